@@ -0,0 +1,178 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate/key pair from disk and reloads it
+// whenever either file's modification time changes, so certificates can be
+// rotated without restarting the server or client using them.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx      sync.RWMutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// NewCertReloader loads the PEM encoded certificate/key pair in certFile and
+// keyFile.
+// It returns an error if the pair can't be loaded.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificate/key pair from disk unconditionally.
+// It returns an error, and keeps serving the previous pair, if the files
+// can't be loaded.
+func (r *CertReloader) Reload() error {
+	certTime, keyTime, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("crypto.CertReloader.Reload() error: %s", err.Error())
+	}
+
+	r.mtx.Lock()
+	r.cert = &cert
+	r.certTime = certTime
+	r.keyTime = keyTime
+	r.mtx.Unlock()
+
+	return nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current()
+}
+
+// GetClientCertificate satisfies tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current()
+}
+
+// current returns the loaded pair, reloading it first if the files changed.
+// A failed reload keeps the previous pair so a half-written rotation doesn't
+// take the server down.
+func (r *CertReloader) current() (*tls.Certificate, error) {
+	certTime, keyTime, err := r.modTimes()
+
+	r.mtx.RLock()
+	stale := err == nil && (!certTime.Equal(r.certTime) || !keyTime.Equal(r.keyTime))
+	cert := r.cert
+	r.mtx.RUnlock()
+
+	if stale {
+		if reloadErr := r.Reload(); reloadErr == nil {
+			r.mtx.RLock()
+			cert = r.cert
+			r.mtx.RUnlock()
+		}
+	}
+
+	return cert, nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("crypto.CertReloader stat error: %s", err.Error())
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("crypto.CertReloader stat error: %s", err.Error())
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates in caFile into a pool.
+// It returns an error if the file can't be read or holds no certificates.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("crypto.LoadCertPool() read error: %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("crypto.LoadCertPool() no certificates found in " + caFile)
+	}
+
+	return pool, nil
+}
+
+// ServerTLSConfig builds a tls.Config for a server that serves the
+// certificate/key pair in certFile and keyFile, reloading it when the files
+// change. If clientCAFile is not empty, clients must present a certificate
+// signed by one of the CAs in it (mutual TLS).
+// It returns an error if any of the files can't be loaded.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// ClientTLSConfig builds a tls.Config for a client. If caFile is not empty
+// the server's certificate is verified against the CAs in it rather than the
+// system roots. If certFile and keyFile are not empty the pair is presented
+// to servers that ask for a client certificate, reloading it when the files
+// change.
+// It returns an error if any of the files can't be loaded.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		reloader, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return config, nil
+}
@@ -0,0 +1,119 @@
+package crypto_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/crypto"
+)
+
+// writeCert writes a self-signed certificate for commonName, and its key, to
+// certFile and keyFile with modTime as their modification time.
+func writeCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key error: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate error: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("key error: %s", err)
+	}
+
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	}
+
+	for name, block := range files {
+		if err := os.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// commonName returns the subject of the certificate r currently serves.
+func commonName(t *testing.T, r *crypto.CertReloader) string {
+	t.Helper()
+
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetCertificate() error: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("certificate error: %s", err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	modTime := time.Now().Add(-time.Minute)
+
+	writeCert(t, certFile, keyFile, "first", modTime)
+
+	r, err := crypto.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader() error: %s", err)
+	}
+
+	if name := commonName(t, r); name != "first" {
+		t.Errorf("GetCertificate() served %q, expected first", name)
+	}
+
+	writeCert(t, certFile, keyFile, "second", modTime.Add(time.Second))
+
+	if name := commonName(t, r); name != "second" {
+		t.Errorf("GetCertificate() after a rotation served %q, expected second", name)
+	}
+
+	// A half-written rotation keeps the previous pair in service.
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, modTime.Add(2*time.Second), modTime.Add(2*time.Second))
+
+	if name := commonName(t, r); name != "second" {
+		t.Errorf("GetCertificate() after a bad rotation served %q, expected second", name)
+	}
+
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload() of a bad key succeeded")
+	}
+
+	if _, err := crypto.NewCertReloader(certFile, filepath.Join(dir, "missing.key")); err == nil {
+		t.Errorf("NewCertReloader() of a missing key succeeded")
+	}
+}
@@ -4,67 +4,104 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
 // Identity represents the name of the rdbms that should be used when
-// it is associated with an action. Such as "mysql".
+// it is associated with an action. Such as "mysql". Each Identity has a
+// Driver registered for it; see RegisterDriver.
 type Identity string
 
 const (
 	// Used to represent the MySQL database driver.
 	MysqlIdentity Identity = "mysql"
+	// Used to represent the PostgreSQL database driver.
+	PostgresIdentity Identity = "postgres"
+	// Used to represent the SQLite database driver.
+	SqliteIdentity Identity = "sqlite"
 )
 
 var (
-	// a key/value map of connection pools i.e. key/pool
+	// a key/value map of connection pools i.e. key/pool. A key maps to nil
+	// while New is connecting it.
 	dbs map[string]*sql.DB
+
+	// the identity each pool in dbs was created with i.e. key/identity
+	identities map[string]Identity
+
+	// A mutex to protect async access to dbs and identities.
+	mtxDbs sync.RWMutex
 )
 
+// ErrPoolExists is returned by New when the pool key is already in use.
+var ErrPoolExists = errors.New("database: pool key already in use")
+
 func init() {
 	// make the dbs map
 	dbs = make(map[string]*sql.DB)
+	identities = make(map[string]Identity)
 }
 
 // New creates a new connection pool identified by poolKey and established by
-// connInfo. Once built, if the connection is good, it sets the
-// max idle & open connections based on the maxIdleConns & maxOpenConns
-// parameters.
-// It returns nil if the connection pool couldn't be built, or a reference
-// to it if it could.
-func New(poolKey string, connInfo ConnectionInfo) *sql.DB {
-	isGoodKey := registerConnectionPool(poolKey)
-
-	if !isGoodKey {
-		fmt.Println("isGoodKey == false")
-		return nil
+// connInfo. Once built, it sets the max idle & open connections from
+// connInfo and pings the database, retrying PingRetries times with a delay
+// starting at RetryDelay and doubling after every attempt; see OnPingRetry.
+// It returns the pool, ErrPoolExists if poolKey is taken, or the error the
+// last attempt failed with, in which case the key is released again.
+// New is thread safe.
+func New(poolKey string, connInfo ConnectionInfo) (*sql.DB, error) {
+	return NewContext(context.Background(), poolKey, connInfo)
+}
+
+// NewContext works like New but gives up retrying once ctx is done.
+func NewContext(ctx context.Context, poolKey string, connInfo ConnectionInfo) (*sql.DB, error) {
+	if !registerConnectionPool(poolKey) {
+		return nil, fmt.Errorf("%w: '%s'", ErrPoolExists, poolKey)
 	}
 
-	dbs[poolKey] = connect(connInfo)
+	db, err := connect(ctx, poolKey, connInfo)
 
-	if dbs[poolKey] != nil {
-		dbs[poolKey].SetMaxIdleConns(connInfo.MaxIdleConns)
-		dbs[poolKey].SetMaxOpenConns(connInfo.MaxOpenConns)
+	mtxDbs.Lock()
+	defer mtxDbs.Unlock()
+
+	if err != nil {
+		delete(dbs, poolKey)
+		return nil, fmt.Errorf("database.New('%s') error: %w", poolKey, err)
 	}
 
-	return dbs[poolKey]
+	dbs[poolKey] = db
+	identities[poolKey] = connInfo.DbIdentity
+
+	return db, nil
 }
 
 // Delete closes and removes the connection pool associated with the pool key
 // parameter.
 // It returns a boolean indicating whether or not it the pool key existed. If it
 // does...it will have deleted it.
+// Delete is thread safe.
 func Delete(poolKey string) bool {
-	_, ok := dbs[poolKey]
-	if !ok {
+	mtxDbs.Lock()
+	db, ok := dbs[poolKey]
+	if ok && db != nil {
+		delete(dbs, poolKey)
+		delete(identities, poolKey)
+	}
+	mtxDbs.Unlock()
+
+	// A key New is still connecting isn't a pool yet.
+	if !ok || db == nil {
 		return false
 	}
 
-	dbs[poolKey].Close()
-	delete(dbs, poolKey)
+	db.Close()
 
 	return true
 }
@@ -73,8 +110,15 @@ func Delete(poolKey string) bool {
 // delete them.
 // It returns false if any close/delete fails...and true if all succeed.
 func DeleteAll() bool {
-	success := true
+	mtxDbs.RLock()
+	keys := make([]string, 0, len(dbs))
 	for key := range dbs {
+		keys = append(keys, key)
+	}
+	mtxDbs.RUnlock()
+
+	success := true
+	for _, key := range keys {
 		if Delete(key) == false {
 			success = false
 		}
@@ -87,11 +131,26 @@ func DeleteAll() bool {
 // connection pool map.
 // It returns nil if no such key exists...or a reference to the pool if it does.
 func Pool(poolKey string) *sql.DB {
-	pool, ok := dbs[poolKey]
+	mtxDbs.RLock()
+	defer mtxDbs.RUnlock()
 
-	if !ok {
-		return nil
-	}
+	return dbs[poolKey]
+}
+
+// PoolIdentity returns the Identity the pool referenced by poolKey was
+// created with.
+// It returns "" if no such key exists.
+func PoolIdentity(poolKey string) Identity {
+	mtxDbs.RLock()
+	defer mtxDbs.RUnlock()
+
+	return identities[poolKey]
+}
 
-	return pool
+// PoolDialect returns the Dialect of the driver the pool referenced by
+// poolKey was created with, or the zero Dialect if the key or the driver
+// doesn't exist.
+func PoolDialect(poolKey string) Dialect {
+	driver, _ := LookupDriver(PoolIdentity(poolKey))
+	return driver.Dialect
 }
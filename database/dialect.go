@@ -0,0 +1,95 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect holds the differences in SQL syntax between databases that the
+// queries nx/database builds have to account for.
+type Dialect struct {
+	// Placeholder returns the bind parameter for the nth argument of a
+	// query, counting from 1. When nil every argument is "?".
+	Placeholder func(n int) string `json:"-"`
+	// IdentQuote is the character identifiers are quoted with. When empty
+	// it is the standard double quote.
+	IdentQuote string `json:"IdentQuote"`
+	// Returning reports whether INSERT supports a RETURNING clause, which is
+	// how generated keys are read when the driver has no LastInsertId.
+	Returning bool `json:"Returning"`
+	// TransactionalDDL reports whether schema changes such as CREATE TABLE
+	// can be rolled back as part of a transaction. MySQL commits them
+	// implicitly.
+	TransactionalDDL bool `json:"TransactionalDDL"`
+}
+
+var (
+	// MysqlDialect is the dialect of MySQL and MariaDB.
+	MysqlDialect = Dialect{IdentQuote: "`"}
+	// PostgresDialect is the dialect of PostgreSQL.
+	PostgresDialect = Dialect{Placeholder: dollarPlaceholder, Returning: true, TransactionalDDL: true}
+	// SqliteDialect is the dialect of SQLite.
+	SqliteDialect = Dialect{TransactionalDDL: true}
+)
+
+func dollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// Bind returns the bind parameter for the nth argument of a query, counting
+// from 1.
+func (d Dialect) Bind(n int) string {
+	if d.Placeholder == nil {
+		return "?"
+	}
+
+	return d.Placeholder(n)
+}
+
+// Quote quotes ident, which may be qualified as in "schema.table", so it is
+// used as is even if it is a reserved word or holds special characters.
+func (d Dialect) Quote(ident string) string {
+	quote := d.IdentQuote
+	if quote == "" {
+		quote = `"`
+	}
+
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = quote + strings.ReplaceAll(part, quote, quote+quote) + quote
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// Rebind rewrites the "?" placeholders of query into the dialect's bind
+// parameters, leaving question marks inside quoted strings and identifiers
+// alone.
+func (d Dialect) Rebind(query string) string {
+	if d.Placeholder == nil {
+		return query
+	}
+
+	var b strings.Builder
+	var quote rune
+	n := 0
+
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString(d.Placeholder(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
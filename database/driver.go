@@ -0,0 +1,185 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DSNBuilder builds the data source name a driver's sql.Open expects from the
+// fields of connInfo.
+type DSNBuilder func(connInfo ConnectionInfo) (string, error)
+
+// Driver describes how to connect to one kind of database.
+type Driver struct {
+	// Name is the database/sql driver name passed to sql.Open. The driver
+	// package itself has to be imported somewhere in the program.
+	Name string
+	// BuildDSN turns a ConnectionInfo into the driver's data source name.
+	BuildDSN DSNBuilder
+	// Dialect is the SQL dialect queries built for the database use.
+	Dialect Dialect
+}
+
+var (
+	// a key/value map of the known drivers i.e. identity/driver
+	drivers map[Identity]Driver
+
+	// A mutex to protect async access to drivers.
+	mtxDrivers sync.RWMutex
+)
+
+func init() {
+	drivers = map[Identity]Driver{
+		MysqlIdentity:    {Name: "mysql", BuildDSN: MysqlDSN, Dialect: MysqlDialect},
+		PostgresIdentity: {Name: "postgres", BuildDSN: PostgresDSN, Dialect: PostgresDialect},
+		SqliteIdentity:   {Name: "sqlite3", BuildDSN: SqliteDSN, Dialect: SqliteDialect},
+	}
+}
+
+// RegisterDriver makes driver available to connections whose DbIdentity is
+// identity, replacing any driver registered for it before.
+// RegisterDriver is thread safe.
+func RegisterDriver(identity Identity, driver Driver) error {
+	if identity == "" || driver.Name == "" || driver.BuildDSN == nil {
+		return errors.New("database.RegisterDriver() error: identity, Name and BuildDSN are required")
+	}
+
+	mtxDrivers.Lock()
+	drivers[identity] = driver
+	mtxDrivers.Unlock()
+
+	return nil
+}
+
+// LookupDriver returns the driver registered for identity.
+// It returns false if there is none.
+func LookupDriver(identity Identity) (Driver, bool) {
+	mtxDrivers.RLock()
+	defer mtxDrivers.RUnlock()
+
+	driver, ok := drivers[identity]
+	return driver, ok
+}
+
+// DSN builds the data source name for connInfo with the driver registered for
+// its DbIdentity.
+// It returns the driver name along with it, or an error if the identity
+// isn't registered or connInfo can't be expressed for the driver.
+func DSN(connInfo ConnectionInfo) (driverName string, dsn string, err error) {
+	driver, ok := LookupDriver(connInfo.DbIdentity)
+	if !ok {
+		return "", "", fmt.Errorf("database: no driver registered for '%s'", connInfo.DbIdentity)
+	}
+
+	dsn, err = driver.BuildDSN(connInfo)
+	if err != nil {
+		return "", "", fmt.Errorf("database: %s dsn error: %w", connInfo.DbIdentity, err)
+	}
+
+	return driver.Name, dsn, nil
+}
+
+// MysqlDSN builds a github.com/go-sql-driver/mysql data source name. Socket,
+// when set, connects over that unix socket instead of Url and Port. SSLMode
+// becomes the driver's tls parameter, e.g. "true", "skip-verify" or
+// "preferred".
+func MysqlDSN(connInfo ConnectionInfo) (string, error) {
+	config := mysql.NewConfig()
+	config.User = connInfo.Username
+	config.Passwd = connInfo.Password
+	config.Net = "tcp"
+	config.Addr = net.JoinHostPort(connInfo.Url, strconv.Itoa(connInfo.Port))
+	config.DBName = connInfo.DbName
+	config.Timeout = 5 * time.Second
+	config.ParseTime = connInfo.ParseTime
+	config.TLSConfig = connInfo.SSLMode
+	// Without it MySQL counts only the rows an UPDATE changed, so saving a
+	// row as it already is would look like it matched none.
+	config.ClientFoundRows = true
+
+	if connInfo.Socket != "" {
+		config.Net = "unix"
+		config.Addr = connInfo.Socket
+	}
+
+	config.Params = make(map[string]string)
+
+	if connInfo.Charset != "" {
+		config.Params["charset"] = connInfo.Charset
+	}
+
+	for key, value := range connInfo.Params {
+		config.Params[key] = value
+	}
+
+	// FormatDSN leaves credentials holding '@', ':' or '/' for the driver to
+	// parse back intact.
+	return config.FormatDSN(), nil
+}
+
+// PostgresDSN builds a github.com/lib/pq connection URL. Socket, when set, is
+// the directory holding the server's unix socket and replaces Url. SSLMode is
+// passed as sslmode, e.g. "disable", "require" or "verify-full". Charset and
+// ParseTime don't apply; the driver always uses UTF-8 and returns times as
+// time.Time.
+func PostgresDSN(connInfo ConnectionInfo) (string, error) {
+	dsn := url.URL{
+		Scheme: "postgres",
+		Path:   "/" + connInfo.DbName,
+	}
+
+	if connInfo.Username != "" {
+		dsn.User = url.UserPassword(connInfo.Username, connInfo.Password)
+	}
+
+	params := url.Values{}
+	params.Set("connect_timeout", "5")
+
+	if connInfo.Socket != "" {
+		params.Set("host", connInfo.Socket)
+	} else {
+		dsn.Host = connInfo.Url
+		if connInfo.Port != 0 {
+			dsn.Host = net.JoinHostPort(connInfo.Url, strconv.Itoa(connInfo.Port))
+		}
+	}
+
+	if connInfo.SSLMode != "" {
+		params.Set("sslmode", connInfo.SSLMode)
+	}
+
+	return dsn.String() + query(params, connInfo.Params), nil
+}
+
+// SqliteDSN builds a github.com/mattn/go-sqlite3 data source name. DbName is
+// the path of the database file, or ":memory:". The driver needs cgo so it
+// isn't imported by this package; programs using SqliteIdentity import it
+// themselves.
+func SqliteDSN(connInfo ConnectionInfo) (string, error) {
+	if connInfo.DbName == "" {
+		return "", errors.New("DbName, the database file, is required")
+	}
+
+	return "file:" + connInfo.DbName + query(url.Values{}, connInfo.Params), nil
+}
+
+// query encodes params, overridden by extra, as a query string including the
+// leading "?", or "" when there are none.
+func query(params url.Values, extra map[string]string) string {
+	for key, value := range extra {
+		params.Set(key, value)
+	}
+
+	if len(params) == 0 {
+		return ""
+	}
+
+	return "?" + params.Encode()
+}
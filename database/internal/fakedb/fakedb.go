@@ -0,0 +1,290 @@
+// nx/database/internal/fakedb is a database/sql driver for the tests of
+// nx/database and its packages. A Driver records every statement run on it,
+// transactions included, and answers them with the replies scripted on it,
+// so tests can check the SQL a package sends and how it handles what comes
+// back without a database server.
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/database"
+)
+
+// ErrRefused is returned by Open while a Driver is refusing connections.
+var ErrRefused = errors.New("fakedb: connection refused")
+
+// The statements logged for transactions, which replies can be scripted for
+// like any other statement.
+const (
+	Begin    = "BEGIN"
+	Commit   = "COMMIT"
+	Rollback = "ROLLBACK"
+)
+
+// Statement is a statement run on a Driver.
+type Statement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// Reply is how a Driver answers a statement. Exec returns LastInsertID and
+// RowsAffected, Query returns Columns and Rows, and both fail with Err when
+// it is set.
+type Reply struct {
+	LastInsertID int64
+	RowsAffected int64
+	Columns      []string
+	Rows         [][]driver.Value
+	Err          error
+}
+
+// Handler answers s in place of the scripted replies. It returns false to
+// leave s to them.
+type Handler func(s Statement) (Reply, bool)
+
+// Driver is a database/sql driver whose answers are scripted by the test
+// using it. Unless told otherwise it accepts every connection and answers
+// every statement with a Reply affecting one row.
+// It is safe for concurrent use.
+type Driver struct {
+	mtx     sync.Mutex
+	log     []Statement
+	refuse  int
+	handler Handler
+	replies map[string]Reply
+	once    map[string][]Reply
+}
+
+// registered numbers the drivers registered with database/sql, which can't
+// take a name twice.
+var registered int64
+
+// Register registers a new Driver with database/sql and makes it the driver
+// of the connections whose DbIdentity is identity, with dialect.
+func Register(identity database.Identity, dialect database.Dialect) *Driver {
+	d := &Driver{
+		replies: map[string]Reply{"": {RowsAffected: 1}},
+		once:    make(map[string][]Reply),
+	}
+
+	name := "nxfakedb" + strconv.FormatInt(atomic.AddInt64(&registered, 1), 10)
+	sql.Register(name, d)
+
+	database.RegisterDriver(identity, database.Driver{
+		Name:     name,
+		BuildDSN: func(database.ConnectionInfo) (string, error) { return "", nil },
+		Dialect:  dialect,
+	})
+
+	return d
+}
+
+// NewPool registers a new Driver with dialect and opens the pool poolKey on
+// it, which is deleted when t ends.
+func NewPool(t testing.TB, poolKey string, dialect database.Dialect) *Driver {
+	t.Helper()
+
+	identity := database.Identity("fakedb-" + poolKey)
+	d := Register(identity, dialect)
+
+	if _, err := database.New(poolKey, ConnectionInfo(identity)); err != nil {
+		t.Fatalf("database.New() error: %s", err)
+	}
+	t.Cleanup(func() { database.Delete(poolKey) })
+
+	return d
+}
+
+// ConnectionInfo returns the default ConnectionInfo for identity, retrying
+// refused connections after a millisecond.
+func ConnectionInfo(identity database.Identity) database.ConnectionInfo {
+	var connInfo database.ConnectionInfo
+	connInfo.Init()
+	connInfo.DbIdentity = identity
+	connInfo.RetryDelay = time.Millisecond
+
+	return connInfo
+}
+
+// Refuse makes the next n connections fail with ErrRefused.
+func (d *Driver) Refuse(n int) {
+	d.mtx.Lock()
+	d.refuse = n
+	d.mtx.Unlock()
+}
+
+// Handle makes h answer statements before the scripted replies.
+func (d *Driver) Handle(h Handler) {
+	d.mtx.Lock()
+	d.handler = h
+	d.mtx.Unlock()
+}
+
+// Reply makes r the answer to every statement that is query. An empty query
+// sets the answer to the statements without one of their own.
+func (d *Driver) Reply(query string, r Reply) {
+	d.mtx.Lock()
+	d.replies[query] = r
+	d.mtx.Unlock()
+}
+
+// ReplyOnce queues r as the answer to the next statement that is query,
+// ahead of the one Reply set.
+func (d *Driver) ReplyOnce(query string, r Reply) {
+	d.mtx.Lock()
+	d.once[query] = append(d.once[query], r)
+	d.mtx.Unlock()
+}
+
+// Statements returns the statements run so far.
+func (d *Driver) Statements() []Statement {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return append([]Statement(nil), d.log...)
+}
+
+// Queries returns the text of the statements run so far.
+func (d *Driver) Queries() []string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	queries := make([]string, len(d.log))
+	for i, s := range d.log {
+		queries[i] = s.Query
+	}
+
+	return queries
+}
+
+// Last returns the statement run last, or a zero Statement if there is none.
+func (d *Driver) Last() Statement {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(d.log) == 0 {
+		return Statement{}
+	}
+
+	return d.log[len(d.log)-1]
+}
+
+// Reset forgets the statements run so far.
+func (d *Driver) Reset() {
+	d.mtx.Lock()
+	d.log = nil
+	d.mtx.Unlock()
+}
+
+// Open implements driver.Driver.
+func (d *Driver) Open(string) (driver.Conn, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.refuse > 0 {
+		d.refuse--
+		return nil, ErrRefused
+	}
+
+	return &conn{d}, nil
+}
+
+// run logs the statement query and returns its reply.
+func (d *Driver) run(query string, args []driver.NamedValue) Reply {
+	s := Statement{Query: query, Args: make([]driver.Value, len(args))}
+	for i, arg := range args {
+		s.Args[i] = arg.Value
+	}
+
+	d.mtx.Lock()
+	d.log = append(d.log, s)
+	handler := d.handler
+	d.mtx.Unlock()
+
+	// Called unlocked so the handler may script the driver.
+	if handler != nil {
+		if r, ok := handler(s); ok {
+			return r
+		}
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if queued := d.once[query]; len(queued) > 0 {
+		d.once[query] = queued[1:]
+		return queued[0]
+	}
+
+	if r, ok := d.replies[query]; ok {
+		return r
+	}
+
+	return d.replies[""]
+}
+
+type conn struct{ d *Driver }
+
+func (c *conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements aren't supported")
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if err := c.d.run(Begin, nil).Err; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *conn) Commit() error   { return c.d.run(Commit, nil).Err }
+func (c *conn) Rollback() error { return c.d.run(Rollback, nil).Err }
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r := c.d.run(query, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return result{r.LastInsertID, r.RowsAffected}, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r := c.d.run(query, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return &rows{columns: r.Columns, rows: r.Rows}, nil
+}
+
+type result struct{ id, affected int64 }
+
+func (r result) LastInsertId() (int64, error) { return r.id, nil }
+func (r result) RowsAffected() (int64, error) { return r.affected, nil }
+
+type rows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *rows) Columns() []string { return r.columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
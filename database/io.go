@@ -1,13 +1,357 @@
 package database
 
 import (
-  "fmt"
-  "database/sql"
-  _ "github.com/go-sql-driver/mysql"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
-// TODO: this is unfinished...didn't need it...may need removal
-func ScanType(v interface{}, rows *sql.Rows, colType *sql.ColumnType) error {
-  fmt.Printf("DatabaseTypeName: %v\n", colType.DatabaseTypeName())
-  return nil
-}
\ No newline at end of file
+// Field is a struct field rows are scanned into.
+type Field struct {
+	// Column is the column named by the field's db tag, or else the field
+	// name lower cased.
+	Column string
+	// Index is the field's index path for reflect.Value.FieldByIndex.
+	Index []int
+	// Options are the comma separated tag options following the column.
+	Options []string
+}
+
+// HasOption reports whether the field's tag has option.
+func (f *Field) HasOption(option string) bool {
+	for _, o := range f.Options {
+		if o == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// structFields is the cached field layout of a struct type.
+type structFields struct {
+	list []Field
+	// byColumn maps lower cased columns to their position in list.
+	byColumn map[string]int
+}
+
+// fieldCache caches the layout of every struct type scanned into i.e.
+// reflect.Type/*structFields.
+var fieldCache sync.Map
+
+var (
+	scannerType  = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType     = reflect.TypeOf(time.Time{})
+	timePtrType  = reflect.TypeOf((*time.Time)(nil))
+	nullTimeType = reflect.TypeOf(sql.NullTime{})
+)
+
+// timeLayouts are the layouts timestamps sent as text are parsed with, such
+// as the DATETIME and DATE values of MySQL without parseTime.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02",
+}
+
+// ScanType scans the current row of rows into v, a pointer to a struct, by
+// matching each column to the field tagged `db:"column"`, or else named like
+// the column, ignoring case. Fields of embedded structs are matched as if
+// they were the outer struct's, and fields tagged `db:"-"` are skipped.
+// Options following the column name in a tag, such as `db:"id,pk"`, are left
+// to nx/database/model. Columns without a field are discarded. NULL columns
+// need pointer or sql.Scanner fields such as sql.NullString. time.Time,
+// *time.Time and sql.NullTime fields also accept timestamps the driver sends
+// as text, which MySQL does unless parseTime is set. When v points to
+// anything else than a struct, such as an int, the row must have a single
+// column which is scanned into it.
+// It returns an error if v isn't a pointer or a column can't be converted.
+func ScanType(v interface{}, rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	dest, err := destinations(reflect.ValueOf(v), columns)
+	if err != nil {
+		return err
+	}
+
+	return rows.Scan(dest...)
+}
+
+// ScanOne scans the first row of rows into v like ScanType and closes rows.
+// It returns sql.ErrNoRows if there are no rows.
+func ScanOne(v interface{}, rows *sql.Rows) error {
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	if err := ScanType(v, rows); err != nil {
+		return err
+	}
+
+	return rows.Close()
+}
+
+// ScanAll scans every row of rows into v, a pointer to a slice of structs or
+// of pointers to structs, appending to it, and closes rows.
+// It returns the error that stopped the iteration.
+func ScanAll(v interface{}, rows *sql.Rows) error {
+	defer rows.Close()
+
+	slice := reflect.ValueOf(v)
+	if slice.Kind() != reflect.Pointer || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("database.ScanAll() error: expected a pointer to a slice, got %T", v)
+	}
+	slice = slice.Elem()
+
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Pointer
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		elem := reflect.New(elemType)
+
+		dest, err := destinations(elem, columns)
+		if err != nil {
+			return err
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		if isPtr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return rows.Close()
+}
+
+// destinations returns what rows.Scan should scan each of columns into for
+// the value ptr points to.
+func destinations(ptr reflect.Value, columns []string) ([]interface{}, error) {
+	if ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+		return nil, fmt.Errorf("database: scan destination must be a non-nil pointer, got %s", ptr.Kind())
+	}
+
+	if !isStruct(ptr.Type().Elem()) {
+		if len(columns) != 1 {
+			return nil, fmt.Errorf("database: scanning %d columns into a %s", len(columns), ptr.Type().Elem())
+		}
+		if isTime(ptr.Type().Elem()) {
+			return []interface{}{timeScanner{ptr.Elem()}}, nil
+		}
+		return []interface{}{ptr.Interface()}, nil
+	}
+
+	fields := fieldsOf(ptr.Type().Elem())
+	structValue := ptr.Elem()
+	dest := make([]interface{}, len(columns))
+
+	for i, column := range columns {
+		pos, ok := fields.byColumn[strings.ToLower(column)]
+		if !ok {
+			dest[i] = new(interface{})
+			continue
+		}
+
+		field, err := FieldByIndex(structValue, fields.list[pos].Index)
+		if err != nil {
+			return nil, err
+		}
+
+		if isTime(field.Type()) {
+			dest[i] = timeScanner{field}
+			continue
+		}
+
+		dest[i] = field.Addr().Interface()
+	}
+
+	return dest, nil
+}
+
+// Fields returns the fields of the struct type t rows are scanned into, in
+// declaration order with the fields of embedded structs in place of the
+// embedded field. The result is cached per type and must not be modified.
+func Fields(t reflect.Type) []Field {
+	return fieldsOf(t).list
+}
+
+func fieldsOf(t reflect.Type) *structFields {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(*structFields)
+	}
+
+	fields := &structFields{byColumn: make(map[string]int)}
+	addFields(fields, t, nil)
+
+	actual, _ := fieldCache.LoadOrStore(t, fields)
+	return actual.(*structFields)
+}
+
+// addFields adds the fields of the struct type t, found at the index path
+// parent, to fields. A column already taken by an outer field isn't
+// overridden by the fields of an embedded struct.
+func addFields(fields *structFields, t reflect.Type, parent []int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("db"), ",")
+		index := append(append([]int(nil), parent...), i)
+
+		if tag[0] == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+
+		if field.Anonymous && tag[0] == "" && isStruct(fieldType) {
+			addFields(fields, fieldType, index)
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		column := tag[0]
+		if column == "" {
+			column = strings.ToLower(field.Name)
+		}
+
+		if pos, ok := fields.byColumn[strings.ToLower(column)]; ok {
+			// The shallower field wins, as with Go's promoted fields.
+			if len(fields.list[pos].Index) <= len(index) {
+				continue
+			}
+			fields.list[pos] = Field{Column: column, Index: index, Options: tag[1:]}
+			continue
+		}
+
+		fields.byColumn[strings.ToLower(column)] = len(fields.list)
+		fields.list = append(fields.list, Field{Column: column, Index: index, Options: tag[1:]})
+	}
+}
+
+// isStruct reports whether t is a struct scanned field by field, as opposed
+// to time.Time or a sql.Scanner such as sql.NullString which are scanned as
+// a single value.
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType && !reflect.PointerTo(t).Implements(scannerType)
+}
+
+// isTime reports whether t is one of the timestamp types timeScanner scans.
+func isTime(t reflect.Type) bool {
+	return t == timeType || t == timePtrType || t == nullTimeType
+}
+
+// timeScanner scans a column into a time.Time, *time.Time or sql.NullTime
+// field, parsing timestamps the driver sends as text.
+type timeScanner struct {
+	field reflect.Value
+}
+
+func (s timeScanner) Scan(src interface{}) error {
+	var t time.Time
+
+	switch src := src.(type) {
+	case nil:
+		if s.field.Type() == timeType {
+			return errors.New("database: converting NULL to time.Time is unsupported")
+		}
+		s.field.Set(reflect.Zero(s.field.Type()))
+		return nil
+	case time.Time:
+		t = src
+	case []byte:
+		parsed, err := parseTime(string(src))
+		if err != nil {
+			return err
+		}
+		t = parsed
+	case string:
+		parsed, err := parseTime(src)
+		if err != nil {
+			return err
+		}
+		t = parsed
+	default:
+		return fmt.Errorf("database: can't scan %T into %s", src, s.field.Type())
+	}
+
+	switch s.field.Type() {
+	case timePtrType:
+		s.field.Set(reflect.ValueOf(&t))
+	case nullTimeType:
+		s.field.Set(reflect.ValueOf(sql.NullTime{Time: t, Valid: true}))
+	default:
+		s.field.Set(reflect.ValueOf(t))
+	}
+
+	return nil
+}
+
+// parseTime parses the timestamp text with the first of timeLayouts that
+// fits, in UTC. MySQL's zero dates parse as the zero time.
+// It returns an error if no layout fits.
+func parseTime(text string) (time.Time, error) {
+	if strings.HasPrefix(text, "0000-00-00") {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("database: can't parse '%s' as a time", text)
+}
+
+// FieldByIndex returns the field of the struct v at index, allocating nil
+// embedded struct pointers along the way.
+func FieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, errors.New("database: can't set embedded pointer to unexported struct")
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v, nil
+}
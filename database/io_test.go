@@ -0,0 +1,130 @@
+package database_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/internal/fakedb"
+)
+
+type Audit struct {
+	CreatedAt time.Time  `db:"created_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
+}
+
+type user struct {
+	ID       int64
+	Name     string         `db:"user_name"`
+	Email    sql.NullString `db:"email"`
+	Age      *int64
+	Password string `db:"-"`
+	Audit
+}
+
+func TestScan(t *testing.T) {
+	d := fakedb.NewPool(t, t.Name(), database.MysqlDialect)
+	db := database.Pool(t.Name())
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	d.Reply("users", fakedb.Reply{
+		Columns: []string{"id", "user_name", "email", "age", "password", "created_at", "deleted_at", "extra"},
+		Rows: [][]driver.Value{
+			{int64(1), "ann", "ann@example.com", int64(30), "secret", created, nil, "x"},
+			{int64(2), "bob", nil, nil, "secret", created, created, "y"},
+		},
+	})
+	d.Reply("count", fakedb.Reply{Columns: []string{"count"}, Rows: [][]driver.Value{{int64(2)}}})
+	d.Reply("none", fakedb.Reply{Columns: []string{"id"}})
+
+	rows, err := db.Query("users")
+	if err != nil {
+		t.Fatalf("Query() error: %s", err)
+	}
+
+	var users []*user
+	if err := database.ScanAll(&users, rows); err != nil {
+		t.Fatalf("ScanAll() error: %s", err)
+	}
+
+	if len(users) != 2 {
+		t.Fatalf("ScanAll() scanned %d users, expected 2", len(users))
+	}
+
+	ann, bob := users[0], users[1]
+
+	if ann.ID != 1 || ann.Name != "ann" || ann.Email.String != "ann@example.com" || ann.Age == nil || *ann.Age != 30 ||
+		ann.Password != "" || !ann.CreatedAt.Equal(created) || ann.DeletedAt != nil {
+		t.Errorf("ScanAll() first row = %+v", ann)
+	}
+
+	if bob.Email.Valid || bob.Age != nil || bob.DeletedAt == nil || !bob.DeletedAt.Equal(created) {
+		t.Errorf("ScanAll() second row = %+v, expected NULL email and age", bob)
+	}
+
+	var first user
+	rows, _ = db.Query("users")
+	if err := database.ScanOne(&first, rows); err != nil || first.Name != "ann" {
+		t.Errorf("ScanOne() = %+v, %v, expected ann", first, err)
+	}
+
+	var count int
+	rows, _ = db.Query("count")
+	if err := database.ScanOne(&count, rows); err != nil || count != 2 {
+		t.Errorf("ScanOne() into an int = %d, %v, expected 2", count, err)
+	}
+
+	rows, _ = db.Query("none")
+	if err := database.ScanOne(&first, rows); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ScanOne() of no rows error = %v, expected sql.ErrNoRows", err)
+	}
+}
+
+func TestScanTextTimestamps(t *testing.T) {
+	d := fakedb.NewPool(t, t.Name(), database.MysqlDialect)
+	db := database.Pool(t.Name())
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC)
+
+	// MySQL without parseTime sends DATETIME columns as text.
+	d.Reply("audits", fakedb.Reply{
+		Columns: []string{"created_at", "deleted_at"},
+		Rows: [][]driver.Value{
+			{[]byte("2024-01-02 03:04:05.6"), nil},
+			{[]byte("2024-01-02 03:04:05.6"), []byte("0000-00-00 00:00:00")},
+		},
+	})
+	d.Reply("max", fakedb.Reply{Columns: []string{"max"}, Rows: [][]driver.Value{{"2024-01-02"}}})
+	d.Reply("bad", fakedb.Reply{Columns: []string{"created_at"}, Rows: [][]driver.Value{{[]byte("yesterday")}}})
+
+	rows, err := db.Query("audits")
+	if err != nil {
+		t.Fatalf("Query() error: %s", err)
+	}
+
+	var audits []Audit
+	if err := database.ScanAll(&audits, rows); err != nil {
+		t.Fatalf("ScanAll() of text timestamps error: %s", err)
+	}
+
+	if len(audits) != 2 || !audits[0].CreatedAt.Equal(created) || audits[0].DeletedAt != nil ||
+		audits[1].DeletedAt == nil || !audits[1].DeletedAt.IsZero() {
+		t.Errorf("ScanAll() of text timestamps = %+v", audits)
+	}
+
+	var max sql.NullTime
+	rows, _ = db.Query("max")
+	if err := database.ScanOne(&max, rows); err != nil || !max.Valid || !max.Time.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("ScanOne() of a text date = %+v, %v", max, err)
+	}
+
+	var audit Audit
+	rows, _ = db.Query("bad")
+	if err := database.ScanOne(&audit, rows); err == nil {
+		t.Errorf("ScanOne() of a malformed timestamp succeeded with %+v", audit)
+	}
+}
@@ -0,0 +1,559 @@
+// nx/database/migrate provides a way to evolve the schema of a database
+// managed through nx/database with versioned migrations. Each migration is
+// a pair of SQL files in a directory or an embed.FS, named after its version
+// and a description:
+//
+//	0001_create_users.up.sql
+//	0001_create_users.down.sql
+//	0002_add_user_email.up.sql
+//	0002_add_user_email.down.sql
+//
+// The up file applies the migration and the optional down file reverts it.
+// The versions applied are recorded in a schema_migrations table. On
+// databases that can roll schema changes back, PostgreSQL and SQLite, every
+// migration runs in a transaction along with its record, unless its file
+// starts with the line
+//
+//	-- migrate:no-transaction
+//
+// which statements such as PostgreSQL's CREATE INDEX CONCURRENTLY need.
+// MySQL commits schema changes as they run, so a migration that fails
+// halfway has to be cleaned up by hand there. The mysql driver also only
+// runs files holding several statements with the multiStatements=true
+// parameter, see database.ConnectionInfo.Params.
+//
+// Runners on MySQL and PostgreSQL hold an advisory lock while they work, so
+// instances of a program started together don't apply the same migration
+// twice. SQLite locks the whole database file for every write already.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/query"
+)
+
+// DefaultTable is the table applied versions are recorded in unless
+// Migrator.Table says otherwise.
+const DefaultTable = "schema_migrations"
+
+// noTransaction is the first line of a migration file that has to run
+// outside of a transaction.
+const noTransaction = "-- migrate:no-transaction"
+
+// ErrNoDown is returned when reverting a migration without a down file.
+var ErrNoDown = errors.New("migrate: migration can't be reverted")
+
+// Migration is one versioned change to a schema.
+type Migration struct {
+	Version int64
+	Name    string
+	// Up and Down are the SQL applying and reverting the migration. Down
+	// is empty if it can't be reverted.
+	Up   string
+	Down string
+	// NoTransaction reports whether the migration has to run outside of a
+	// transaction.
+	NoTransaction bool
+}
+
+// Status is a migration along with whether it has been applied.
+type Status struct {
+	Migration
+	Applied bool
+	// AppliedAt is when the migration was applied, or the zero time.
+	AppliedAt time.Time
+}
+
+// Load reads the migrations in dir of fsys, which may be an embed.FS, from
+// files named "<version>_<name>.up.sql" and "<version>_<name>.down.sql".
+// Other files are ignored.
+// It returns the migrations sorted by version, or an error if a file can't
+// be read, a version is used twice or a down file has no up file.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	downs := make(map[int64]string)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		base, direction, ok := cutSuffix(entry.Name())
+		if !ok {
+			continue
+		}
+
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: '%s' doesn't start with a version", entry.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		script := string(data)
+
+		if direction == "down" {
+			if _, ok := downs[version]; ok {
+				return nil, fmt.Errorf("migrate: version %d has more than one down file", version)
+			}
+			downs[version] = script
+			continue
+		}
+
+		if _, ok := byVersion[version]; ok {
+			return nil, fmt.Errorf("migrate: version %d has more than one up file", version)
+		}
+
+		byVersion[version] = &Migration{
+			Version:       version,
+			Name:          name,
+			Up:            script,
+			NoTransaction: hasNoTransaction(script),
+		}
+	}
+
+	for version, script := range downs {
+		migration, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("migrate: version %d has a down file but no up file", version)
+		}
+
+		migration.Down = script
+		migration.NoTransaction = migration.NoTransaction || hasNoTransaction(script)
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// LoadDir reads the migrations in the directory dir like Load.
+func LoadDir(dir string) ([]Migration, error) {
+	return Load(os.DirFS(dir), ".")
+}
+
+// cutSuffix splits a migration file name into its base and direction.
+// It returns false if name isn't a migration file.
+func cutSuffix(name string) (base string, direction string, ok bool) {
+	for _, direction := range []string{"up", "down"} {
+		if base, ok := strings.CutSuffix(name, "."+direction+".sql"); ok {
+			return base, direction, true
+		}
+	}
+
+	return "", "", false
+}
+
+func hasNoTransaction(script string) bool {
+	line, _, _ := strings.Cut(script, "\n")
+	return strings.TrimSpace(line) == noTransaction
+}
+
+// Migrator applies and reverts migrations on the database of a pool.
+type Migrator struct {
+	// PoolKey is the key of the nx/database pool migrated.
+	PoolKey string
+	// Table is the table applied versions are recorded in, DefaultTable
+	// when empty.
+	Table string
+	// Migrations are the known migrations, sorted by version.
+	Migrations []Migration
+	// Logger, when set, is told about every migration applied or reverted.
+	Logger *log.Logger
+}
+
+// New returns a Migrator applying migrations to the pool referenced by
+// poolKey.
+// It returns an error if two migrations share a version.
+func New(poolKey string, migrations []Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Version == sorted[i-1].Version {
+			return nil, fmt.Errorf("migrate: version %d is used twice", sorted[i].Version)
+		}
+	}
+
+	return &Migrator{PoolKey: poolKey, Table: DefaultTable, Migrations: sorted}, nil
+}
+
+// Status returns every known migration and whether it has been applied,
+// followed by the versions applied that aren't known, say by a newer
+// release of the program, with just their version and name.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.run(ctx, func(s *session) error {
+		applied, err := s.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			status := Status{Migration: migration}
+			if record, ok := applied[migration.Version]; ok {
+				status.Applied = true
+				status.AppliedAt = record.AppliedAt
+				delete(applied, migration.Version)
+			}
+			statuses = append(statuses, status)
+		}
+
+		var unknown []Status
+		for _, record := range applied {
+			unknown = append(unknown, Status{
+				Migration: Migration{Version: record.Version, Name: record.Name},
+				Applied:   true,
+				AppliedAt: record.AppliedAt,
+			})
+		}
+
+		sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+		statuses = append(statuses, unknown...)
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// Up applies every migration that hasn't been, in order of version.
+// It returns the versions applied, up to the one that failed if any.
+func (m *Migrator) Up(ctx context.Context) ([]int64, error) {
+	var versions []int64
+
+	err := m.run(ctx, func(s *session) error {
+		applied, err := s.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			if err := s.apply(ctx, migration, true); err != nil {
+				return err
+			}
+
+			versions = append(versions, migration.Version)
+		}
+
+		return nil
+	})
+
+	return versions, err
+}
+
+// Down reverts the migration applied last.
+// It returns the version reverted, 0 if none was applied, or ErrNoDown if
+// it has no down file or isn't known.
+func (m *Migrator) Down(ctx context.Context) (int64, error) {
+	var version int64
+
+	err := m.run(ctx, func(s *session) error {
+		migration, ok, err := s.last(ctx)
+		if err != nil || !ok {
+			return err
+		}
+
+		if err := s.apply(ctx, migration, false); err != nil {
+			return err
+		}
+
+		version = migration.Version
+		return nil
+	})
+
+	return version, err
+}
+
+// Redo reverts the migration applied last and applies it again, which is
+// handy while writing it.
+// It returns the version redone, 0 if none was applied, or ErrNoDown if
+// it has no down file or isn't known.
+func (m *Migrator) Redo(ctx context.Context) (int64, error) {
+	var version int64
+
+	err := m.run(ctx, func(s *session) error {
+		migration, ok, err := s.last(ctx)
+		if err != nil || !ok {
+			return err
+		}
+
+		if err := s.apply(ctx, migration, false); err != nil {
+			return err
+		}
+
+		if err := s.apply(ctx, migration, true); err != nil {
+			return err
+		}
+
+		version = migration.Version
+		return nil
+	})
+
+	return version, err
+}
+
+// session is a Migrator working on a single connection, which holds the
+// advisory lock.
+type session struct {
+	*Migrator
+	conn    *sql.Conn
+	dialect database.Dialect
+}
+
+// record is a row of the migrations table.
+type record struct {
+	Version   int64     `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// advisoryLock holds the statements taking and releasing a lock that only
+// concerns the programs asking for it, and the key they take. Both answer a
+// single 1 when they succeeded.
+type advisoryLock struct {
+	lock   string
+	unlock string
+	key    func(table string) interface{}
+}
+
+// advisoryLocks are the advisory locks of the databases that have them.
+var advisoryLocks = map[database.Identity]advisoryLock{
+	database.MysqlIdentity: {
+		lock:   "SELECT GET_LOCK(?, -1)",
+		unlock: "SELECT RELEASE_LOCK(?)",
+		key:    func(table string) interface{} { return "nx.migrate." + table },
+	},
+	database.PostgresIdentity: {
+		lock:   "SELECT 1 FROM pg_advisory_lock($1)",
+		unlock: "SELECT pg_advisory_unlock($1)::int",
+		key: func(table string) interface{} {
+			h := fnv.New64a()
+			h.Write([]byte("nx.migrate." + table))
+			return int64(h.Sum64())
+		},
+	},
+}
+
+// run runs fn on a connection of the pool holding the advisory lock, with
+// the migrations table created.
+func (m *Migrator) run(ctx context.Context, fn func(s *session) error) (err error) {
+	db := database.Pool(m.PoolKey)
+	if db == nil {
+		return fmt.Errorf("migrate: no pool registered as '%s'", m.PoolKey)
+	}
+
+	if m.Table == "" {
+		m.Table = DefaultTable
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if lock, ok := advisoryLocks[database.PoolIdentity(m.PoolKey)]; ok {
+		key := lock.key(m.Table)
+
+		if err := queryLock(ctx, conn, lock.lock, key); err != nil {
+			return fmt.Errorf("migrate: taking the lock: %w", err)
+		}
+
+		// Released even when ctx is done.
+		defer func() {
+			if unlockErr := queryLock(context.Background(), conn, lock.unlock, key); unlockErr != nil && err == nil {
+				err = fmt.Errorf("migrate: releasing the lock: %w", unlockErr)
+			}
+		}()
+	}
+
+	s := &session{Migrator: m, conn: conn, dialect: database.PoolDialect(m.PoolKey)}
+
+	create := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (%s BIGINT NOT NULL PRIMARY KEY, %s VARCHAR(255) NOT NULL, %s TIMESTAMP NOT NULL)",
+		s.dialect.Quote(m.Table),
+		s.dialect.Quote("version"),
+		s.dialect.Quote("name"),
+		s.dialect.Quote("applied_at"),
+	)
+
+	if _, err := conn.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("migrate: creating %s: %w", m.Table, err)
+	}
+
+	return fn(s)
+}
+
+// queryLock runs the advisory lock statement stmt for key on conn.
+// It returns an error if stmt failed or didn't answer 1, such as GET_LOCK
+// when the lock couldn't be taken or RELEASE_LOCK when it wasn't held.
+func queryLock(ctx context.Context, conn *sql.Conn, stmt string, key interface{}) error {
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, stmt, key).Scan(&got); err != nil {
+		return err
+	}
+
+	if !got.Valid {
+		return fmt.Errorf("'%s' answered NULL, expected 1", stmt)
+	}
+	if got.Int64 != 1 {
+		return fmt.Errorf("'%s' answered %d, expected 1", stmt, got.Int64)
+	}
+
+	return nil
+}
+
+// applied returns the records of the applied migrations by version.
+func (s *session) applied(ctx context.Context) (map[int64]record, error) {
+	q, args, err := query.Select("version", "name", "applied_at").From(s.Table).Build(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []record
+	if err := database.ScanAll(&records, rows); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]record, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+// last returns the migration applied last.
+// It returns false if none was applied, or ErrNoDown if it isn't known or
+// can't be reverted.
+func (s *session) last(ctx context.Context) (Migration, bool, error) {
+	q, args, err := query.Select("version").From(s.Table).OrderBy("version DESC").Limit(1).Build(s.dialect)
+	if err != nil {
+		return Migration{}, false, err
+	}
+
+	rows, err := s.conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return Migration{}, false, err
+	}
+
+	var version int64
+	if err := database.ScanOne(&version, rows); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Migration{}, false, nil
+		}
+		return Migration{}, false, err
+	}
+
+	for _, migration := range s.Migrations {
+		if migration.Version == version {
+			if migration.Down == "" {
+				return Migration{}, false, fmt.Errorf("%w: version %d has no down file", ErrNoDown, version)
+			}
+			return migration, true, nil
+		}
+	}
+
+	return Migration{}, false, fmt.Errorf("%w: version %d isn't known", ErrNoDown, version)
+}
+
+// execer is what a migration runs on, the connection or a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// apply applies the migration, or reverts it when up is false, and records
+// the change, both in a transaction when the dialect and migration allow.
+func (s *session) apply(ctx context.Context, migration Migration, up bool) error {
+	script, action := migration.Up, "applying"
+	if !up {
+		script, action = migration.Down, "reverting"
+	}
+
+	if s.Logger != nil {
+		s.Logger.Printf("migrate: %s %d_%s", action, migration.Version, migration.Name)
+	}
+
+	var tx *sql.Tx
+	var exec execer = s.conn
+
+	if s.dialect.TransactionalDDL && !migration.NoTransaction {
+		var err error
+		if tx, err = s.conn.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		exec = tx
+	}
+
+	if _, err := exec.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migrate: %s %d_%s: %w", action, migration.Version, migration.Name, err)
+	}
+
+	var q string
+	var args []interface{}
+	var err error
+
+	if up {
+		q, args, err = query.Insert(s.Table).
+			Columns("version", "name", "applied_at").
+			Values(migration.Version, migration.Name, time.Now().UTC()).
+			Build(s.dialect)
+	} else {
+		q, args, err = query.Delete(s.Table).Where(query.Eq("version", migration.Version)).Build(s.dialect)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := exec.ExecContext(ctx, q, args...); err != nil {
+		return fmt.Errorf("migrate: recording %d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	if tx != nil {
+		return tx.Commit()
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package migrate_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/internal/fakedb"
+	"github.com/steviesama/nx/database/migrate"
+)
+
+// schema keeps the migrations table for a fake driver, rolling it back
+// with the transactions, and logs every other statement run. The advisory
+// lock's statements are logged as LOCK and UNLOCK.
+type schema struct {
+	mtx     sync.Mutex
+	log     []string
+	applied map[int64]string
+	// saved is applied as of the open transaction's start.
+	saved map[int64]string
+}
+
+func (s *schema) handle(st fakedb.Statement) (fakedb.Reply, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch query := st.Query; {
+	case query == fakedb.Begin:
+		s.log = append(s.log, query)
+		s.saved = make(map[int64]string)
+		for version, name := range s.applied {
+			s.saved[version] = name
+		}
+	case query == fakedb.Rollback:
+		s.log = append(s.log, query)
+		s.applied = s.saved
+	case strings.HasPrefix(query, "SELECT 1 FROM pg_advisory_lock"):
+		s.log = append(s.log, "LOCK")
+		return locked, true
+	case strings.HasPrefix(query, "SELECT pg_advisory_unlock"):
+		s.log = append(s.log, "UNLOCK")
+		return locked, true
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS"):
+	case strings.HasPrefix(query, `INSERT INTO "schema_migrations"`):
+		s.applied[st.Args[0].(int64)] = st.Args[1].(string)
+	case strings.HasPrefix(query, `DELETE FROM "schema_migrations"`):
+		delete(s.applied, st.Args[0].(int64))
+	case strings.HasPrefix(query, "SELECT"):
+		return s.versions(query), true
+	default:
+		// Scripts and commits are left to the scripted replies.
+		s.log = append(s.log, query)
+		return fakedb.Reply{}, false
+	}
+
+	return fakedb.Reply{RowsAffected: 1}, true
+}
+
+// locked answers the advisory lock statements that succeeded.
+var locked = fakedb.Reply{Columns: []string{"locked"}, Rows: [][]driver.Value{{int64(1)}}}
+
+// versions answers the queries of the applied versions, newest first.
+func (s *schema) versions(query string) fakedb.Reply {
+	var versions []int64
+	for version := range s.applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+	if strings.Contains(query, "LIMIT 1") {
+		r := fakedb.Reply{Columns: []string{"version"}}
+		if len(versions) > 0 {
+			r.Rows = [][]driver.Value{{versions[0]}}
+		}
+		return r
+	}
+
+	r := fakedb.Reply{Columns: []string{"version", "name", "applied_at"}}
+	for _, version := range versions {
+		r.Rows = append(r.Rows, []driver.Value{version, s.applied[version], time.Now()})
+	}
+
+	return r
+}
+
+func (s *schema) statements() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]string(nil), s.log...)
+}
+
+var migrations = fstest.MapFS{
+	"sql/0001_create_users.up.sql":     {Data: []byte("CREATE TABLE users (id INT)")},
+	"sql/0001_create_users.down.sql":   {Data: []byte("DROP TABLE users")},
+	"sql/0002_index_users.up.sql":      {Data: []byte("-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY users_id ON users (id)")},
+	"sql/0002_index_users.down.sql":    {Data: []byte("DROP INDEX users_id")},
+	"sql/0010_add_email.up.sql":        {Data: []byte("ALTER TABLE users ADD email TEXT")},
+	"sql/README.md":                    {Data: []byte("not a migration")},
+	"sql/0003_irreversible.up.sql.bak": {Data: []byte("ignored")},
+}
+
+func TestLoad(t *testing.T) {
+	loaded, err := migrate.Load(migrations, "sql")
+	if err != nil {
+		t.Fatalf("Load() error: %s", err)
+	}
+
+	expected := []migrate.Migration{
+		{Version: 1, Name: "create_users", Up: "CREATE TABLE users (id INT)", Down: "DROP TABLE users"},
+		{Version: 2, Name: "index_users", Up: "-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY users_id ON users (id)", Down: "DROP INDEX users_id", NoTransaction: true},
+		{Version: 10, Name: "add_email", Up: "ALTER TABLE users ADD email TEXT"},
+	}
+
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("Load() = %+v, expected %+v", loaded, expected)
+	}
+
+	orphan := fstest.MapFS{"0004_gone.down.sql": {Data: []byte("DROP TABLE gone")}}
+	if _, err := migrate.Load(orphan, "."); err == nil {
+		t.Errorf("Load() of a down file without an up file succeeded")
+	}
+}
+
+func TestUpDownRedo(t *testing.T) {
+	db := &schema{applied: make(map[int64]string)}
+	d := fakedb.Register(database.PostgresIdentity, database.PostgresDialect)
+	d.Handle(db.handle)
+	d.Reply("FAIL", fakedb.Reply{Err: errors.New("syntax error")})
+
+	if _, err := database.New("migrate", fakedb.ConnectionInfo(database.PostgresIdentity)); err != nil {
+		t.Fatalf("database.New() error: %s", err)
+	}
+	defer database.Delete("migrate")
+
+	loaded, err := migrate.Load(migrations, "sql")
+	if err != nil {
+		t.Fatalf("Load() error: %s", err)
+	}
+
+	failing := append(loaded, migrate.Migration{Version: 11, Name: "broken", Up: "FAIL"})
+
+	m, err := migrate.New("migrate", failing)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	var logged bytes.Buffer
+	m.Logger = log.New(&logged, "", 0)
+
+	ctx := context.Background()
+
+	versions, err := m.Up(ctx)
+	if err == nil || !reflect.DeepEqual(versions, []int64{1, 2, 10}) {
+		t.Fatalf("Up() = %v, %v, expected 1, 2 and 10 applied before 11 failed", versions, err)
+	}
+
+	expected := []string{
+		"LOCK",
+		"BEGIN", "CREATE TABLE users (id INT)", "COMMIT",
+		"-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY users_id ON users (id)",
+		"BEGIN", "ALTER TABLE users ADD email TEXT", "COMMIT",
+		"BEGIN", "FAIL", "ROLLBACK",
+		"UNLOCK",
+	}
+
+	if statements := db.statements(); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Up() ran %q, expected %q", statements, expected)
+	}
+
+	want := "migrate: applying 1_create_users\nmigrate: applying 2_index_users\nmigrate: applying 10_add_email\nmigrate: applying 11_broken\n"
+	if got := logged.String(); got != want {
+		t.Errorf("Up() logged %q, expected %q", got, want)
+	}
+
+	m.Migrations = loaded
+
+	statuses, err := m.Status(ctx)
+	if err != nil || len(statuses) != 3 || !statuses[2].Applied || statuses[2].AppliedAt.IsZero() {
+		t.Errorf("Status() = %+v, %v", statuses, err)
+	}
+
+	if _, err := m.Down(ctx); !errors.Is(err, migrate.ErrNoDown) {
+		t.Errorf("Down() of a migration without a down file error = %v, expected ErrNoDown", err)
+	}
+
+	m.Migrations = loaded[:2]
+
+	statuses, err = m.Status(ctx)
+	if err != nil || len(statuses) != 3 || statuses[2].Version != 10 || !statuses[2].Applied {
+		t.Errorf("Status() with an unknown version applied = %+v, %v", statuses, err)
+	}
+
+	delete(db.applied, 10)
+
+	if version, err := m.Redo(ctx); err != nil || version != 2 {
+		t.Errorf("Redo() = %d, %v, expected 2", version, err)
+	}
+
+	for want := int64(2); want > 0; want-- {
+		if version, err := m.Down(ctx); err != nil || version != want {
+			t.Errorf("Down() = %d, %v, expected %d", version, err, want)
+		}
+	}
+
+	if version, err := m.Down(ctx); err != nil || version != 0 {
+		t.Errorf("Down() with nothing applied = %d, %v", version, err)
+	}
+
+	if len(db.applied) != 0 {
+		t.Errorf("versions left applied: %v", db.applied)
+	}
+}
+
+func TestMysqlLock(t *testing.T) {
+	d := fakedb.Register(database.MysqlIdentity, database.MysqlDialect)
+
+	if _, err := database.New("mysql", fakedb.ConnectionInfo(database.MysqlIdentity)); err != nil {
+		t.Fatalf("database.New() error: %s", err)
+	}
+	defer database.Delete("mysql")
+
+	m, err := migrate.New("mysql", nil)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	ctx := context.Background()
+
+	const lock, unlock = "SELECT GET_LOCK(?, -1)", "SELECT RELEASE_LOCK(?)"
+
+	// GET_LOCK answers 0 when it times out and NULL on an error.
+	for _, answer := range []driver.Value{int64(0), nil} {
+		d.Reset()
+		d.Reply(lock, fakedb.Reply{Columns: []string{"locked"}, Rows: [][]driver.Value{{answer}}})
+
+		if _, err := m.Status(ctx); err == nil {
+			t.Errorf("Status() succeeded when GET_LOCK answered %v", answer)
+		}
+
+		if statements := d.Statements(); len(statements) != 1 || statements[0].Query != lock {
+			t.Errorf("Status() ran %v after GET_LOCK answered %v", statements, answer)
+		}
+	}
+
+	d.Reply(lock, locked)
+	d.Reply(unlock, fakedb.Reply{Columns: []string{"released"}, Rows: [][]driver.Value{{int64(0)}}})
+	d.Reply("", fakedb.Reply{Columns: []string{"version", "name", "applied_at"}})
+
+	if _, err := m.Status(ctx); err == nil || !strings.Contains(err.Error(), "releasing the lock") {
+		t.Errorf("Status() error = %v when RELEASE_LOCK answered 0, expected a release error", err)
+	}
+
+	d.Reply(unlock, locked)
+
+	if _, err := m.Status(ctx); err != nil {
+		t.Errorf("Status() error: %s", err)
+	}
+}
+
+func TestMysqlTextAppliedAt(t *testing.T) {
+	d := fakedb.Register(database.MysqlIdentity, database.MysqlDialect)
+
+	if _, err := database.New("mysql-text", fakedb.ConnectionInfo(database.MysqlIdentity)); err != nil {
+		t.Fatalf("database.New() error: %s", err)
+	}
+	defer database.Delete("mysql-text")
+
+	m, err := migrate.New("mysql-text", []migrate.Migration{{Version: 1, Name: "create_users", Up: "CREATE TABLE users (id INT)"}})
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	// Without parseTime the MySQL driver returns the TIMESTAMP as []byte.
+	d.Reply("SELECT GET_LOCK(?, -1)", locked)
+	d.Reply("SELECT RELEASE_LOCK(?)", locked)
+	d.Reply("SELECT `version`, `name`, `applied_at` FROM `schema_migrations`", fakedb.Reply{
+		Columns: []string{"version", "name", "applied_at"},
+		Rows:    [][]driver.Value{{int64(1), []byte("create_users"), []byte("2024-01-02 03:04:05")}},
+	})
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status() with a text applied_at error: %s", err)
+	}
+
+	appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if len(statuses) != 1 || !statuses[0].Applied || !statuses[0].AppliedAt.Equal(appliedAt) {
+		t.Errorf("Status() = %+v, expected version 1 applied at %s", statuses, appliedAt)
+	}
+}
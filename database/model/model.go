@@ -1,8 +1,463 @@
-// nx/database/model will provide a way to define data model programmatically.
-// Unlike the well-defined datatypes you create for packages with a specific purpose,
-// model will allow you to define a data model and will use the text/template package
-// in order to generate the model definitions before compile time.
-// In order for this to work...a conversion program will have to be build in the cmd/
-// folder which must be built and run before the primary program is built as it will rely
-// on the generated data model.
+// nx/database/model provides a way to define data models as tagged structs
+// and have their rows inserted, updated, deleted and found without writing
+// the SQL by hand. A model is a struct with a TableName method whose fields
+// are mapped to columns the way nx/database scans rows: by their
+// `db:"column"` tag, or else their lower cased name. Options following the
+// column in the tag give a field its role:
+//
+//	pk       the primary key; generated by the database when left zero
+//	created  set to the current time by Insert
+//	updated  set to the current time by Insert and Update
+//	version  the optimistic lock, starting at 1 and bumped by every Update
+//
+// For example:
+//
+//	type User struct {
+//		ID        int64     `db:"id,pk"`
+//		Name      string    `db:"name"`
+//		CreatedAt time.Time `db:"created_at,created"`
+//		UpdatedAt time.Time `db:"updated_at,updated"`
+//		Version   int64     `db:"version,version"`
+//	}
+//
+//	func (*User) TableName() string { return "users" }
+//
+// The functions run against the nx/database pool registered under a pool
+// key, using the Dialect of the driver it was created with.
 package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/steviesama/nx/database"
+)
+
+// ErrNotFound is returned when no row has the model's primary key.
+var ErrNotFound = errors.New("model: not found")
+
+// ErrStale is returned by Update and Delete when the row's version no longer
+// matches the model's, because it was changed or deleted since it was read.
+var ErrStale = errors.New("model: row changed since it was read")
+
+// Model is implemented by the structs this package stores.
+type Model interface {
+	// TableName returns the name of the table the model is stored in.
+	TableName() string
+}
+
+// Meta describes how a model type maps to its table.
+type Meta struct {
+	Table string
+	// Columns holds every column, the primary key included, in field order.
+	Columns []database.Field
+	// PK, Created, Updated and Version are the columns with those roles, or
+	// nil if the model has none.
+	PK      *database.Field
+	Created *database.Field
+	Updated *database.Field
+	Version *database.Field
+}
+
+// metas caches the Meta of every model type i.e. reflect.Type/*Meta.
+var metas sync.Map
+
+// MetaOf returns the Meta of the model m, a pointer to a struct.
+// It returns an error if m isn't one or it has no primary key.
+func MetaOf(m Model) (*Meta, error) {
+	t := reflect.TypeOf(m)
+	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("model: %T is not a pointer to a struct", m)
+	}
+
+	if meta, ok := metas.Load(t); ok {
+		return meta.(*Meta), nil
+	}
+
+	meta := &Meta{
+		Table:   m.TableName(),
+		Columns: database.Fields(t.Elem()),
+	}
+
+	for i := range meta.Columns {
+		column := &meta.Columns[i]
+
+		roles := []struct {
+			option string
+			role   **database.Field
+		}{
+			{"pk", &meta.PK},
+			{"created", &meta.Created},
+			{"updated", &meta.Updated},
+			{"version", &meta.Version},
+		}
+
+		for _, role := range roles {
+			if !column.HasOption(role.option) {
+				continue
+			}
+			if *role.role != nil {
+				return nil, fmt.Errorf("model: %s has more than one %s column", t.Elem(), role.option)
+			}
+			*role.role = column
+		}
+	}
+
+	if meta.PK == nil {
+		return nil, fmt.Errorf("model: %s has no column tagged pk", t.Elem())
+	}
+
+	if meta.Version != nil {
+		switch t.Elem().FieldByIndex(meta.Version.Index).Type.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+		default:
+			return nil, fmt.Errorf("model: the version column of %s must be an int", t.Elem())
+		}
+	}
+
+	actual, _ := metas.LoadOrStore(t, meta)
+	return actual.(*Meta), nil
+}
+
+// columnList returns the quoted names of columns joined by commas.
+func columnList(dialect database.Dialect, columns []database.Field) string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = dialect.Quote(column.Column)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// value returns the field of the struct v that column is stored from.
+func value(v reflect.Value, column *database.Field) reflect.Value {
+	field, _ := database.FieldByIndex(v, column.Index)
+	return field
+}
+
+// pool returns the pool and dialect registered under poolKey.
+func pool(poolKey string) (*sql.DB, database.Dialect, error) {
+	db := database.Pool(poolKey)
+	if db == nil {
+		return nil, database.Dialect{}, fmt.Errorf("model: no pool registered as '%s'", poolKey)
+	}
+
+	return db, database.PoolDialect(poolKey), nil
+}
+
+// Insert stores m as a new row. The created and updated columns are set to
+// the current time and the version column to 1 first. A zero primary key is
+// left for the database to generate and read back into m. Should the insert
+// fail, those columns are put back as they were.
+func Insert(ctx context.Context, poolKey string, m Model) (err error) {
+	meta, err := MetaOf(m)
+	if err != nil {
+		return err
+	}
+
+	db, dialect, err := pool(poolKey)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(m).Elem()
+	now := time.Now().UTC()
+
+	// Kept to put back should the insert fail.
+	var fields, previous []reflect.Value
+	for _, column := range []*database.Field{meta.Created, meta.Updated, meta.Version} {
+		if column != nil {
+			field := value(v, column)
+			fields = append(fields, field)
+			previous = append(previous, reflect.New(field.Type()).Elem())
+			previous[len(previous)-1].Set(field)
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			for i, field := range fields {
+				field.Set(previous[i])
+			}
+		}
+	}()
+
+	for _, column := range []*database.Field{meta.Created, meta.Updated} {
+		if column != nil {
+			setTime(value(v, column), now)
+		}
+	}
+
+	if meta.Version != nil {
+		value(v, meta.Version).SetInt(1)
+	}
+
+	pk := value(v, meta.PK)
+	generated := pk.IsZero()
+
+	var columns []database.Field
+	var args []interface{}
+	var binds []string
+
+	for i := range meta.Columns {
+		column := &meta.Columns[i]
+		if generated && column == meta.PK {
+			continue
+		}
+
+		columns = append(columns, *column)
+		args = append(args, value(v, column).Interface())
+		binds = append(binds, dialect.Bind(len(args)))
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		dialect.Quote(meta.Table), columnList(dialect, columns), strings.Join(binds, ", "))
+
+	if !generated {
+		_, err := db.ExecContext(ctx, query, args...)
+		return err
+	}
+
+	if dialect.Returning {
+		query += " RETURNING " + dialect.Quote(meta.PK.Column)
+		return db.QueryRowContext(ctx, query, args...).Scan(pk.Addr().Interface())
+	}
+
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("model: reading the generated %s: %w", meta.PK.Column, err)
+	}
+
+	switch pk.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		pk.SetInt(id)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		pk.SetUint(uint64(id))
+	default:
+		return fmt.Errorf("model: can't store generated id in %s", pk.Type())
+	}
+
+	return nil
+}
+
+// Update writes every column of m to the row with its primary key, setting
+// the updated column to the current time first. With a version column only
+// a row still at m's version is updated, and m's version is bumped.
+// It returns ErrStale if the row's version moved on, or ErrNotFound if there
+// is no such row.
+func Update(ctx context.Context, poolKey string, m Model) error {
+	meta, err := MetaOf(m)
+	if err != nil {
+		return err
+	}
+
+	db, dialect, err := pool(poolKey)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(m).Elem()
+
+	// Kept to put back should the update fail.
+	var updatedAt, previous reflect.Value
+	if meta.Updated != nil {
+		updatedAt = value(v, meta.Updated)
+		previous = reflect.New(updatedAt.Type()).Elem()
+		previous.Set(updatedAt)
+		setTime(updatedAt, time.Now().UTC())
+	}
+
+	var sets []string
+	var args []interface{}
+
+	for i := range meta.Columns {
+		column := &meta.Columns[i]
+
+		switch column {
+		case meta.PK, meta.Created:
+			continue
+		case meta.Version:
+			sets = append(sets, fmt.Sprintf("%s = %s + 1", dialect.Quote(column.Column), dialect.Quote(column.Column)))
+			continue
+		}
+
+		args = append(args, value(v, column).Interface())
+		sets = append(sets, fmt.Sprintf("%s = %s", dialect.Quote(column.Column), dialect.Bind(len(args))))
+	}
+
+	where, args := whereKey(dialect, meta, v, args)
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", dialect.Quote(meta.Table), strings.Join(sets, ", "), where)
+
+	if err := execOne(ctx, db, meta, query, args); err != nil {
+		if updatedAt.IsValid() {
+			updatedAt.Set(previous)
+		}
+		return err
+	}
+
+	if meta.Version != nil {
+		version := value(v, meta.Version)
+		version.SetInt(version.Int() + 1)
+	}
+
+	return nil
+}
+
+// Delete removes the row with m's primary key, and with a version column
+// only while it is still at m's version.
+// It returns ErrStale if the row's version moved on, or ErrNotFound if there
+// is no such row.
+func Delete(ctx context.Context, poolKey string, m Model) error {
+	meta, err := MetaOf(m)
+	if err != nil {
+		return err
+	}
+
+	db, dialect, err := pool(poolKey)
+	if err != nil {
+		return err
+	}
+
+	where, args := whereKey(dialect, meta, reflect.ValueOf(m).Elem(), nil)
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", dialect.Quote(meta.Table), where)
+
+	return execOne(ctx, db, meta, query, args)
+}
+
+// FindByID reads the row whose primary key is id into m.
+// It returns ErrNotFound if there is no such row.
+func FindByID(ctx context.Context, poolKey string, m Model, id interface{}) error {
+	meta, err := MetaOf(m)
+	if err != nil {
+		return err
+	}
+
+	db, dialect, err := pool(poolKey)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s",
+		columnList(dialect, meta.Columns), dialect.Quote(meta.Table), dialect.Quote(meta.PK.Column), dialect.Bind(1))
+
+	rows, err := db.QueryContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if err := database.ScanOne(m, rows); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// FindWhere reads the rows of the table of the model type dest holds, a
+// pointer to a slice of models or of pointers to them, that match where, a
+// SQL condition with "?" placeholders for args, appending them to dest. An
+// empty where matches every row. Placeholders are rewritten for the pool's
+// dialect.
+func FindWhere(ctx context.Context, poolKey string, dest interface{}, where string, args ...interface{}) error {
+	slice := reflect.TypeOf(dest)
+	if slice.Kind() != reflect.Pointer || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("model.FindWhere() error: expected a pointer to a slice, got %T", dest)
+	}
+
+	elem := slice.Elem().Elem()
+	if elem.Kind() != reflect.Pointer {
+		elem = reflect.PointerTo(elem)
+	}
+
+	m, ok := reflect.New(elem.Elem()).Interface().(Model)
+	if !ok {
+		return fmt.Errorf("model.FindWhere() error: %s doesn't implement Model", elem)
+	}
+
+	meta, err := MetaOf(m)
+	if err != nil {
+		return err
+	}
+
+	db, dialect, err := pool(poolKey)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", columnList(dialect, meta.Columns), dialect.Quote(meta.Table))
+	if where != "" {
+		query += " WHERE " + dialect.Rebind(where)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	return database.ScanAll(dest, rows)
+}
+
+// whereKey returns the condition matching the row of the model v by its
+// primary key, and its version if it has one, with their values appended to
+// args.
+func whereKey(dialect database.Dialect, meta *Meta, v reflect.Value, args []interface{}) (string, []interface{}) {
+	args = append(args, value(v, meta.PK).Interface())
+	where := fmt.Sprintf("%s = %s", dialect.Quote(meta.PK.Column), dialect.Bind(len(args)))
+
+	if meta.Version != nil {
+		args = append(args, value(v, meta.Version).Interface())
+		where += fmt.Sprintf(" AND %s = %s", dialect.Quote(meta.Version.Column), dialect.Bind(len(args)))
+	}
+
+	return where, args
+}
+
+// execOne runs query, which should affect a single row.
+// It returns ErrStale or ErrNotFound if it affected none.
+func execOne(ctx context.Context, db *sql.DB, meta *Meta, query string, args []interface{}) error {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		if meta.Version != nil {
+			return ErrStale
+		}
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// setTime stores t in a time.Time, *time.Time or sql.NullTime field.
+func setTime(field reflect.Value, t time.Time) {
+	switch field.Interface().(type) {
+	case time.Time:
+		field.Set(reflect.ValueOf(t))
+	case *time.Time:
+		field.Set(reflect.ValueOf(&t))
+	case sql.NullTime:
+		field.Set(reflect.ValueOf(sql.NullTime{Time: t, Valid: true}))
+	}
+}
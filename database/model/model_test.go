@@ -0,0 +1,183 @@
+package model_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/internal/fakedb"
+	"github.com/steviesama/nx/database/model"
+)
+
+type Timestamps struct {
+	CreatedAt time.Time `db:"created_at,created"`
+	UpdatedAt time.Time `db:"updated_at,updated"`
+}
+
+type user struct {
+	ID      int64  `db:"id,pk"`
+	Name    string `db:"name"`
+	Version int64  `db:"version,version"`
+	Timestamps
+}
+
+func (*user) TableName() string { return "users" }
+
+func TestInsertAndUpdate(t *testing.T) {
+	d := fakedb.NewPool(t, "mysql", database.MysqlDialect)
+	ctx := context.Background()
+
+	d.Reply("", fakedb.Reply{LastInsertID: 7, RowsAffected: 1})
+
+	u := &user{Name: "ann"}
+	if err := model.Insert(ctx, "mysql", u); err != nil {
+		t.Fatalf("Insert() error: %s", err)
+	}
+
+	query, args := d.Last().Query, d.Last().Args
+	if want := "INSERT INTO `users` (`name`, `version`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?)"; query != want {
+		t.Errorf("Insert() ran %q, expected %q", query, want)
+	}
+
+	if u.ID != 7 || u.Version != 1 || u.CreatedAt.IsZero() || !u.UpdatedAt.Equal(u.CreatedAt) || len(args) != 4 {
+		t.Errorf("Insert() left %+v with args %v", u, args)
+	}
+
+	inserted := u.UpdatedAt
+
+	if err := model.Update(ctx, "mysql", u); err != nil {
+		t.Fatalf("Update() error: %s", err)
+	}
+
+	query, args = d.Last().Query, d.Last().Args
+	if want := "UPDATE `users` SET `name` = ?, `version` = `version` + 1, `updated_at` = ? WHERE `id` = ? AND `version` = ?"; query != want {
+		t.Errorf("Update() ran %q, expected %q", query, want)
+	}
+
+	if u.Version != 2 || !reflect.DeepEqual(args[2:], []driver.Value{int64(7), int64(1)}) {
+		t.Errorf("Update() left version %d with args %v", u.Version, args)
+	}
+
+	d.Reply("", fakedb.Reply{RowsAffected: 0})
+	before := u.UpdatedAt
+
+	if err := model.Update(ctx, "mysql", u); !errors.Is(err, model.ErrStale) {
+		t.Errorf("Update() of a changed row error = %v, expected ErrStale", err)
+	}
+
+	if u.Version != 2 || !u.UpdatedAt.Equal(before) || u.UpdatedAt.Before(inserted) {
+		t.Errorf("a stale Update() changed %+v", u)
+	}
+
+	if err := model.Delete(ctx, "mysql", u); !errors.Is(err, model.ErrStale) {
+		t.Errorf("Delete() of a changed row error = %v, expected ErrStale", err)
+	}
+}
+
+func TestFindPostgres(t *testing.T) {
+	d := fakedb.NewPool(t, "postgres", database.PostgresDialect)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	columns := []string{"id", "name", "version", "created_at", "updated_at"}
+	d.Reply("", fakedb.Reply{Columns: columns, Rows: [][]driver.Value{{int64(3), "bob", int64(4), now, now}}})
+
+	var u user
+	if err := model.FindByID(ctx, "postgres", &u, 3); err != nil {
+		t.Fatalf("FindByID() error: %s", err)
+	}
+
+	query := d.Last().Query
+	if want := `SELECT "id", "name", "version", "created_at", "updated_at" FROM "users" WHERE "id" = $1`; query != want {
+		t.Errorf("FindByID() ran %q, expected %q", query, want)
+	}
+
+	if u.ID != 3 || u.Name != "bob" || u.Version != 4 || !u.CreatedAt.Equal(now) {
+		t.Errorf("FindByID() = %+v", u)
+	}
+
+	d.Reply("", fakedb.Reply{Columns: columns})
+
+	if err := model.FindByID(ctx, "postgres", &u, 4); !errors.Is(err, model.ErrNotFound) {
+		t.Errorf("FindByID() of a missing row error = %v, expected ErrNotFound", err)
+	}
+
+	d.Reply("", fakedb.Reply{Columns: columns, Rows: [][]driver.Value{{int64(3), "bob", int64(4), now, now}, {int64(5), "cy", int64(1), now, now}}})
+
+	var users []user
+	if err := model.FindWhere(ctx, "postgres", &users, "name <> ? AND version > ?", "ann", 0); err != nil || len(users) != 2 {
+		t.Fatalf("FindWhere() = %+v, %v", users, err)
+	}
+
+	query = d.Last().Query
+	if want := `SELECT "id", "name", "version", "created_at", "updated_at" FROM "users" WHERE name <> $1 AND version > $2`; query != want {
+		t.Errorf("FindWhere() ran %q, expected %q", query, want)
+	}
+
+	d.Reply("", fakedb.Reply{Columns: []string{"id"}, Rows: [][]driver.Value{{int64(9)}}})
+
+	created := &user{Name: "dee"}
+	if err := model.Insert(ctx, "postgres", created); err != nil || created.ID != 9 {
+		t.Errorf("Insert() = %d, %v, expected the id RETURNING gave", created.ID, err)
+	}
+
+	query = d.Last().Query
+	if want := `INSERT INTO "users" ("name", "version", "created_at", "updated_at") VALUES ($1, $2, $3, $4) RETURNING "id"`; query != want {
+		t.Errorf("Insert() ran %q, expected %q", query, want)
+	}
+}
+
+func TestFindMysqlTextTimestamps(t *testing.T) {
+	d := fakedb.NewPool(t, "mysql-text", database.MysqlDialect)
+	ctx := context.Background()
+
+	// Without parseTime the MySQL driver returns DATETIME columns as []byte.
+	columns := []string{"id", "name", "version", "created_at", "updated_at"}
+	d.Reply("", fakedb.Reply{Columns: columns, Rows: [][]driver.Value{
+		{int64(3), []byte("bob"), int64(4), []byte("2024-01-02 03:04:05"), []byte("2024-05-06 07:08:09.123456")},
+	}})
+
+	var u user
+	if err := model.FindByID(ctx, "mysql-text", &u, 3); err != nil {
+		t.Fatalf("FindByID() with text timestamps error: %s", err)
+	}
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+
+	if u.ID != 3 || u.Name != "bob" || !u.CreatedAt.Equal(created) || !u.UpdatedAt.Equal(updated) {
+		t.Errorf("FindByID() = %+v, expected created %s and updated %s", u, created, updated)
+	}
+}
+
+func TestInsertFailure(t *testing.T) {
+	d := fakedb.NewPool(t, "failing", database.MysqlDialect)
+	ctx := context.Background()
+
+	failure := errors.New("duplicate entry")
+	d.Reply("", fakedb.Reply{Err: failure})
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := &user{ID: 4, Name: "ann", Version: 3, Timestamps: Timestamps{CreatedAt: created}}
+
+	if err := model.Insert(ctx, "failing", u); !errors.Is(err, failure) {
+		t.Fatalf("Insert() error = %v, expected the driver's error", err)
+	}
+
+	if u.ID != 4 || u.Version != 3 || !u.CreatedAt.Equal(created) || !u.UpdatedAt.IsZero() {
+		t.Errorf("a failed Insert() left %+v, expected it untouched", u)
+	}
+
+	generated := &user{Name: "bob"}
+	if err := model.Insert(ctx, "failing", generated); !errors.Is(err, failure) {
+		t.Fatalf("Insert() error = %v, expected the driver's error", err)
+	}
+
+	if generated.ID != 0 || generated.Version != 0 || !generated.CreatedAt.IsZero() || !generated.UpdatedAt.IsZero() {
+		t.Errorf("a failed Insert() left %+v, expected it untouched", generated)
+	}
+}
@@ -0,0 +1,67 @@
+package database_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/internal/fakedb"
+)
+
+func TestNewRetriesPing(t *testing.T) {
+	defer database.DeleteAll()
+
+	d := fakedb.Register("retried", database.MysqlDialect)
+	d.Refuse(2)
+
+	var waits []time.Duration
+	database.OnPingRetry = func(poolKey string, attempt int, err error, wait time.Duration) {
+		if poolKey != "retried" || attempt != len(waits)+1 || !errors.Is(err, fakedb.ErrRefused) {
+			t.Errorf("OnPingRetry(%q, %d, %v, %s) called", poolKey, attempt, err, wait)
+		}
+		waits = append(waits, wait)
+	}
+	defer func() { database.OnPingRetry = nil }()
+
+	db, err := database.New("retried", fakedb.ConnectionInfo("retried"))
+	if err != nil || db == nil {
+		t.Fatalf("New() after two refused pings = %v, %v", db, err)
+	}
+
+	if want := []time.Duration{time.Millisecond, 2 * time.Millisecond}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("OnPingRetry() was called with waits %v, expected %v", waits, want)
+	}
+
+	if database.Pool("retried") != db {
+		t.Errorf("Pool() didn't return the pool New built")
+	}
+
+	fakedb.Register("other", database.MysqlDialect)
+
+	if _, err := database.New("retried", fakedb.ConnectionInfo("other")); !errors.Is(err, database.ErrPoolExists) {
+		t.Errorf("New() with a taken key error = %v, expected ErrPoolExists", err)
+	}
+}
+
+func TestNewReleasesKeyOnFailure(t *testing.T) {
+	defer database.DeleteAll()
+
+	d := fakedb.Register("down", database.MysqlDialect)
+	d.Refuse(100)
+
+	if _, err := database.New("down", fakedb.ConnectionInfo("down")); !errors.Is(err, fakedb.ErrRefused) {
+		t.Fatalf("New() of an unreachable database error = %v, expected the driver's error", err)
+	}
+
+	if database.Pool("down") != nil {
+		t.Errorf("Pool() returned a pool for a failed New()")
+	}
+
+	d.Refuse(0)
+
+	if _, err := database.New("down", fakedb.ConnectionInfo("down")); err != nil {
+		t.Errorf("New() reusing a key that failed before error: %s", err)
+	}
+}
@@ -0,0 +1,251 @@
+package query
+
+// Cond is a condition of a WHERE clause or join. Conditions are built with
+// Eq, In, And, Or and the other functions of this package, or written by
+// hand with Raw.
+type Cond interface {
+	writeCond(w *writer)
+}
+
+// Expr is a fragment of SQL written by hand, with "?" placeholders for Args.
+// The placeholders are rendered for the dialect the query is built for.
+type Expr struct {
+	SQL  string
+	Args []interface{}
+}
+
+// Raw returns the Expr sql with args. It can be used as a condition, a
+// selected column or a value to insert or set, e.g. Raw("NOW()").
+func Raw(sql string, args ...interface{}) Expr {
+	return Expr{SQL: sql, Args: args}
+}
+
+func (e Expr) writeCond(w *writer) {
+	w.expr(e)
+}
+
+// compare is a comparison of a column to a value or another column.
+type compare struct {
+	column string
+	op     string
+	value  interface{}
+	// isColumn reports whether value is a column name rather than a value.
+	isColumn bool
+}
+
+func (c compare) writeCond(w *writer) {
+	w.ident(c.column)
+
+	if c.value == nil && !c.isColumn {
+		switch c.op {
+		case "=":
+			w.WriteString(" IS NULL")
+			return
+		case "<>":
+			w.WriteString(" IS NOT NULL")
+			return
+		}
+	}
+
+	w.WriteString(" " + c.op + " ")
+
+	if c.isColumn {
+		w.ident(c.value.(string))
+	} else {
+		w.value(c.value)
+	}
+}
+
+// Eq returns the condition column = value, or column IS NULL when value is
+// nil.
+func Eq(column string, value interface{}) Cond {
+	return compare{column: column, op: "=", value: value}
+}
+
+// Ne returns the condition column <> value, or column IS NOT NULL when value
+// is nil.
+func Ne(column string, value interface{}) Cond {
+	return compare{column: column, op: "<>", value: value}
+}
+
+// Lt returns the condition column < value.
+func Lt(column string, value interface{}) Cond {
+	return compare{column: column, op: "<", value: value}
+}
+
+// Le returns the condition column <= value.
+func Le(column string, value interface{}) Cond {
+	return compare{column: column, op: "<=", value: value}
+}
+
+// Gt returns the condition column > value.
+func Gt(column string, value interface{}) Cond {
+	return compare{column: column, op: ">", value: value}
+}
+
+// Ge returns the condition column >= value.
+func Ge(column string, value interface{}) Cond {
+	return compare{column: column, op: ">=", value: value}
+}
+
+// Like returns the condition column LIKE pattern.
+func Like(column string, pattern string) Cond {
+	return compare{column: column, op: "LIKE", value: pattern}
+}
+
+// IsNull returns the condition column IS NULL.
+func IsNull(column string) Cond {
+	return Eq(column, nil)
+}
+
+// IsNotNull returns the condition column IS NOT NULL.
+func IsNotNull(column string) Cond {
+	return Ne(column, nil)
+}
+
+// On returns the condition left = right between two columns, as used to
+// join tables, e.g. On("u.id", "o.user_id").
+func On(left string, right string) Cond {
+	return compare{column: left, op: "=", value: right, isColumn: true}
+}
+
+// in is a column matched against a list of values.
+type in struct {
+	column string
+	values []interface{}
+	not    bool
+}
+
+func (c in) writeCond(w *writer) {
+	// An empty list matches no row, or every row when negated.
+	if len(c.values) == 0 {
+		if c.not {
+			w.WriteString("1 = 1")
+		} else {
+			w.WriteString("1 = 0")
+		}
+		return
+	}
+
+	w.ident(c.column)
+	if c.not {
+		w.WriteString(" NOT")
+	}
+	w.WriteString(" IN (")
+
+	for i, value := range c.values {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.value(value)
+	}
+
+	w.WriteString(")")
+}
+
+// In returns the condition column IN (values...). Without values it matches
+// no row.
+func In(column string, values ...interface{}) Cond {
+	return in{column: column, values: values}
+}
+
+// NotIn returns the condition column NOT IN (values...). Without values it
+// matches every row.
+func NotIn(column string, values ...interface{}) Cond {
+	return in{column: column, values: values, not: true}
+}
+
+// junction is conditions joined by AND or OR.
+type junction struct {
+	op    string
+	conds []Cond
+}
+
+func (j junction) writeCond(w *writer) {
+	j.write(w, false)
+}
+
+// write writes the conditions joined by the junction's operator, in
+// parentheses unless top is set, as it is for a whole WHERE clause.
+func (j junction) write(w *writer, top bool) {
+	var conds []Cond
+	for _, cond := range j.conds {
+		if cond != nil {
+			conds = append(conds, cond)
+		}
+	}
+
+	switch len(conds) {
+	case 0:
+		// AND of nothing is true and OR of nothing false.
+		if j.op == "AND" {
+			w.WriteString("1 = 1")
+		} else {
+			w.WriteString("1 = 0")
+		}
+		return
+	case 1:
+		if top {
+			conds[0].writeCond(w)
+		} else {
+			writeOperand(w, conds[0])
+		}
+		return
+	}
+
+	if !top {
+		w.WriteString("(")
+	}
+
+	for i, cond := range conds {
+		if i > 0 {
+			w.WriteString(" " + j.op + " ")
+		}
+		writeOperand(w, cond)
+	}
+
+	if !top {
+		w.WriteString(")")
+	}
+}
+
+// writeOperand writes cond as an operand of AND, OR or NOT, in parentheses
+// if it is hand written as it may hold operators of its own.
+func writeOperand(w *writer, cond Cond) {
+	if _, ok := cond.(Expr); ok {
+		w.WriteString("(")
+		cond.writeCond(w)
+		w.WriteString(")")
+		return
+	}
+
+	cond.writeCond(w)
+}
+
+// And returns the condition that all of conds hold. Nil conditions are
+// skipped and without any it is always true.
+func And(conds ...Cond) Cond {
+	return junction{op: "AND", conds: conds}
+}
+
+// Or returns the condition that any of conds holds. Nil conditions are
+// skipped and without any it is always false.
+func Or(conds ...Cond) Cond {
+	return junction{op: "OR", conds: conds}
+}
+
+// not negates a condition.
+type not struct {
+	cond Cond
+}
+
+func (n not) writeCond(w *writer) {
+	w.WriteString("NOT (")
+	n.cond.writeCond(w)
+	w.WriteString(")")
+}
+
+// Not returns the condition that cond doesn't hold.
+func Not(cond Cond) Cond {
+	return not{cond: cond}
+}
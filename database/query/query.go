@@ -0,0 +1,487 @@
+// nx/database/query provides a way to build SELECT, INSERT, UPDATE and
+// DELETE statements without concatenating SQL by hand. Table and column
+// names are quoted for the database, and values are passed as arguments
+// with the placeholders the database expects, "?" for MySQL and SQLite and
+// "$1", "$2"... for PostgreSQL. For example:
+//
+//	q, args, err := query.Select("u.id", "u.name").
+//		From("users u").
+//		LeftJoin("orders o", query.On("o.user_id", "u.id")).
+//		Where(query.Eq("u.active", true), query.Gt("o.total", 100)).
+//		OrderBy("u.name DESC").
+//		Limit(10).
+//		Build(database.PoolDialect("main"))
+//
+//	rows, err := database.Pool("main").QueryContext(ctx, q, args...)
+//
+// Names may be qualified as in "schema.table" and followed by an alias as
+// in "users u" or "name AS n".
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/steviesama/nx/database"
+)
+
+// writer accumulates a statement with "?" placeholders and their arguments.
+type writer struct {
+	strings.Builder
+	dialect database.Dialect
+	args    []interface{}
+}
+
+// ident writes name quoted, along with its alias if it has one.
+func (w *writer) ident(name string) {
+	fields := strings.Fields(name)
+
+	switch {
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+		w.WriteString(w.dialect.Quote(fields[0]) + " AS " + w.dialect.Quote(fields[2]))
+	case len(fields) == 2:
+		w.WriteString(w.dialect.Quote(fields[0]) + " " + w.dialect.Quote(fields[1]))
+	default:
+		w.WriteString(w.dialect.Quote(strings.TrimSpace(name)))
+	}
+}
+
+// column writes a selected column, which may be "*" or "table.*".
+func (w *writer) column(name string) {
+	switch {
+	case name == "*":
+		w.WriteString("*")
+	case strings.HasSuffix(name, ".*"):
+		w.WriteString(w.dialect.Quote(strings.TrimSuffix(name, ".*")) + ".*")
+	default:
+		w.ident(name)
+	}
+}
+
+// value writes a placeholder for v, or v itself if it is an Expr.
+func (w *writer) value(v interface{}) {
+	if e, ok := v.(Expr); ok {
+		w.expr(e)
+		return
+	}
+
+	w.WriteString("?")
+	w.args = append(w.args, v)
+}
+
+func (w *writer) expr(e Expr) {
+	w.WriteString(e.SQL)
+	w.args = append(w.args, e.Args...)
+}
+
+// where writes the WHERE clause of conds, if there are any.
+func (w *writer) where(conds []Cond) {
+	if len(conds) == 0 {
+		return
+	}
+
+	w.WriteString(" WHERE ")
+	junction{op: "AND", conds: conds}.write(w, true)
+}
+
+// returning writes the RETURNING clause of columns, if there are any.
+func (w *writer) returning(columns []string) {
+	if len(columns) == 0 {
+		return
+	}
+
+	w.WriteString(" RETURNING ")
+	w.columns(columns)
+}
+
+func (w *writer) columns(columns []string) {
+	for i, column := range columns {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.column(column)
+	}
+}
+
+// build returns the statement with its placeholders rendered for the
+// dialect.
+func (w *writer) build() (string, []interface{}) {
+	return w.dialect.Rebind(w.String()), w.args
+}
+
+// join is a table joined by a SelectBuilder.
+type join struct {
+	kind  string
+	table string
+	on    Cond
+}
+
+// SelectBuilder builds a SELECT statement. Its methods add to the statement
+// and return the builder so they can be chained.
+type SelectBuilder struct {
+	columns  []interface{}
+	distinct bool
+	table    string
+	joins    []join
+	where    []Cond
+	groupBy  []string
+	orderBy  []string
+	limit    int64
+	offset   int64
+}
+
+// Select starts a SELECT of columns, or of every column when there are none.
+func Select(columns ...string) *SelectBuilder {
+	b := &SelectBuilder{limit: -1, offset: -1}
+	for _, column := range columns {
+		b.columns = append(b.columns, column)
+	}
+
+	return b
+}
+
+// Columns adds columns to the selected ones.
+func (b *SelectBuilder) Columns(columns ...string) *SelectBuilder {
+	for _, column := range columns {
+		b.columns = append(b.columns, column)
+	}
+
+	return b
+}
+
+// ColumnExpr adds the expression e to the selected columns, e.g.
+// Raw("COUNT(*) AS total").
+func (b *SelectBuilder) ColumnExpr(e Expr) *SelectBuilder {
+	b.columns = append(b.columns, e)
+	return b
+}
+
+// Distinct selects only distinct rows.
+func (b *SelectBuilder) Distinct() *SelectBuilder {
+	b.distinct = true
+	return b
+}
+
+// From sets the table selected from.
+func (b *SelectBuilder) From(table string) *SelectBuilder {
+	b.table = table
+	return b
+}
+
+// Join adds an INNER JOIN of table on the condition on.
+func (b *SelectBuilder) Join(table string, on Cond) *SelectBuilder {
+	b.joins = append(b.joins, join{"JOIN", table, on})
+	return b
+}
+
+// LeftJoin adds a LEFT JOIN of table on the condition on.
+func (b *SelectBuilder) LeftJoin(table string, on Cond) *SelectBuilder {
+	b.joins = append(b.joins, join{"LEFT JOIN", table, on})
+	return b
+}
+
+// RightJoin adds a RIGHT JOIN of table on the condition on. SQLite only
+// supports it from version 3.39.
+func (b *SelectBuilder) RightJoin(table string, on Cond) *SelectBuilder {
+	b.joins = append(b.joins, join{"RIGHT JOIN", table, on})
+	return b
+}
+
+// Where adds conds to the conditions rows must meet. All of the conditions
+// of every call have to hold, as with And.
+func (b *SelectBuilder) Where(conds ...Cond) *SelectBuilder {
+	b.where = append(b.where, conds...)
+	return b
+}
+
+// GroupBy adds columns to group the rows by.
+func (b *SelectBuilder) GroupBy(columns ...string) *SelectBuilder {
+	b.groupBy = append(b.groupBy, columns...)
+	return b
+}
+
+// OrderBy adds columns to sort the rows by, each optionally followed by ASC
+// or DESC, e.g. "created_at DESC".
+func (b *SelectBuilder) OrderBy(columns ...string) *SelectBuilder {
+	b.orderBy = append(b.orderBy, columns...)
+	return b
+}
+
+// Limit limits the statement to n rows.
+func (b *SelectBuilder) Limit(n int64) *SelectBuilder {
+	b.limit = n
+	return b
+}
+
+// Offset skips the first n rows. MySQL and SQLite only allow it along with
+// a Limit.
+func (b *SelectBuilder) Offset(n int64) *SelectBuilder {
+	b.offset = n
+	return b
+}
+
+// Build returns the statement for dialect and its arguments.
+// It returns an error if no table was set with From.
+func (b *SelectBuilder) Build(dialect database.Dialect) (string, []interface{}, error) {
+	if b.table == "" {
+		return "", nil, errors.New("query: SELECT without a table")
+	}
+
+	w := &writer{dialect: dialect}
+	w.WriteString("SELECT ")
+
+	if b.distinct {
+		w.WriteString("DISTINCT ")
+	}
+
+	if len(b.columns) == 0 {
+		w.WriteString("*")
+	}
+
+	for i, column := range b.columns {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+
+		switch column := column.(type) {
+		case Expr:
+			w.expr(column)
+		case string:
+			w.column(column)
+		}
+	}
+
+	w.WriteString(" FROM ")
+	w.ident(b.table)
+
+	for _, join := range b.joins {
+		w.WriteString(" " + join.kind + " ")
+		w.ident(join.table)
+		w.WriteString(" ON ")
+		join.on.writeCond(w)
+	}
+
+	w.where(b.where)
+
+	if len(b.groupBy) > 0 {
+		w.WriteString(" GROUP BY ")
+		w.columns(b.groupBy)
+	}
+
+	for i, column := range b.orderBy {
+		if i == 0 {
+			w.WriteString(" ORDER BY ")
+		} else {
+			w.WriteString(", ")
+		}
+
+		fields := strings.Fields(column)
+		if len(fields) == 2 && (strings.EqualFold(fields[1], "ASC") || strings.EqualFold(fields[1], "DESC")) {
+			w.ident(fields[0])
+			w.WriteString(" " + strings.ToUpper(fields[1]))
+			continue
+		}
+
+		w.ident(column)
+	}
+
+	if b.limit >= 0 {
+		w.WriteString(" LIMIT " + strconv.FormatInt(b.limit, 10))
+	}
+
+	if b.offset >= 0 {
+		w.WriteString(" OFFSET " + strconv.FormatInt(b.offset, 10))
+	}
+
+	q, args := w.build()
+	return q, args, nil
+}
+
+// InsertBuilder builds an INSERT statement. Its methods add to the statement
+// and return the builder so they can be chained.
+type InsertBuilder struct {
+	table     string
+	columns   []string
+	rows      [][]interface{}
+	returning []string
+}
+
+// Insert starts an INSERT into table.
+func Insert(table string) *InsertBuilder {
+	return &InsertBuilder{table: table}
+}
+
+// Columns sets the columns values are inserted into.
+func (b *InsertBuilder) Columns(columns ...string) *InsertBuilder {
+	b.columns = columns
+	return b
+}
+
+// Values adds a row of values, one for each column. A value may be an Expr
+// such as Raw("DEFAULT").
+func (b *InsertBuilder) Values(values ...interface{}) *InsertBuilder {
+	b.rows = append(b.rows, values)
+	return b
+}
+
+// Returning makes the statement return columns of the inserted rows.
+// MySQL doesn't support it.
+func (b *InsertBuilder) Returning(columns ...string) *InsertBuilder {
+	b.returning = columns
+	return b
+}
+
+// Build returns the statement for dialect and its arguments.
+// It returns an error if there are no rows, or a row doesn't have a value
+// for every column.
+func (b *InsertBuilder) Build(dialect database.Dialect) (string, []interface{}, error) {
+	if len(b.columns) == 0 || len(b.rows) == 0 {
+		return "", nil, fmt.Errorf("query: INSERT into '%s' without columns or values", b.table)
+	}
+
+	w := &writer{dialect: dialect}
+	w.WriteString("INSERT INTO ")
+	w.ident(b.table)
+	w.WriteString(" (")
+	w.columns(b.columns)
+	w.WriteString(") VALUES ")
+
+	for i, row := range b.rows {
+		if len(row) != len(b.columns) {
+			return "", nil, fmt.Errorf("query: INSERT into '%s' of %d values for %d columns", b.table, len(row), len(b.columns))
+		}
+
+		if i > 0 {
+			w.WriteString(", ")
+		}
+
+		w.WriteString("(")
+		for j, value := range row {
+			if j > 0 {
+				w.WriteString(", ")
+			}
+			w.value(value)
+		}
+		w.WriteString(")")
+	}
+
+	w.returning(b.returning)
+
+	q, args := w.build()
+	return q, args, nil
+}
+
+// assignment is a column set by an UpdateBuilder.
+type assignment struct {
+	column string
+	value  interface{}
+}
+
+// UpdateBuilder builds an UPDATE statement. Its methods add to the statement
+// and return the builder so they can be chained.
+type UpdateBuilder struct {
+	table     string
+	sets      []assignment
+	where     []Cond
+	returning []string
+}
+
+// Update starts an UPDATE of table.
+func Update(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+// Set sets column to value, which may be an Expr such as
+// Raw("hits + ?", 1).
+func (b *UpdateBuilder) Set(column string, value interface{}) *UpdateBuilder {
+	b.sets = append(b.sets, assignment{column, value})
+	return b
+}
+
+// Where adds conds to the conditions updated rows must meet, as with
+// SelectBuilder.Where. Without any every row is updated.
+func (b *UpdateBuilder) Where(conds ...Cond) *UpdateBuilder {
+	b.where = append(b.where, conds...)
+	return b
+}
+
+// Returning makes the statement return columns of the updated rows.
+// MySQL doesn't support it.
+func (b *UpdateBuilder) Returning(columns ...string) *UpdateBuilder {
+	b.returning = columns
+	return b
+}
+
+// Build returns the statement for dialect and its arguments.
+// It returns an error if no column was Set.
+func (b *UpdateBuilder) Build(dialect database.Dialect) (string, []interface{}, error) {
+	if len(b.sets) == 0 {
+		return "", nil, fmt.Errorf("query: UPDATE of '%s' without columns to set", b.table)
+	}
+
+	w := &writer{dialect: dialect}
+	w.WriteString("UPDATE ")
+	w.ident(b.table)
+	w.WriteString(" SET ")
+
+	for i, set := range b.sets {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.ident(set.column)
+		w.WriteString(" = ")
+		w.value(set.value)
+	}
+
+	w.where(b.where)
+	w.returning(b.returning)
+
+	q, args := w.build()
+	return q, args, nil
+}
+
+// DeleteBuilder builds a DELETE statement. Its methods add to the statement
+// and return the builder so they can be chained.
+type DeleteBuilder struct {
+	table     string
+	where     []Cond
+	returning []string
+}
+
+// Delete starts a DELETE from table.
+func Delete(table string) *DeleteBuilder {
+	return &DeleteBuilder{table: table}
+}
+
+// Where adds conds to the conditions deleted rows must meet, as with
+// SelectBuilder.Where. Without any every row is deleted.
+func (b *DeleteBuilder) Where(conds ...Cond) *DeleteBuilder {
+	b.where = append(b.where, conds...)
+	return b
+}
+
+// Returning makes the statement return columns of the deleted rows.
+// MySQL doesn't support it.
+func (b *DeleteBuilder) Returning(columns ...string) *DeleteBuilder {
+	b.returning = columns
+	return b
+}
+
+// Build returns the statement for dialect and its arguments.
+// It returns an error if no table was given.
+func (b *DeleteBuilder) Build(dialect database.Dialect) (string, []interface{}, error) {
+	if b.table == "" {
+		return "", nil, errors.New("query: DELETE without a table")
+	}
+
+	w := &writer{dialect: dialect}
+	w.WriteString("DELETE FROM ")
+	w.ident(b.table)
+	w.where(b.where)
+	w.returning(b.returning)
+
+	q, args := w.build()
+	return q, args, nil
+}
@@ -0,0 +1,109 @@
+package query_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/query"
+)
+
+type builder interface {
+	Build(dialect database.Dialect) (string, []interface{}, error)
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		builder builder
+		dialect database.Dialect
+		sql     string
+		args    []interface{}
+	}{
+		{
+			query.Select().From("users"),
+			database.MysqlDialect,
+			"SELECT * FROM `users`",
+			nil,
+		},
+		{
+			query.Select("u.id", "u.name AS n", "o.*").
+				From("shop.users u").
+				LeftJoin("orders o", query.On("o.user_id", "u.id")).
+				Where(query.Eq("u.active", true), query.Or(query.Gt("o.total", 100), query.IsNull("o.total"))).
+				Where(query.In("u.role", "admin", "staff")).
+				OrderBy("u.name desc", "u.id").
+				Limit(10).
+				Offset(20),
+			database.PostgresDialect,
+			`SELECT "u"."id", "u"."name" AS "n", "o".* FROM "shop"."users" "u" LEFT JOIN "orders" "o" ON "o"."user_id" = "u"."id"` +
+				` WHERE "u"."active" = $1 AND ("o"."total" > $2 OR "o"."total" IS NULL) AND "u"."role" IN ($3, $4)` +
+				` ORDER BY "u"."name" DESC, "u"."id" LIMIT 10 OFFSET 20`,
+			[]interface{}{true, 100, "admin", "staff"},
+		},
+		{
+			query.Select("role").ColumnExpr(query.Raw("COUNT(*) AS total")).
+				From("users").
+				Where(query.Raw("name = 'who?' OR age > ?", 30), query.Not(query.Like("name", "a%")), query.In("id")).
+				GroupBy("role"),
+			database.PostgresDialect,
+			`SELECT "role", COUNT(*) AS total FROM "users" WHERE (name = 'who?' OR age > $1) AND NOT ("name" LIKE $2) AND 1 = 0 GROUP BY "role"`,
+			[]interface{}{30, "a%"},
+		},
+		{
+			query.Insert("users").Columns("name", "created_at").
+				Values("ann", query.Raw("NOW()")).
+				Values("bob", query.Raw("NOW()")).
+				Returning("id"),
+			database.PostgresDialect,
+			`INSERT INTO "users" ("name", "created_at") VALUES ($1, NOW()), ($2, NOW()) RETURNING "id"`,
+			[]interface{}{"ann", "bob"},
+		},
+		{
+			query.Update("users").Set("name", "ann").Set("hits", query.Raw("hits + ?", 1)).
+				Where(query.Eq("id", 7), query.Ne("deleted_at", nil)),
+			database.MysqlDialect,
+			"UPDATE `users` SET `name` = ?, `hits` = hits + ? WHERE `id` = ? AND `deleted_at` IS NOT NULL",
+			[]interface{}{"ann", 1, 7},
+		},
+		{
+			query.Delete("users").Where(query.Lt("seen", 5), query.NotIn("id", 1, 2)),
+			database.SqliteDialect,
+			`DELETE FROM "users" WHERE "seen" < ? AND "id" NOT IN (?, ?)`,
+			[]interface{}{5, 1, 2},
+		},
+		{
+			query.Select("we`ird").From(`my"table`),
+			database.MysqlDialect,
+			"SELECT `we``ird` FROM `my\"table`",
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		sql, args, err := test.builder.Build(test.dialect)
+		if err != nil {
+			t.Errorf("Build() error: %s", err)
+			continue
+		}
+
+		if sql != test.sql || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("Build() = %q, %v, expected %q, %v", sql, args, test.sql, test.args)
+		}
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []builder{
+		query.Select("id"),
+		query.Insert("users"),
+		query.Insert("users").Columns("a", "b").Values(1),
+		query.Update("users"),
+		query.Delete(""),
+	}
+
+	for _, test := range tests {
+		if sql, _, err := test.Build(database.MysqlDialect); err == nil {
+			t.Errorf("Build() = %q, expected an error", sql)
+		}
+	}
+}
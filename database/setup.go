@@ -1,16 +1,26 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-
-	_ "github.com/go-sql-driver/mysql"
+	"time"
 )
 
-// registerConnectionPool initializes a connection pool pointer in the dbs
-// map with the passed pool key.
+// pingTimeout bounds every attempt connect makes to reach the database.
+const pingTimeout = 5 * time.Second
+
+// OnPingRetry, when set, is called every time New is about to ping the
+// database of poolKey again after err, with the attempt that failed,
+// counting from 1, and how long New waits before the next one.
+var OnPingRetry func(poolKey string, attempt int, err error, wait time.Duration)
+
+// registerConnectionPool reserves the passed pool key in the dbs map while
+// its connection pool is built.
 // It returns a boolean indicating whether it was successful.
 func registerConnectionPool(poolKey string) bool {
+	mtxDbs.Lock()
+	defer mtxDbs.Unlock()
+
 	_, ok := dbs[poolKey]
 	// poolKey exists...return failure
 	if ok {
@@ -23,35 +33,55 @@ func registerConnectionPool(poolKey string) bool {
 }
 
 // connect establishes a connection to the specified database using the connInfo
-// passed to it.
-// It returns nil if a connection wasn't established, or a reference to the pool
-// if it was.
-func connect(connInfo ConnectionInfo) *sql.DB {
-	var db *sql.DB
-	// if the db has ben opened before, close it
-	if db != nil {
-		db.Close()
-		fmt.Printf("%s Connection Closed!", connInfo.DbIdentity)
+// passed to it and the Driver registered for its DbIdentity, pinging it until
+// it answers or the retries run out. Retries are reported to OnPingRetry
+// under poolKey.
+// It returns the pool, or the error that kept it from connecting, in which
+// case the pool is closed.
+func connect(ctx context.Context, poolKey string, connInfo ConnectionInfo) (*sql.DB, error) {
+	driverName, connString, err := DSN(connInfo)
+	if err != nil {
+		return nil, err
 	}
 
-	connString := fmt.Sprintf(
-		"%s:%s@tcp(%s:%d)/%s?charset=utf8&timeout=5s",
-		connInfo.Username,
-		connInfo.Password,
-		connInfo.Url,
-		connInfo.Port,
-		connInfo.DbName,
-	)
+	db, err := sql.Open(driverName, connString)
+	if err != nil {
+		return nil, err
+	}
 
-	var err error
-	db, err = sql.Open(string(connInfo.DbIdentity), connString)
+	db.SetMaxIdleConns(connInfo.MaxIdleConns)
+	db.SetMaxOpenConns(connInfo.MaxOpenConns)
 
-	if err != nil {
-		fmt.Printf("%s: %v\n", connInfo.DbIdentity, err)
-		return nil
-	} else {
-		fmt.Printf("%s connection successful!\n", connInfo.DbIdentity)
+	delay := connInfo.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err = db.PingContext(pingCtx)
+		cancel()
+
+		if err == nil {
+			return db, nil
+		}
+
+		if attempt >= connInfo.PingRetries {
+			break
+		}
+
+		if OnPingRetry != nil {
+			OnPingRetry(poolKey, attempt+1, err, delay)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			db.Close()
+			return nil, ctx.Err()
+		}
+
+		delay *= 2
 	}
 
-	return db
+	db.Close()
+
+	return nil, err
 }
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+const (
+	// txRetries is how many times WithTx retries a transaction the database
+	// aborted to resolve a conflict.
+	txRetries = 3
+	// txRetryDelay is the delay before the first retry, doubled after every
+	// attempt.
+	txRetryDelay = 20 * time.Millisecond
+)
+
+// OnTxRetry, when set, is called every time WithTx is about to retry the
+// transaction of poolKey that err aborted, with the attempt that failed,
+// counting from 1, and how long WithTx waits before the next one.
+var OnTxRetry func(poolKey string, attempt int, err error, wait time.Duration)
+
+// savepoints numbers the savepoints Savepoint creates so their names are
+// unique.
+var savepoints uint64
+
+// WithTx runs fn in a transaction of the pool referenced by poolKey, started
+// with opts which may be nil. The transaction is committed if fn returns nil
+// and rolled back if it returns an error or panics, in which case the panic
+// carries on once it is. When the database aborts the transaction to break a
+// deadlock or serialization conflict, see IsRetryable, it is retried from the
+// start with a growing delay, so fn must be safe to run more than once.
+// It returns the error of fn or of the commit, or an error if poolKey doesn't
+// exist.
+func WithTx(ctx context.Context, poolKey string, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	db := Pool(poolKey)
+	if db == nil {
+		return fmt.Errorf("database.WithTx() error: no pool registered as '%s'", poolKey)
+	}
+
+	delay := txRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || attempt >= txRetries || !IsRetryable(err) {
+			return err
+		}
+
+		// Jitter keeps the transactions that conflicted from retrying in
+		// lockstep.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		if OnTxRetry != nil {
+			OnTxRetry(poolKey, attempt+1, err, wait)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay *= 2
+	}
+}
+
+// runTx makes a single attempt at the transaction of WithTx.
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Savepoint runs fn within a savepoint of tx, which lets a part of a
+// transaction fail without losing the rest. The savepoint is released if fn
+// returns nil and rolled back to if it returns an error or panics. Savepoints
+// nest by calling Savepoint again within fn.
+// It returns the error of fn or of the savepoint statements.
+func Savepoint(ctx context.Context, tx *sql.Tx, fn func(*sql.Tx) error) (err error) {
+	name := "nx_savepoint_" + strconv.FormatUint(atomic.AddUint64(&savepoints, 1), 10)
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.ExecContext(context.Background(), "ROLLBACK TO SAVEPOINT "+name)
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+			return fmt.Errorf("%w (rolling back to the savepoint failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+// IsRetryable reports whether err is the database aborting a transaction to
+// resolve a conflict with another, so running it again may succeed: a MySQL
+// deadlock (1213) or lock wait timeout (1205), or a PostgreSQL serialization
+// failure (40001) or deadlock (40P01).
+func IsRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/steviesama/nx/database"
+	"github.com/steviesama/nx/database/internal/fakedb"
+)
+
+// deadlock is the error MySQL aborts a transaction with to break a
+// deadlock.
+var deadlock = &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+
+// take returns the queries run on d so far, with the process wide savepoint
+// numbers dropped, and forgets them.
+func take(d *fakedb.Driver) []string {
+	queries := d.Queries()
+	d.Reset()
+
+	for i, query := range queries {
+		if name := strings.LastIndex(query, " nx_savepoint_"); name >= 0 {
+			queries[i] = query[:name] + " sp"
+		}
+	}
+
+	return queries
+}
+
+func exec(query string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	d := fakedb.NewPool(t, t.Name(), database.MysqlDialect)
+	ctx := context.Background()
+
+	if err := database.WithTx(ctx, t.Name(), nil, exec("UPDATE a")); err != nil {
+		t.Errorf("WithTx() error: %s", err)
+	}
+
+	if log, want := take(d), []string{"BEGIN", "UPDATE a", "COMMIT"}; !reflect.DeepEqual(log, want) {
+		t.Errorf("WithTx() ran %q, expected %q", log, want)
+	}
+
+	failure := errors.New("failure")
+	err := database.WithTx(ctx, t.Name(), nil, func(tx *sql.Tx) error { return failure })
+	if !errors.Is(err, failure) {
+		t.Errorf("WithTx() error = %v, expected fn's error", err)
+	}
+
+	if log, want := take(d), []string{"BEGIN", "ROLLBACK"}; !reflect.DeepEqual(log, want) {
+		t.Errorf("a failed WithTx() ran %q, expected %q", log, want)
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("WithTx() recovered %v, expected the panic to carry on", p)
+			}
+		}()
+		database.WithTx(ctx, t.Name(), nil, func(tx *sql.Tx) error { panic("boom") })
+	}()
+
+	if log, want := take(d), []string{"BEGIN", "ROLLBACK"}; !reflect.DeepEqual(log, want) {
+		t.Errorf("a panicking WithTx() ran %q, expected %q", log, want)
+	}
+
+	if err := database.WithTx(ctx, "missing", nil, exec("UPDATE a")); err == nil {
+		t.Errorf("WithTx() on a missing pool succeeded")
+	}
+}
+
+func TestWithTxRetries(t *testing.T) {
+	d := fakedb.NewPool(t, t.Name(), database.MysqlDialect)
+	ctx := context.Background()
+
+	var retries []int
+	database.OnTxRetry = func(poolKey string, attempt int, err error, wait time.Duration) {
+		if poolKey != t.Name() || !errors.Is(err, deadlock) || wait <= 0 {
+			t.Errorf("OnTxRetry(%q, %d, %v, %s) called", poolKey, attempt, err, wait)
+		}
+		retries = append(retries, attempt)
+	}
+	defer func() { database.OnTxRetry = nil }()
+
+	for i := 0; i < 2; i++ {
+		d.ReplyOnce("DEADLOCK", fakedb.Reply{Err: deadlock})
+	}
+
+	if err := database.WithTx(ctx, t.Name(), nil, exec("DEADLOCK")); err != nil {
+		t.Errorf("WithTx() after two deadlocks error: %s", err)
+	}
+
+	if !reflect.DeepEqual(retries, []int{1, 2}) {
+		t.Errorf("OnTxRetry() was called for attempts %v, expected 1 and 2", retries)
+	}
+
+	want := []string{"BEGIN", "DEADLOCK", "ROLLBACK", "BEGIN", "DEADLOCK", "ROLLBACK", "BEGIN", "DEADLOCK", "COMMIT"}
+	if log := take(d); !reflect.DeepEqual(log, want) {
+		t.Errorf("WithTx() ran %q, expected %q", log, want)
+	}
+
+	d.Reply("DEADLOCK", fakedb.Reply{Err: deadlock})
+	err := database.WithTx(ctx, t.Name(), nil, exec("DEADLOCK"))
+
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || !database.IsRetryable(err) {
+		t.Errorf("WithTx() deadlocking every time error = %v, expected the deadlock", err)
+	}
+
+	if attempts := strings.Count(strings.Join(take(d), " "), "BEGIN"); attempts != 4 {
+		t.Errorf("WithTx() made %d attempts, expected 4", attempts)
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	d := fakedb.NewPool(t, t.Name(), database.MysqlDialect)
+	ctx := context.Background()
+	failure := errors.New("failure")
+
+	err := database.WithTx(ctx, t.Name(), nil, func(tx *sql.Tx) error {
+		return database.Savepoint(ctx, tx, func(tx *sql.Tx) error {
+			if err := exec("UPDATE a")(tx); err != nil {
+				return err
+			}
+
+			err := database.Savepoint(ctx, tx, func(tx *sql.Tx) error { return failure })
+			if !errors.Is(err, failure) {
+				t.Errorf("Savepoint() error = %v, expected fn's error", err)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		t.Errorf("WithTx() error: %s", err)
+	}
+
+	want := []string{
+		"BEGIN",
+		"SAVEPOINT sp", "UPDATE a",
+		"SAVEPOINT sp", "ROLLBACK TO SAVEPOINT sp",
+		"RELEASE SAVEPOINT sp",
+		"COMMIT",
+	}
+
+	if log := take(d); !reflect.DeepEqual(log, want) {
+		t.Errorf("Savepoint() ran %q, expected %q", log, want)
+	}
+}
@@ -1,16 +1,42 @@
 package database
 
+import "time"
+
 // ConnectionInfo contains the fields required to build a database connection
-// string which is used to connect to the database.
+// string which is used to connect to the database. The options below DbName
+// only apply to the drivers noted on them; see the DSN builder of each
+// driver.
 type ConnectionInfo struct {
-	DbIdentity   Identity `json:"DbIdentity"`
-	Username     string   `json:"Username"`
-	Password     string   `json:"Password"`
-	Url          string   `json:"Url"`
-	Port         int      `json:"Port"`
-	DbName       string   `json:"DbName"`
-	MaxIdleConns int      `json:"MaxIdleConns"`
-	MaxOpenConns int      `json:"MaxOpenConns"`
+	DbIdentity Identity `json:"DbIdentity" yaml:"DbIdentity" toml:"DbIdentity"`
+	Username   string   `json:"Username" yaml:"Username" toml:"Username"`
+	Password   string   `json:"Password" yaml:"Password" toml:"Password"`
+	// PasswordFile is the path of a file holding the password, such as a
+	// mounted secret, read into Password by ReadSecrets.
+	PasswordFile string `json:"PasswordFile" yaml:"PasswordFile" toml:"PasswordFile"`
+	Url          string `json:"Url" yaml:"Url" toml:"Url"`
+	Port         int    `json:"Port" yaml:"Port" toml:"Port"`
+	DbName       string `json:"DbName" yaml:"DbName" toml:"DbName"`
+	MaxIdleConns int    `json:"MaxIdleConns" yaml:"MaxIdleConns" toml:"MaxIdleConns"`
+	MaxOpenConns int    `json:"MaxOpenConns" yaml:"MaxOpenConns" toml:"MaxOpenConns"`
+	// Socket is the unix socket path (MySQL) or socket directory
+	// (PostgreSQL) to connect through instead of Url and Port.
+	Socket string `json:"Socket" yaml:"Socket" toml:"Socket"`
+	// SSLMode is PostgreSQL's sslmode or MySQL's tls parameter.
+	SSLMode string `json:"SSLMode" yaml:"SSLMode" toml:"SSLMode"`
+	// Charset is the MySQL connection character set. Init sets "utf8";
+	// set "utf8mb4" for full Unicode.
+	Charset string `json:"Charset" yaml:"Charset" toml:"Charset"`
+	// ParseTime makes MySQL return DATE and DATETIME columns as time.Time
+	// rather than []byte. It is off by default.
+	ParseTime bool `json:"ParseTime" yaml:"ParseTime" toml:"ParseTime"`
+	// Params holds any other driver parameters, added to the DSN's query
+	// string.
+	Params map[string]string `json:"Params" yaml:"Params" toml:"Params"`
+	// PingRetries is how many more times New pings a database that didn't
+	// answer the first time.
+	PingRetries int `json:"PingRetries" yaml:"PingRetries" toml:"PingRetries"`
+	// RetryDelay is the wait before the first retry, doubled after each.
+	RetryDelay time.Duration `json:"RetryDelay" yaml:"RetryDelay" toml:"RetryDelay"`
 }
 
 // Init assigns the intended default values on the ConnectionInfo instance.
@@ -18,9 +44,17 @@ func (ci *ConnectionInfo) Init() {
 	ci.DbIdentity = ""
 	ci.Username = ""
 	ci.Password = ""
+	ci.PasswordFile = ""
 	ci.Url = ""
 	ci.Port = 0
 	ci.DbName = ""
 	ci.MaxIdleConns = 0
 	ci.MaxOpenConns = 151
+	ci.Socket = ""
+	ci.SSLMode = ""
+	ci.Charset = "utf8"
+	ci.ParseTime = false
+	ci.Params = nil
+	ci.PingRetries = 3
+	ci.RetryDelay = 500 * time.Millisecond
 }
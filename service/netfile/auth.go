@@ -0,0 +1,287 @@
+package netfile
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrUnauthorized is matched by the errors a client gets when it hasn't
+// authenticated, or failed to, with a server that requires it.
+var ErrUnauthorized = errors.New("netfile: not authenticated")
+
+// ErrForbidden is matched by the errors a client gets when its user lacks
+// the permission a command needs.
+var ErrForbidden = errors.New("netfile: permission denied")
+
+// Permission is a set of operations a User may perform.
+type Permission uint8
+
+const (
+	// PermRead allows client.fetch, client.fetch.range, client.list,
+	// client.list.sums and client.stat.
+	PermRead Permission = 1 << iota
+	// PermWrite allows client.store.
+	PermWrite
+	// PermDelete allows client.delete.
+	PermDelete
+
+	PermAll = PermRead | PermWrite | PermDelete
+)
+
+// User is an identity allowed to use a Server. Once ServerConfig.Users is
+// set, clients have to authenticate as one of them with client.auth before
+// any other command but client.ping and client.quit.
+type User struct {
+	Name string `json:"Name"`
+	// Secret is the key shared with the client. It is only ever used to sign
+	// the server's challenge and is never sent over the connection.
+	Secret string `json:"Secret"`
+	// Root, if set, confines the user to this sub directory of FilesDir. It
+	// is created if it doesn't exist.
+	Root string `json:"Root"`
+	// Permissions are the operations the user may perform.
+	Permissions Permission `json:"Permissions"`
+}
+
+// AuditEvent is one line of the audit log, recording which identity
+// accessed which file and with what result.
+type AuditEvent struct {
+	Time   time.Time `json:"Time"`
+	Remote string    `json:"Remote"`
+	// User is empty when authentication is disabled.
+	User    string `json:"User"`
+	Command string `json:"Command"`
+	// Name is the file name, or the prefix for client.list, relative to the
+	// user's root.
+	Name string `json:"Name"`
+	// Result is "ok" or the ErrCode the command failed with.
+	Result string `json:"Result"`
+}
+
+// account is a User prepared for serving, with its sandbox resolved.
+type account struct {
+	User
+	files *Sandbox
+}
+
+// loadAccounts resolves the root of every user inside files.
+// It returns an error for a duplicate, unnamed or secretless user or a root
+// that can't be created.
+func loadAccounts(users []User, files *Sandbox) (map[string]*account, error) {
+	accounts := make(map[string]*account)
+
+	for _, user := range users {
+		if user.Name == "" || user.Secret == "" {
+			return nil, errors.New("netfile: users need a Name and a Secret")
+		}
+
+		if _, ok := accounts[user.Name]; ok {
+			return nil, fmt.Errorf("netfile: duplicate user '%s'", user.Name)
+		}
+
+		sandbox := files
+		if user.Root != "" {
+			root, resolveErr := files.Resolve(user.Root)
+			if resolveErr != nil {
+				return nil, fmt.Errorf("netfile: root of user '%s': %w", user.Name, resolveErr)
+			}
+
+			if mkdirErr := os.MkdirAll(root, os.ModePerm); mkdirErr != nil {
+				return nil, fmt.Errorf("netfile mkdir error: %w", mkdirErr)
+			}
+
+			var sandboxErr error
+			if sandbox, sandboxErr = NewSandbox(root); sandboxErr != nil {
+				return nil, fmt.Errorf("netfile: root of user '%s': %w", user.Name, sandboxErr)
+			}
+		}
+
+		accounts[user.Name] = &account{User: user, files: sandbox}
+	}
+
+	return accounts, nil
+}
+
+// authRequired reports whether clients have to authenticate.
+func (s *Server) authRequired() bool {
+	return len(s.accounts) > 0
+}
+
+// handleClientAuth implements client.auth:
+//
+//	client -> client.auth, <user>
+//	server -> server.auth.challenge, <nonce hex>
+//	client -> <hex hmac-sha256 of the nonce keyed with the user's secret>
+//	server -> server.auth.ok | server.error, <ServerError json>
+//
+// A challenge is sent even for unknown users so names can't be probed.
+// Servers without Users refuse every client.auth.
+// It returns false if authentication failed and the connection should be
+// closed.
+func (s *Server) handleClientAuth(sc *serverConn) bool {
+	p := sc.proto
+
+	args, readErr := p.readArgs(1)
+	if readErr != nil {
+		return false
+	}
+
+	name := args[0]
+
+	nonce := make([]byte, 32)
+	if _, randErr := rand.Read(nonce); randErr != nil {
+		replyError(p, ErrCodeInternal, "unable to create challenge")
+		return false
+	}
+
+	p.writeFrame("server.auth.challenge", hex.EncodeToString(nonce))
+	p.flush()
+
+	args, readErr = p.readArgs(1)
+	if readErr != nil {
+		return false
+	}
+
+	response := args[0]
+
+	acct, ok := s.accounts[name]
+	if !ok {
+		// Check against a throwaway key so unknown names take as long.
+		acct = &account{User: User{Secret: hex.EncodeToString(nonce)}}
+	}
+
+	signature, decodeErr := hex.DecodeString(response)
+
+	if !hmac.Equal(signature, signChallenge([]byte(acct.Secret), nonce)) || !ok || decodeErr != nil {
+		sc.logger.Printf("authentication failed for '%s'", name)
+		s.audit(sc, "client.auth", name, ErrCodeUnauthorized)
+		replyError(p, ErrCodeUnauthorized, "authentication failed")
+		return false
+	}
+
+	sc.user = acct
+	sc.files = acct.files
+	sc.perms = acct.Permissions
+
+	s.audit(sc, "client.auth", "", "ok")
+	p.writeFrame("server.auth.ok")
+	p.flush()
+
+	return true
+}
+
+// signChallenge returns the HMAC-SHA256 of nonce keyed with secret.
+func signChallenge(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// allow reports whether the connection's user may perform perm and records
+// the attempt in the audit log when it may not.
+func (s *Server) allow(sc *serverConn, perm Permission, cmd, name string) bool {
+	if sc.perms&perm == perm {
+		return true
+	}
+
+	s.audit(sc, cmd, name, ErrCodeForbidden)
+	return false
+}
+
+// audit appends an event to the audit log, if one is configured.
+func (s *Server) audit(sc *serverConn, cmd, name, result string) {
+	if s.config.AuditLog == nil {
+		return
+	}
+
+	event := AuditEvent{
+		Time:    time.Now().UTC(),
+		Remote:  sc.conn.RemoteAddr().String(),
+		Command: cmd,
+		Name:    name,
+		Result:  result,
+	}
+
+	if sc.user != nil {
+		event.User = sc.user.Name
+	}
+
+	data, _ := json.Marshal(&event)
+
+	s.mtxAudit.Lock()
+	defer s.mtxAudit.Unlock()
+
+	if _, writeErr := s.config.AuditLog.Write(append(data, '\n')); writeErr != nil {
+		sc.logger.Printf("audit log write error: %s", writeErr.Error())
+	}
+}
+
+// resultOf maps the error a transfer ended with to an AuditEvent Result.
+func resultOf(err error) string {
+	if err != nil {
+		return ErrCodeInternal
+	}
+
+	return "ok"
+}
+
+// Auth authenticates the connection as user by signing the server's
+// challenge with secret, which never leaves the client.
+// It returns an error matching ErrUnauthorized if the server refused it; the
+// server closes the connection in that case.
+func (c *Client) Auth(ctx context.Context, user string, secret []byte) error {
+	return c.do(ctx, func() error {
+		if err := c.send("client.auth", user); err != nil {
+			return err
+		}
+
+		reply, err := c.proto.readName()
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.auth.challenge":
+		case "server.error":
+			return c.readServerError()
+		default:
+			return unexpectedReply("server.auth.challenge", reply)
+		}
+
+		args, err := c.proto.readArgs(1)
+		if err != nil {
+			return err
+		}
+
+		nonce, err := hex.DecodeString(args[0])
+		if err != nil {
+			return fmt.Errorf("netfile: malformed challenge '%s'", args[0])
+		}
+
+		if err := c.send("", hex.EncodeToString(signChallenge(secret, nonce))); err != nil {
+			return err
+		}
+
+		reply, err = c.proto.readName()
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.auth.ok":
+			return nil
+		case "server.error":
+			return c.readServerError()
+		default:
+			return unexpectedReply("server.auth.ok", reply)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package netfile_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestAuthAndPermissions(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "alice"), 0755)
+	os.WriteFile(filepath.Join(root, "alice", "mine.txt"), []byte("alice"), 0644)
+	os.WriteFile(filepath.Join(root, "shared.txt"), []byte("shared"), 0644)
+
+	var audit bytes.Buffer
+
+	config := testConfig(t, root)
+	config.AuditLog = &audit
+	config.Users = []netfile.User{
+		{Name: "alice", Secret: "alice-secret", Root: "alice", Permissions: netfile.PermRead},
+		{Name: "admin", Secret: "admin-secret", Permissions: netfile.PermAll},
+	}
+
+	server := newServer(t, config)
+	addr := serve(t, server)
+
+	ctx := context.Background()
+	dial := func() *netfile.Client {
+		client, err := netfile.Dial(ctx, "tcp", addr, nil)
+		if err != nil {
+			t.Fatalf("Dial() error: %s", err)
+		}
+		return client
+	}
+
+	anonymous := dial()
+	defer anonymous.Close()
+	if err := anonymous.Ping(ctx); err != nil {
+		t.Errorf("Ping() before authenticating error: %s", err)
+	}
+	if _, err := anonymous.Fetch(ctx, "shared.txt", &bytes.Buffer{}); !errors.Is(err, netfile.ErrUnauthorized) {
+		t.Errorf("Fetch() before authenticating error = %v, expected ErrUnauthorized", err)
+	}
+
+	impostor := dial()
+	defer impostor.Close()
+	if err := impostor.Auth(ctx, "alice", []byte("wrong")); !errors.Is(err, netfile.ErrUnauthorized) {
+		t.Errorf("Auth() with the wrong secret error = %v, expected ErrUnauthorized", err)
+	}
+
+	alice := dial()
+	defer alice.Quit()
+	if err := alice.Auth(ctx, "alice", []byte("alice-secret")); err != nil {
+		t.Fatalf("Auth() error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := alice.Fetch(ctx, "mine.txt", &buf); err != nil || buf.String() != "alice" {
+		t.Errorf("Fetch() in own root = %q, %v, expected \"alice\"", buf.String(), err)
+	}
+	if _, err := alice.Fetch(ctx, "../shared.txt", &bytes.Buffer{}); err == nil {
+		t.Errorf("Fetch() outside own root succeeded")
+	}
+	if err := alice.Store(ctx, "new.txt", bytes.NewReader([]byte("x")), 1); !errors.Is(err, netfile.ErrRejected) {
+		t.Errorf("Store() without PermWrite error = %v, expected ErrRejected", err)
+	}
+	if err := alice.Delete(ctx, "mine.txt"); !errors.Is(err, netfile.ErrForbidden) {
+		t.Errorf("Delete() without PermDelete error = %v, expected ErrForbidden", err)
+	}
+
+	admin := dial()
+	defer admin.Quit()
+	if err := admin.Auth(ctx, "admin", []byte("admin-secret")); err != nil {
+		t.Fatalf("Auth() error: %s", err)
+	}
+	if err := admin.Delete(ctx, "alice/mine.txt"); err != nil {
+		t.Errorf("Delete() with PermDelete error: %s", err)
+	}
+
+	server.Close()
+
+	var events []netfile.AuditEvent
+	for _, line := range bytes.Split(bytes.TrimSpace(audit.Bytes()), []byte("\n")) {
+		var event netfile.AuditEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("malformed audit line %q: %s", line, err)
+		}
+		events = append(events, event)
+	}
+
+	want := []netfile.AuditEvent{
+		{Command: "client.fetch", Result: netfile.ErrCodeUnauthorized},
+		{Command: "client.auth", Name: "alice", Result: netfile.ErrCodeUnauthorized},
+		{User: "alice", Command: "client.auth", Result: "ok"},
+		{User: "alice", Command: "client.fetch", Name: "mine.txt", Result: "ok"},
+		{User: "alice", Command: "client.fetch", Name: "../shared.txt", Result: netfile.ErrCodeNoFile},
+		{User: "alice", Command: "client.store", Name: "new.txt", Result: netfile.ErrCodeForbidden},
+		{User: "alice", Command: "client.delete", Name: "mine.txt", Result: netfile.ErrCodeForbidden},
+		{User: "admin", Command: "client.auth", Result: "ok"},
+		{User: "admin", Command: "client.delete", Name: "alice/mine.txt", Result: "ok"},
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("audit log has %d events, expected %d: %+v", len(events), len(want), events)
+	}
+
+	for i, event := range events {
+		event.Time, event.Remote = want[i].Time, ""
+		if event != want[i] {
+			t.Errorf("audit event %d = %+v, expected %+v", i, event, want[i])
+		}
+	}
+}
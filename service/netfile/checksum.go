@@ -0,0 +1,149 @@
+package netfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrChecksumMismatch is returned when a downloaded file doesn't match the
+// checksum the server reported for it.
+var ErrChecksumMismatch = errors.New("netfile: checksum mismatch")
+
+// checksumCache remembers the sha256 digests of files by path so unchanged
+// files aren't read twice for every transfer. An entry is only used while
+// the file's size and modification time still match the ones it was computed
+// for.
+type checksumCache struct {
+	mtx     sync.Mutex
+	entries map[string]checksumEntry
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// get returns the hex encoded digest of the file at path described by info,
+// reading the file in bufferSize chunks only if there is no valid entry.
+func (c *checksumCache) get(path string, info os.FileInfo, bufferSize int) (string, error) {
+	c.mtx.Lock()
+	entry, ok := c.entries[path]
+	c.mtx.Unlock()
+
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+
+	sum, err := fileSha256(path, bufferSize)
+	if err != nil {
+		return "", err
+	}
+
+	c.put(path, info, sum)
+
+	return sum, nil
+}
+
+// put records sum as the digest of the file at path described by info.
+func (c *checksumCache) put(path string, info os.FileInfo, sum string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]checksumEntry)
+	}
+
+	c.entries[path] = checksumEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+}
+
+// forget drops the entry for path.
+func (c *checksumCache) forget(path string) {
+	c.mtx.Lock()
+	delete(c.entries, path)
+	c.mtx.Unlock()
+}
+
+// fileSha256 returns the hex encoded sha256 digest of the file at path, read
+// in bufferSize chunks.
+func fileSha256(path string, bufferSize int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	sum := sha256.New()
+	if _, err := io.CopyBuffer(sum, file, make([]byte, bufferSize)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// sendFile streams exactly length bytes of file to sc in BufferSize chunks
+// and follows them with the trailer "server.fetch.ok". A failed read, e.g.
+// because the file shrank since its size was announced, ends the transfer
+// short; the client couldn't tell a reply apart from file bytes then, so the
+// bytes read are flushed and the connection is closed without one, leaving
+// the client with only real file data to resume from.
+// It returns the error that stopped the file being sent. After a read or
+// write error the connection is no longer usable.
+func (s *Server) sendFile(sc *serverConn, file *os.File, length int64) error {
+	p := sc.proto
+
+	_, readErr, writeErr := s.streamFile(sc, file, length)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if readErr != nil {
+		p.flush()
+		sc.conn.Close()
+		return readErr
+	}
+
+	p.writeFrame("server.fetch.ok")
+
+	if flushErr := p.flush(); flushErr != nil {
+		return fmt.Errorf("netfile server write error: %w", flushErr)
+	}
+
+	return nil
+}
+
+// streamFile writes up to length bytes of file to sc in BufferSize chunks,
+// without a trailer or flushing the last chunk.
+// It returns the number of bytes written along with the error reading file
+// that stopped it short, or the error writing to the client after which the
+// connection is no longer usable.
+func (s *Server) streamFile(sc *serverConn, file *os.File, length int64) (sent int64, readErr error, writeErr error) {
+	data := make([]byte, s.config.BufferSize)
+
+	for sent < length {
+		chunk := int64(len(data))
+		if remaining := length - sent; remaining < chunk {
+			chunk = remaining
+		}
+
+		n, err := io.ReadFull(file, data[:chunk])
+
+		s.extendDeadline(sc)
+		if _, writeErr := sc.proto.rw.Write(data[:n]); writeErr != nil {
+			return sent, nil, fmt.Errorf("netfile server write error after %d of %d bytes: %w", sent, length, writeErr)
+		}
+		sent += int64(n)
+
+		if err != nil {
+			return sent, fmt.Errorf("netfile server read error on '%s' after %d of %d bytes: %w", file.Name(), sent, length, err), nil
+		}
+	}
+
+	return sent, nil, nil
+}
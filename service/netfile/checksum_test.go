@@ -0,0 +1,49 @@
+package netfile_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestFetchChecksumFollowsModTime(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "f")
+	os.WriteFile(path, []byte("first"), 0644)
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", startServer(t, testConfig(t, root)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	before, err := client.Stat(ctx, "f")
+	if err != nil {
+		t.Fatalf("Stat() error: %s", err)
+	}
+
+	// Same size, new contents and a later modification time.
+	os.WriteFile(path, []byte("other"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+
+	var buf bytes.Buffer
+	if _, err := client.Fetch(ctx, "f", &buf); err != nil || buf.String() != "other" {
+		t.Fatalf("Fetch() = %q, %v, expected \"other\"", buf.String(), err)
+	}
+
+	after, err := client.Stat(ctx, "f")
+	if err != nil {
+		t.Fatalf("Stat() error: %s", err)
+	}
+
+	if after.Sha256 == before.Sha256 {
+		t.Errorf("Stat() returned the cached digest of the old contents")
+	}
+}
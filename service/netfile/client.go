@@ -0,0 +1,407 @@
+package netfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/steviesama/nx/service/socket"
+)
+
+// ErrNoFile is returned by Client.Fetch when the server doesn't have the
+// requested file.
+var ErrNoFile = errors.New("netfile: no such file on server")
+
+// ErrUnknownCommand is returned when the server doesn't recognize a command.
+var ErrUnknownCommand = errors.New("netfile: command not supported by server")
+
+// NegotiateTimeout is how long Negotiate waits for the server to answer
+// when ctx has no deadline of its own. The original netfile server never
+// answers, so a server that stays silent that long is taken to be one.
+var NegotiateTimeout = 5 * time.Second
+
+// ProgressFunc is called as a transfer progresses with the number of bytes
+// transferred so far and the total expected.
+type ProgressFunc func(transferred, total int64)
+
+// Client speaks the netfile protocol to a netfile server. A Client runs one
+// command at a time; concurrent calls are serialized.
+type Client struct {
+	// OnProgress, if set, is called after every BufferSize chunk of a
+	// transfer.
+	OnProgress ProgressFunc
+
+	// Compression, if set, lists the encodings, most preferred first, that
+	// Fetch and FetchRange ask the server to compress downloads with, such
+	// as CompressionZstd and CompressionGzip. Progress and the returned byte
+	// counts are of the uncompressed data.
+	Compression []string
+
+	conn  net.Conn
+	proto *protoConn
+
+	// noCompression is set once the server turned out not to support
+	// compressed transfers.
+	noCompression bool
+
+	// A mutex so only one command is on the wire at a time.
+	mtx sync.Mutex
+}
+
+// Dial connects to the netfile server at addr on network, "tcp" or "unix",
+// waits for its "server.ready" message and negotiates the newest protocol
+// version both sides support. If tlsConfig is not nil the connection is made
+// over TLS.
+// It returns the client, or an error if the connection or handshake failed.
+func Dial(ctx context.Context, network, addr string, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := socket.DialConn(ctx, network, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(conn)
+
+	err = c.do(ctx, func() error {
+		return c.expect("server.ready")
+	})
+	if err == nil {
+		err = c.Negotiate(ctx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewClient wraps an established connection to a netfile server. The caller
+// is responsible for having consumed "server.ready". The client starts on
+// ProtocolLegacy; see Negotiate.
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn:  conn,
+		proto: newProtoConn(NewConnReadWriter(conn)),
+	}
+}
+
+// Negotiate asks the server to switch the connection to ProtocolFramed.
+// Servers that predate it but answer "server.unknown" leave the connection
+// on ProtocolLegacy, and compression off since those servers don't support
+// it either. The original netfile server doesn't answer at all; when ctx has
+// no deadline, a server silent for NegotiateTimeout is treated the same way,
+// otherwise the exchange fails when ctx's deadline passes.
+// Dial negotiates on its own; a client made with NewClient has to call it
+// before its first command.
+// It returns an error only if the exchange failed.
+func (c *Client) Negotiate(ctx context.Context) error {
+	return c.do(ctx, func() error {
+		if c.proto.framed() {
+			return nil
+		}
+
+		_, bounded := ctx.Deadline()
+		if !bounded && NegotiateTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(NegotiateTimeout))
+		}
+
+		if err := c.send("client.protocol.v2"); err != nil {
+			return err
+		}
+
+		reply, err := c.proto.readName()
+		if err != nil && !bounded && isTimeout(err) && ctx.Err() == nil {
+			// The original server ignored the command, so the connection
+			// is still in step on the legacy protocol.
+			c.noCompression = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.protocol.v2":
+			c.proto.version = ProtocolFramed
+		case "server.unknown":
+			// Compressed transfers came after the framed protocol.
+			c.noCompression = true
+		default:
+			return unexpectedReply("server.protocol.v2", reply)
+		}
+
+		return nil
+	})
+}
+
+// Protocol returns the protocol version the connection uses, ProtocolLegacy
+// or ProtocolFramed.
+func (c *Client) Protocol() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.proto.version
+}
+
+// Ping sends "client.ping" and waits for "server.pong".
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, func() error {
+		if err := c.send("client.ping"); err != nil {
+			return err
+		}
+		return c.expect("server.pong")
+	})
+}
+
+// Fetch asks the server for the file called name and streams exactly the
+// number of bytes the server announces into w. With ProtocolFramed they are
+// checked against the sha256 digest the server sends with them; the legacy
+// reply carries no digest.
+// With Client.Compression set the file is fetched as a compressed range.
+// It returns the number of bytes written to w, ErrNoFile if the server
+// doesn't have the file, an error wrapping ErrChecksumMismatch or a
+// *ServerError if the data written to w is not to be trusted, or the error
+// that interrupted the transfer.
+func (c *Client) Fetch(ctx context.Context, name string, w io.Writer) (int64, error) {
+	var written int64
+
+	err := c.do(ctx, func() error {
+		if len(c.Compression) > 0 && !c.noCompression {
+			var err error
+			written, err = c.fetchRange(name, 0, -1, w, &FileInfo{Name: name})
+			if !errors.Is(err, ErrUnknownCommand) || !c.proto.framed() {
+				return err
+			}
+		}
+
+		if err := c.send("client.fetch", name); err != nil {
+			return err
+		}
+
+		reply, err := c.proto.readName()
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.fetch.file":
+		case "server.fetch.nofile":
+			return ErrNoFile
+		case "server.error":
+			return c.readServerError()
+		default:
+			return unexpectedReply("server.fetch.file", reply)
+		}
+
+		// Legacy servers announce only the size and send nothing after the
+		// file.
+		framed := c.proto.framed()
+
+		n := 1
+		if framed {
+			n = 2
+		}
+
+		args, err := c.proto.readArgs(n)
+		if err != nil {
+			return err
+		}
+
+		size, err := parseSize(args[0])
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.New()
+
+		written, err = c.receive(c.proto.rw, io.MultiWriter(w, sum), size)
+		if err != nil {
+			// Unread bytes of the file are still in flight.
+			c.conn.Close()
+			return err
+		}
+
+		if !framed {
+			return nil
+		}
+
+		if err := c.readTrailer(); err != nil {
+			return err
+		}
+
+		return verifySum(name, sum, args[1])
+	})
+
+	return written, err
+}
+
+// Quit sends "client.quit" and closes the connection.
+func (c *Client) Quit() error {
+	c.mtx.Lock()
+	sendErr := c.send("client.quit")
+	c.mtx.Unlock()
+
+	closeErr := c.conn.Close()
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return closeErr
+}
+
+// Close closes the connection without telling the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// do runs one command exchange under the client's lock with ctx's deadline
+// and cancellation applied to the connection. A cancelled exchange leaves
+// the protocol in an unknown state so the connection is closed.
+func (c *Client) do(ctx context.Context, exchange func() error) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		// Unblock any pending read or write.
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := exchange()
+
+	if !stop() {
+		c.conn.Close()
+		return ctx.Err()
+	}
+
+	c.conn.SetDeadline(time.Time{})
+
+	return err
+}
+
+// send writes the message name with args to the server and flushes it. An
+// empty name sends only the arguments.
+func (c *Client) send(name string, args ...string) error {
+	if err := c.proto.writeFrame(name, args...); err != nil {
+		return fmt.Errorf("netfile.Client write error: %w", err)
+	}
+
+	if err := c.proto.flush(); err != nil {
+		return fmt.Errorf("netfile.Client flush error: %w", err)
+	}
+
+	return nil
+}
+
+// expect reads the next message and checks that it is want.
+func (c *Client) expect(want string) error {
+	reply, err := c.proto.readName()
+	if err != nil {
+		return err
+	}
+
+	if reply != want {
+		return unexpectedReply(want, reply)
+	}
+
+	return nil
+}
+
+// parseSize parses a decimal byte count argument.
+func parseSize(arg string) (int64, error) {
+	size, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("netfile: malformed size '%s'", arg)
+	}
+
+	return size, nil
+}
+
+// receive copies exactly size bytes from r, the connection or a decompressor
+// reading from it, into w in BufferSize chunks, reporting progress after
+// each one.
+func (c *Client) receive(r io.Reader, w io.Writer, size int64) (int64, error) {
+	data := make([]byte, BufferSize)
+	var written int64
+
+	if c.OnProgress != nil {
+		c.OnProgress(0, size)
+	}
+
+	for written < size {
+		chunk := int64(len(data))
+		if remaining := size - written; remaining < chunk {
+			chunk = remaining
+		}
+
+		n, readErr := io.ReadFull(r, data[:chunk])
+
+		if n > 0 {
+			wn, writeErr := w.Write(data[:n])
+			written += int64(wn)
+
+			if writeErr != nil {
+				return written, fmt.Errorf("netfile.Client write error: %w", writeErr)
+			}
+
+			if c.OnProgress != nil {
+				c.OnProgress(written, size)
+			}
+		}
+
+		if readErr != nil {
+			return written, fmt.Errorf("netfile.Client transfer interrupted after %d of %d bytes: %w", written, size, readErr)
+		}
+	}
+
+	return written, nil
+}
+
+// readTrailer reads the reply that follows the bytes of a file.
+// It returns the *ServerError the server sends if it failed to read the file
+// part way through.
+func (c *Client) readTrailer() error {
+	reply, err := c.proto.readName()
+	if err != nil {
+		return err
+	}
+
+	switch reply {
+	case "server.fetch.ok":
+		return nil
+	case "server.error":
+		return c.readServerError()
+	default:
+		return unexpectedReply("server.fetch.ok", reply)
+	}
+}
+
+// verifySum checks the digest of the bytes fed to sum against want, the hex
+// encoded digest the server sent for the file called name.
+func verifySum(name string, sum hash.Hash, want string) error {
+	if got := hex.EncodeToString(sum.Sum(nil)); got != want {
+		return fmt.Errorf("%w: '%s' is %s, server reported %s", ErrChecksumMismatch, name, got, want)
+	}
+
+	return nil
+}
+
+func unexpectedReply(want, got string) error {
+	if got == "server.unknown" {
+		return ErrUnknownCommand
+	}
+
+	return fmt.Errorf("netfile: expected '%s' from server, got '%s'", want, got)
+}
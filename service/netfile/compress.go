@@ -0,0 +1,234 @@
+package netfile
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings a client can ask client.fetch.range.compressed to use, listed in
+// Client.Compression.
+const (
+	CompressionNone = "identity"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// chooseEncoding picks the first encoding in offered, a comma separated list
+// in the client's order of preference, that the server supports.
+// It returns CompressionNone if there is none.
+func chooseEncoding(offered string) string {
+	for _, encoding := range strings.Split(offered, ",") {
+		switch encoding = strings.TrimSpace(encoding); encoding {
+		case CompressionGzip, CompressionZstd, CompressionNone:
+			return encoding
+		}
+	}
+
+	return CompressionNone
+}
+
+// newCompressor returns a writer compressing into w with encoding. Close
+// flushes the compressed stream but doesn't close w.
+func newCompressor(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+
+	return nil, fmt.Errorf("netfile: unsupported encoding '%s'", encoding)
+}
+
+// newDecompressor returns a reader decompressing r with encoding.
+func newDecompressor(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	}
+
+	return nil, fmt.Errorf("netfile: unsupported encoding '%s'", encoding)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// chunkWriter frames a compressed stream, whose length isn't known up front,
+// as chunks each preceded by its 4 byte big-endian length. close writes the
+// empty chunk that ends the stream.
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	if err := binary.Write(cw.w, binary.BigEndian, uint32(len(data))); err != nil {
+		return 0, err
+	}
+
+	return cw.w.Write(data)
+}
+
+func (cw *chunkWriter) close() error {
+	return binary.Write(cw.w, binary.BigEndian, uint32(0))
+}
+
+// chunkReader reads the stream a chunkWriter framed, returning io.EOF at the
+// empty chunk that ends it.
+type chunkReader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func (cr *chunkReader) Read(data []byte) (int, error) {
+	for cr.remaining == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+
+		if err := binary.Read(cr.r, binary.BigEndian, &cr.remaining); err != nil {
+			return 0, noEOF(err)
+		}
+
+		cr.done = cr.remaining == 0
+	}
+
+	if uint32(len(data)) > cr.remaining {
+		data = data[:cr.remaining]
+	}
+
+	n, err := cr.r.Read(data)
+	cr.remaining -= uint32(n)
+
+	return n, noEOF(err)
+}
+
+// noEOF turns an io.EOF in the middle of a chunked stream into
+// io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// sendCompressed streams length bytes of file to sc compressed with encoding,
+// reading it in BufferSize chunks, and follows them with the trailer sendFile
+// sends. A read failure ends the compressed stream early, which the client
+// notices from the shortfall; since the chunks keep the stream apart from
+// the replies, a server.error trailer follows instead of the connection
+// being closed.
+// It returns the error that stopped the file being sent. After a write error
+// the connection is no longer usable.
+func (s *Server) sendCompressed(sc *serverConn, file io.Reader, length int64, encoding string) error {
+	p := sc.proto
+	cw := &chunkWriter{w: p.rw}
+
+	zw, err := newCompressor(encoding, cw)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, s.config.BufferSize)
+	var sent int64
+	var readErr error
+
+	for sent < length && readErr == nil {
+		chunk := int64(len(data))
+		if remaining := length - sent; remaining < chunk {
+			chunk = remaining
+		}
+
+		var n int
+		n, readErr = io.ReadFull(file, data[:chunk])
+
+		s.extendDeadline(sc)
+		if _, writeErr := zw.Write(data[:n]); writeErr != nil {
+			return fmt.Errorf("netfile server write error after %d of %d bytes: %w", sent, length, writeErr)
+		}
+		sent += int64(n)
+	}
+
+	s.extendDeadline(sc)
+	if closeErr := zw.Close(); closeErr != nil {
+		return fmt.Errorf("netfile server write error: %w", closeErr)
+	}
+
+	if closeErr := cw.close(); closeErr != nil {
+		return fmt.Errorf("netfile server write error: %w", closeErr)
+	}
+
+	if readErr != nil {
+		p.writeError(ErrCodeInternal, "file read error")
+	} else {
+		p.writeFrame("server.fetch.ok")
+	}
+
+	if flushErr := p.flush(); flushErr != nil {
+		return fmt.Errorf("netfile server write error: %w", flushErr)
+	}
+
+	if readErr != nil {
+		return fmt.Errorf("netfile server read error after %d of %d bytes: %w", sent, length, readErr)
+	}
+
+	return nil
+}
+
+// receiveCompressed decompresses the chunked stream that follows a
+// server.fetch.range.compressed reply into w, expecting size bytes once
+// decompressed. The stream is read to its end even when decompression fails
+// so the connection stays in step; only a broken stream closes it.
+// It returns the number of bytes written to w, the server.error the trailer
+// carries if the server stopped early, or the error decompression failed
+// with.
+func (c *Client) receiveCompressed(encoding string, w io.Writer, size int64) (int64, error) {
+	cr := &chunkReader{r: c.proto.rw}
+	var written int64
+
+	zr, err := newDecompressor(encoding, cr)
+	if err == nil {
+		written, err = c.receive(zr, w, size)
+		zr.Close()
+	}
+
+	if _, drainErr := io.Copy(io.Discard, cr); drainErr != nil {
+		c.conn.Close()
+		return written, fmt.Errorf("netfile.Client transfer interrupted after %d of %d bytes: %w", written, size, drainErr)
+	}
+
+	if err != nil {
+		// A server that couldn't read the file says so in the trailer.
+		if trailerErr := c.readTrailer(); trailerErr != nil {
+			return written, trailerErr
+		}
+		return written, err
+	}
+
+	return written, nil
+}
@@ -0,0 +1,207 @@
+package netfile_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+// countingConn counts the bytes read from the connection it wraps.
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestFetchCompressed(t *testing.T) {
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("a line of very compressible text\n"), 2048)
+	os.WriteFile(filepath.Join(root, "text"), data, 0644)
+
+	raw, err := net.Dial("tcp", startServer(t, testConfig(t, root)))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+
+	conn := &countingConn{Conn: raw}
+
+	if msg, err := netfile.ReadMsg(conn); err != nil || msg != "server.ready" {
+		t.Fatalf("ReadMsg() = %q, %v, expected \"server.ready\"", msg, err)
+	}
+
+	ctx := context.Background()
+	client := netfile.NewClient(conn)
+	defer client.Quit()
+
+	if err := client.Negotiate(ctx); err != nil {
+		t.Fatalf("Negotiate() error: %s", err)
+	}
+
+	fetch := func(compression ...string) int64 {
+		t.Helper()
+		client.Compression = compression
+
+		before := conn.read.Load()
+
+		var buf bytes.Buffer
+		n, err := client.Fetch(ctx, "text", &buf)
+		if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("Fetch() with %v = %d bytes, %v, expected the %d bytes on the server", compression, n, err, len(data))
+		}
+
+		return conn.read.Load() - before
+	}
+
+	plain := fetch()
+	gzipped := fetch(netfile.CompressionGzip)
+
+	if gzipped*10 > plain {
+		t.Errorf("gzip Fetch() read %d bytes off the wire, expected far fewer than %d", gzipped, plain)
+	}
+
+	fetch("br", netfile.CompressionZstd)
+
+	client.Compression = []string{netfile.CompressionGzip}
+
+	var buf bytes.Buffer
+	if _, _, err := client.FetchRange(ctx, "text", 33, 33, &buf); err != nil || !bytes.Equal(buf.Bytes(), data[33:66]) {
+		t.Errorf("compressed FetchRange() = %q, %v, expected %q", buf.String(), err, data[33:66])
+	}
+
+	if _, err := client.Fetch(ctx, "missing", &buf); !errors.Is(err, netfile.ErrNoFile) {
+		t.Errorf("compressed Fetch() of a missing file error = %v, expected ErrNoFile", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "text")
+	if err := client.Download(ctx, "text", dest); err != nil {
+		t.Fatalf("compressed Download() error: %s", err)
+	}
+
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, data) {
+		t.Errorf("compressed Download() wrote %d bytes that don't match the %d on the server", len(got), len(data))
+	}
+}
+
+// startLegacyServer serves files from root the way netfile servers did before
+// the framed protocol: client.fetch and client.quit, with every other line
+// answered by "server.unknown", or, like the original netfile server,
+// ignored when silent is set.
+// It returns the address to dial.
+func startLegacyServer(t *testing.T, files map[string]string, silent bool) string {
+	t.Helper()
+
+	l := listen(t)
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("server.ready\n"))
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch strings.TrimSuffix(line, "\n") {
+			case "client.quit":
+				return
+			case "client.fetch":
+				name, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				data, ok := files[strings.TrimSuffix(name, "\n")]
+				if !ok {
+					conn.Write([]byte("server.fetch.nofile\n"))
+					continue
+				}
+
+				conn.Write([]byte(fmt.Sprintf("server.fetch.file\n%d\n%s", len(data), data)))
+			default:
+				if !silent {
+					conn.Write([]byte("server.unknown\n"))
+				}
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestCompressionWithLegacyServer(t *testing.T) {
+	addr := startLegacyServer(t, map[string]string{"old.txt": "legacy"}, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := netfile.Dial(ctx, "tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	if client.Protocol() != netfile.ProtocolLegacy {
+		t.Fatalf("Dial() negotiated protocol %d with a legacy server", client.Protocol())
+	}
+
+	client.Compression = []string{netfile.CompressionGzip}
+
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if _, err := client.Fetch(ctx, "old.txt", &buf); err != nil || buf.String() != "legacy" {
+			t.Errorf("Fetch() with compression from a legacy server = %q, %v, expected \"legacy\"", buf.String(), err)
+		}
+	}
+
+	// Without negotiating, the client only finds out from the reply, when
+	// the arguments it sent are already being read as commands.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+
+	if msg, err := netfile.ReadMsg(conn); err != nil || msg != "server.ready" {
+		t.Fatalf("ReadMsg() = %q, %v, expected \"server.ready\"", msg, err)
+	}
+
+	client = netfile.NewClient(conn)
+	client.Compression = []string{netfile.CompressionGzip}
+
+	var buf bytes.Buffer
+	if _, _, err := client.FetchRange(ctx, "old.txt", 0, -1, &buf); !errors.Is(err, netfile.ErrUnknownCommand) {
+		t.Errorf("compressed FetchRange() from a legacy server error = %v, expected ErrUnknownCommand", err)
+	}
+
+	if err := client.Ping(ctx); err == nil {
+		t.Errorf("Ping() succeeded on a connection out of step with the server")
+	}
+}
@@ -0,0 +1,95 @@
+package netfile
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+)
+
+// ConnContext is what a CommandHandlerFunc gets to serve a command: who sent
+// it, a context that ends with the connection, a logger, and the means to
+// read the command's arguments and reply in whichever protocol version the
+// connection uses.
+type ConnContext struct {
+	sc *serverConn
+}
+
+// Context returns a context that is cancelled when the connection ends or
+// the server is closed, so long running handlers can give up.
+func (c *ConnContext) Context() context.Context {
+	return c.sc.ctx
+}
+
+// RemoteAddr returns the client's address.
+func (c *ConnContext) RemoteAddr() net.Addr {
+	return c.sc.conn.RemoteAddr()
+}
+
+// User returns the name the client authenticated as, or "" when the server
+// doesn't require authentication.
+func (c *ConnContext) User() string {
+	if c.sc.user == nil {
+		return ""
+	}
+
+	return c.sc.user.Name
+}
+
+// Permissions returns what the client's user may do. Without authentication
+// that is PermAll.
+func (c *ConnContext) Permissions() Permission {
+	return c.sc.perms
+}
+
+// Logger returns the server's ServerConfig.Logger with the client's address
+// added to its prefix.
+func (c *ConnContext) Logger() *log.Logger {
+	return c.sc.logger
+}
+
+// Protocol returns the protocol version the connection uses, ProtocolLegacy
+// or ProtocolFramed.
+func (c *ConnContext) Protocol() int {
+	return c.sc.proto.version
+}
+
+// ReadArgs reads the n arguments that came with the command, or with the
+// message the client sent after it.
+func (c *ConnContext) ReadArgs(n int) ([]string, error) {
+	return c.sc.proto.readArgs(n)
+}
+
+// Reply sends the message name with args to the client.
+func (c *ConnContext) Reply(name string, args ...string) error {
+	if err := c.sc.proto.writeFrame(name, args...); err != nil {
+		return err
+	}
+
+	return c.sc.proto.flush()
+}
+
+// ReplyJSON sends the message name carrying v as JSON.
+func (c *ConnContext) ReplyJSON(name string, v interface{}) error {
+	if err := c.sc.proto.writeData(name, v); err != nil {
+		return err
+	}
+
+	return c.sc.proto.flush()
+}
+
+// ReplyError sends a server.error reply with one of the ErrCode values.
+func (c *ConnContext) ReplyError(code, msg string) error {
+	if err := c.sc.proto.writeError(code, msg); err != nil {
+		return err
+	}
+
+	return c.sc.proto.flush()
+}
+
+// ReadWriter returns the connection's buffered reader and writer for raw
+// bytes, such as file contents, that follow a message. Anything written has
+// to be flushed.
+func (c *ConnContext) ReadWriter() *bufio.ReadWriter {
+	return c.sc.proto.rw
+}
@@ -0,0 +1,127 @@
+package netfile_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+// temporaryError is an Accept error that is expected to pass.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// flakyListener fails its first failures Accept calls with a temporaryError.
+type flakyListener struct {
+	net.Listener
+
+	mtx      sync.Mutex
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mtx.Lock()
+	fail := l.failures > 0
+	if fail {
+		l.failures--
+	}
+	l.mtx.Unlock()
+
+	if fail {
+		return nil, temporaryError{}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	server := newServer(t, testConfig(t, filepath.Join(t.TempDir(), "files")))
+	l := listen(t)
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(&flakyListener{Listener: l, failures: 3}) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := netfile.Dial(ctx, "tcp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("Dial() after temporary accept errors error: %s", err)
+	}
+	client.Quit()
+
+	select {
+	case err := <-served:
+		t.Fatalf("Serve() returned %v after temporary accept errors", err)
+	default:
+	}
+}
+
+func TestCommandHandlerContext(t *testing.T) {
+	server := newServer(t, testConfig(t, filepath.Join(t.TempDir(), "files")))
+
+	cancelled := make(chan struct{})
+
+	server.AddCommandHandler("client.whoami", func(c *netfile.ConnContext) {
+		args, err := c.ReadArgs(1)
+		if err != nil {
+			return
+		}
+		c.Logger().Printf("whoami %s", args[0])
+		c.Reply("server.whoami", args[0], c.RemoteAddr().String(), c.User())
+	})
+
+	server.AddCommandHandler("client.wait", func(c *netfile.ConnContext) {
+		c.Reply("server.waiting")
+		<-c.Context().Done()
+		close(cancelled)
+	})
+
+	conn, err := net.Dial("tcp", serve(t, server))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readLine := func() string {
+		line, _ := r.ReadString('\n')
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	if line := readLine(); line != "server.ready" {
+		t.Fatalf("read %q, expected \"server.ready\"", line)
+	}
+
+	conn.Write([]byte("client.whoami\nhello\n"))
+
+	want := []string{"server.whoami", "hello", conn.LocalAddr().String(), ""}
+	for _, w := range want {
+		if line := readLine(); line != w {
+			t.Errorf("client.whoami reply line %q, expected %q", line, w)
+		}
+	}
+
+	conn.Write([]byte("client.wait\n"))
+
+	if line := readLine(); line != "server.waiting" {
+		t.Fatalf("read %q, expected \"server.waiting\"", line)
+	}
+
+	server.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("handler context wasn't cancelled by Close")
+	}
+}
@@ -0,0 +1,429 @@
+package netfile
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes carried by server.error replies.
+const (
+	ErrCodeNoFile       = "nofile"
+	ErrCodeBadRequest   = "badrequest"
+	ErrCodeInternal     = "internal"
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeForbidden    = "forbidden"
+)
+
+// FileInfo describes a file held by the server. Name is relative to the
+// server's FilesDir and uses forward slashes.
+type FileInfo struct {
+	Name    string    `json:"Name"`
+	Size    int64     `json:"Size"`
+	ModTime time.Time `json:"ModTime"`
+	// Sha256 is the hex encoded digest of the file's contents. client.list
+	// leaves it empty; client.list.sums and client.stat fill it in.
+	Sha256 string `json:"Sha256,omitempty"`
+}
+
+// ListPage is one page of a client.list reply.
+type ListPage struct {
+	// Files holds the entries of this page sorted by Name.
+	Files []FileInfo `json:"Files"`
+	// Offset is the index of the first entry of Files among all matches.
+	Offset int `json:"Offset"`
+	// Total is the number of files matching the prefix.
+	Total int `json:"Total"`
+}
+
+// More reports whether there are entries after this page.
+func (p *ListPage) More() bool {
+	return p.Offset+len(p.Files) < p.Total
+}
+
+// ServerError is the structured error a server sends in a server.error reply.
+type ServerError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// Error satisfies the error interface.
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("netfile server error (%s): %s", e.Code, e.Message)
+}
+
+// Is lets errors.Is match a ServerError to ErrNoFile, ErrUnauthorized or
+// ErrForbidden by its code.
+func (e *ServerError) Is(target error) bool {
+	switch target {
+	case ErrNoFile:
+		return e.Code == ErrCodeNoFile
+	case ErrUnauthorized:
+		return e.Code == ErrCodeUnauthorized
+	case ErrForbidden:
+		return e.Code == ErrCodeForbidden
+	}
+
+	return false
+}
+
+// replyJSON sends reply carrying v as JSON.
+func replyJSON(p *protoConn, reply string, v interface{}) {
+	if err := p.writeData(reply, v); err != nil {
+		replyError(p, ErrCodeInternal, "encoding error")
+		return
+	}
+
+	p.flush()
+}
+
+// replyError sends a server.error reply.
+func replyError(p *protoConn, code, msg string) {
+	p.writeError(code, msg)
+	p.flush()
+}
+
+// handleClientList implements client.list:
+//
+//	client -> client.list, <prefix>, <offset>, <limit>
+//	server -> server.list, <ListPage json> | server.error, <ServerError json>
+//
+// Requests for a larger or non-positive limit get the configured MaxListPage
+// entries.
+func (s *Server) handleClientList(sc *serverConn) {
+	s.list(sc, "client.list", false)
+}
+
+// handleClientListSums implements client.list.sums, which works like
+// client.list but fills in the Sha256 of every entry in the page:
+//
+//	client -> client.list.sums, <prefix>, <offset>, <limit>
+//	server -> server.list, <ListPage json> | server.error, <ServerError json>
+func (s *Server) handleClientListSums(sc *serverConn) {
+	s.list(sc, "client.list.sums", true)
+}
+
+// list serves a page of the listing for cmd, with checksums if sums is set.
+func (s *Server) list(sc *serverConn, cmd string, sums bool) {
+	p := sc.proto
+
+	args, readErr := p.readArgs(3)
+	if readErr != nil {
+		return
+	}
+
+	prefix := args[0]
+	offset, offsetErr := strconv.Atoi(args[1])
+	limit, limitErr := strconv.Atoi(args[2])
+
+	if offsetErr != nil || limitErr != nil || offset < 0 {
+		replyError(p, ErrCodeBadRequest, "malformed offset or limit")
+		return
+	}
+
+	if !s.allow(sc, PermRead, cmd, prefix) {
+		replyError(p, ErrCodeForbidden, "permission denied")
+		return
+	}
+
+	if limit <= 0 || limit > s.config.MaxListPage {
+		limit = s.config.MaxListPage
+	}
+
+	files, listErr := listFiles(sc.files, prefix)
+	if listErr != nil {
+		sc.logger.Printf("netfile.handleClientList() error: %s", listErr.Error())
+		replyError(p, ErrCodeInternal, "unable to list files")
+		return
+	}
+
+	page := ListPage{Files: []FileInfo{}, Offset: offset, Total: len(files)}
+	if offset < len(files) {
+		end := offset + limit
+		if end > len(files) {
+			end = len(files)
+		}
+		page.Files = files[offset:end]
+	}
+
+	if sums {
+		for i := range page.Files {
+			file := &page.Files[i]
+			path := filepath.Join(sc.files.Root(), filepath.FromSlash(file.Name))
+
+			info, statErr := os.Stat(path)
+			if statErr != nil {
+				// Removed since it was listed; the client finds out when it
+				// asks for it.
+				continue
+			}
+
+			sum, sumErr := s.checksums.get(path, info, s.config.BufferSize)
+			if sumErr != nil {
+				sc.logger.Printf("netfile.handleClientListSums() error: %s", sumErr.Error())
+				replyError(p, ErrCodeInternal, "unable to read file")
+				return
+			}
+
+			file.Size, file.ModTime, file.Sha256 = info.Size(), info.ModTime(), sum
+		}
+	}
+
+	s.audit(sc, cmd, prefix, "ok")
+	replyJSON(p, "server.list", &page)
+}
+
+// listFiles walks the root of sandbox and returns every regular file whose
+// name starts with prefix, sorted by name. Symlinks are skipped.
+func listFiles(sandbox *Sandbox, prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+
+	walkErr := filepath.WalkDir(sandbox.Root(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := sandbox.Rel(path)
+
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, infoErr := d.Info()
+		if infoErr != nil {
+			// Removed since the directory was read.
+			return nil
+		}
+
+		files = append(files, FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+
+	return files, walkErr
+}
+
+// handleClientStat implements client.stat:
+//
+//	client -> client.stat, <name>
+//	server -> server.stat, <FileInfo json> | server.error, <ServerError json>
+func (s *Server) handleClientStat(sc *serverConn) {
+	p := sc.proto
+
+	args, readErr := p.readArgs(1)
+	if readErr != nil {
+		return
+	}
+
+	name := args[0]
+
+	if !s.allow(sc, PermRead, "client.stat", name) {
+		replyError(p, ErrCodeForbidden, "permission denied")
+		return
+	}
+
+	path, resolveErr := sc.files.Resolve(name)
+	if resolveErr != nil {
+		replyError(p, ErrCodeBadRequest, resolveErr.Error())
+		return
+	}
+
+	info, statErr := os.Stat(path)
+	if statErr != nil || !info.Mode().IsRegular() {
+		s.audit(sc, "client.stat", name, ErrCodeNoFile)
+		replyError(p, ErrCodeNoFile, "no such file")
+		return
+	}
+
+	sum, sumErr := s.checksums.get(path, info, s.config.BufferSize)
+	if sumErr != nil {
+		sc.logger.Printf("netfile.handleClientStat() error: %s", sumErr.Error())
+		replyError(p, ErrCodeInternal, "unable to read file")
+		return
+	}
+
+	s.audit(sc, "client.stat", name, "ok")
+	replyJSON(p, "server.stat", &FileInfo{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Sha256:  sum,
+	})
+}
+
+// handleClientDelete implements client.delete:
+//
+//	client -> client.delete, <name>
+//	server -> server.delete.ok | server.error, <ServerError json>
+func (s *Server) handleClientDelete(sc *serverConn) {
+	p := sc.proto
+
+	args, readErr := p.readArgs(1)
+	if readErr != nil {
+		return
+	}
+
+	name := args[0]
+
+	if !s.allow(sc, PermDelete, "client.delete", name) {
+		replyError(p, ErrCodeForbidden, "permission denied")
+		return
+	}
+
+	path, resolveErr := sc.files.Resolve(name)
+	if resolveErr != nil {
+		replyError(p, ErrCodeBadRequest, resolveErr.Error())
+		return
+	}
+
+	info, statErr := os.Lstat(path)
+	if statErr != nil || !info.Mode().IsRegular() {
+		s.audit(sc, "client.delete", name, ErrCodeNoFile)
+		replyError(p, ErrCodeNoFile, "no such file")
+		return
+	}
+
+	if removeErr := os.Remove(path); removeErr != nil {
+		sc.logger.Printf("netfile.handleClientDelete() error: %s", removeErr.Error())
+		replyError(p, ErrCodeInternal, "unable to delete file")
+		return
+	}
+	s.checksums.forget(path)
+	s.audit(sc, "client.delete", name, "ok")
+
+	sc.logger.Printf("Deleted: '%s'", name)
+	p.writeFrame("server.delete.ok")
+	p.flush()
+}
+
+// List asks the server for up to limit files whose names start with prefix,
+// skipping the first offset matches. A limit of zero asks for the server's
+// maximum page size.
+func (c *Client) List(ctx context.Context, prefix string, offset, limit int) (*ListPage, error) {
+	return c.list(ctx, "client.list", prefix, offset, limit)
+}
+
+// ListChecksums works like List but has the server fill in the Sha256 of
+// every entry, which is slower on files it hasn't hashed before.
+func (c *Client) ListChecksums(ctx context.Context, prefix string, offset, limit int) (*ListPage, error) {
+	return c.list(ctx, "client.list.sums", prefix, offset, limit)
+}
+
+func (c *Client) list(ctx context.Context, cmd, prefix string, offset, limit int) (*ListPage, error) {
+	page := &ListPage{}
+
+	err := c.do(ctx, func() error {
+		if err := c.send(cmd, prefix, strconv.Itoa(offset), strconv.Itoa(limit)); err != nil {
+			return err
+		}
+		return c.readJSON("server.list", page)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// ListAll pages through client.list until every file whose name starts with
+// prefix has been returned.
+func (c *Client) ListAll(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return c.listAll(ctx, c.List, prefix)
+}
+
+// ListAllChecksums works like ListAll but with ListChecksums.
+func (c *Client) ListAllChecksums(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return c.listAll(ctx, c.ListChecksums, prefix)
+}
+
+func (c *Client) listAll(ctx context.Context, list func(context.Context, string, int, int) (*ListPage, error), prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+
+	for {
+		page, err := list(ctx, prefix, len(files), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, page.Files...)
+
+		if !page.More() || len(page.Files) == 0 {
+			return files, nil
+		}
+	}
+}
+
+// Stat asks the server for the size, modification time and sha256 digest of
+// the file called name.
+// It returns an error matching ErrNoFile if the server doesn't have it.
+func (c *Client) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	info := &FileInfo{}
+
+	err := c.do(ctx, func() error {
+		if err := c.send("client.stat", name); err != nil {
+			return err
+		}
+		return c.readJSON("server.stat", info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Delete asks the server to remove the file called name.
+// It returns an error matching ErrNoFile if the server doesn't have it.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.do(ctx, func() error {
+		if err := c.send("client.delete", name); err != nil {
+			return err
+		}
+
+		reply, err := c.proto.readName()
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.delete.ok":
+			return nil
+		case "server.error":
+			return c.readServerError()
+		default:
+			return unexpectedReply("server.delete.ok", reply)
+		}
+	})
+}
+
+// readJSON reads a want reply and decodes the JSON document it carries into
+// v, or decodes a server.error reply into a *ServerError.
+func (c *Client) readJSON(want string, v interface{}) error {
+	reply, err := c.proto.readName()
+	if err != nil {
+		return err
+	}
+
+	switch reply {
+	case want:
+	case "server.error":
+		return c.readServerError()
+	default:
+		return unexpectedReply(want, reply)
+	}
+
+	return c.proto.readData(v)
+}
+
+// readServerError decodes the ServerError a server.error reply carries.
+func (c *Client) readServerError() error {
+	return c.proto.readError()
+}
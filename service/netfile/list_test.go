@@ -0,0 +1,94 @@
+package netfile_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestList(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("a%d", i)), []byte("hi"), 0644)
+	}
+	os.WriteFile(filepath.Join(root, "sub", "b"), []byte("hello"), 0644)
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", startServer(t, testConfig(t, root)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	page, err := client.List(ctx, "a", 1, 2)
+	if err != nil {
+		t.Fatalf("List() error: %s", err)
+	}
+
+	if len(page.Files) != 2 || page.Total != 5 || page.Files[0].Name != "a1" || page.Files[1].Name != "a2" || !page.More() {
+		t.Errorf("List(a, 1, 2) = %+v", page)
+	}
+
+	page, err = client.List(ctx, "a", 4, 2)
+	if err != nil || len(page.Files) != 1 || page.Files[0].Name != "a4" || page.More() {
+		t.Errorf("List() of the last page = %+v, %v", page, err)
+	}
+
+	page, err = client.List(ctx, "a", 10, 2)
+	if err != nil || len(page.Files) != 0 || page.Total != 5 || page.More() {
+		t.Errorf("List() past the end = %+v, %v, expected an empty last page", page, err)
+	}
+
+	all, err := client.ListAll(ctx, "")
+	if err != nil || len(all) != 6 || all[5].Name != "sub/b" {
+		t.Errorf("ListAll() = %+v, %v", all, err)
+	}
+
+	sums, err := client.ListAllChecksums(ctx, "sub")
+	if err != nil || len(sums) != 1 || sums[0].Sha256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("ListAllChecksums() = %+v, %v", sums, err)
+	}
+}
+
+func TestStatAndDelete(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0644)
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", startServer(t, testConfig(t, root)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	info, err := client.Stat(ctx, "a.txt")
+	if err != nil || info.Size != 5 || info.Sha256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Stat() = %+v, %v", info, err)
+	}
+
+	if _, err := client.Stat(ctx, "missing.txt"); !errors.Is(err, netfile.ErrNoFile) {
+		t.Errorf("Stat() of a missing file error = %v, expected ErrNoFile", err)
+	}
+
+	if err := client.Delete(ctx, "a.txt"); err != nil {
+		t.Fatalf("Delete() error: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("Delete() left the file behind")
+	}
+
+	if err := client.Delete(ctx, "a.txt"); !errors.Is(err, netfile.ErrNoFile) {
+		t.Errorf("Delete() of a missing file error = %v, expected ErrNoFile", err)
+	}
+
+	if err := client.Ping(ctx); err != nil {
+		t.Errorf("Ping() after a failed Delete() error: %s", err)
+	}
+}
@@ -6,7 +6,7 @@ package netfile
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -18,18 +18,21 @@ import (
 )
 
 // DataDir is the Linux location which netfile stores it's data when
-// netfile server is run.
+// netfile server is run with a ServerConfig left at its defaults.
 const DataDir string = "/var/lib/netfile"
 const FilesDir string = "/var/lib/netfile/files"
 const TempDir string = "/var/lib/netfile/temp"
 
+// BufferSize is the default chunk size transfers are streamed in.
 const BufferSize int = 1024
 
 // CommandHandlerFunc is a type that is used to describe the functions that will
-// handle the various commands netfile server can process.
-type CommandHandlerFunc func(*bufio.ReadWriter)
+// handle the various commands netfile server can process. The ConnContext is
+// only valid until the handler returns.
+type CommandHandlerFunc func(*ConnContext)
 
-// commandHandlers is a pool of handlers for associated commands.
+// commandHandlers is a pool of handlers for associated commands shared by
+// every Server.
 var commandHandlers map[string]CommandHandlerFunc
 
 // A mutex to protect async access to commandHandlers.
@@ -37,75 +40,133 @@ var mtxCommandHandlers sync.RWMutex
 
 func init() {
 	commandHandlers = make(map[string]CommandHandlerFunc)
-	AddCommandHandler("client.fetch", handleClientFetch)
 }
 
-func handleClientFetch(rw *bufio.ReadWriter) {
-	fmt.Println("Before readMsg()")
-	msg, readErr := readMsg(rw)
+// handleClientPing answers a client heartbeat so it can tell the connection
+// is still alive.
+func handleClientPing(sc *serverConn) {
+	sc.proto.writeFrame("server.pong")
+	sc.proto.flush()
+}
+
+// handleClientFetch implements client.fetch. With ProtocolFramed:
+//
+//	client -> client.fetch, <name>
+//	server -> server.fetch.file, <size>, <sha256>, <size bytes>,
+//	          server.fetch.ok | server.error, <ServerError json>
+//	        | server.fetch.nofile | server.error, <ServerError json>
+//
+// With ProtocolLegacy the reply is kept exactly as clients that predate the
+// framed protocol expect it, without the checksum or trailer:
+//
+//	server -> server.fetch.file, <size>, <size bytes> | server.fetch.nofile
+//
+// A legacy transfer that can't be completed closes the connection.
+func (s *Server) handleClientFetch(sc *serverConn) {
+	p := sc.proto
+
+	args, readErr := p.readArgs(1)
 
 	switch {
 	case readErr == io.EOF:
-		fmt.Println("netfile client closed connection.")
+		sc.logger.Printf("netfile client closed connection.")
 		return
 	case readErr != nil:
-		// fmt.Printf("netfile.ReadMsg() error: %s\n", readErr.Error())
+		sc.logger.Printf("netfile.handleClientFetch read error: %s", readErr.Error())
 		return
 	}
 
-	var noFileFlush = func() {
-		rw.WriteString("server.fetch.nofile\n")
-		rw.Flush()
+	msg := args[0]
+
+	if !s.allow(sc, PermRead, "client.fetch", msg) {
+		replyError(p, ErrCodeForbidden, "permission denied")
+		return
 	}
 
-	// Ensure the current working directory is the server data files directory.
-	os.Chdir(FilesDir)
+	var noFileFlush = func() {
+		s.audit(sc, "client.fetch", msg, ErrCodeNoFile)
+		p.writeFrame("server.fetch.nofile")
+		p.flush()
+	}
 
-	fileInfo, statErr := os.Stat(msg)
+	path, resolveErr := sc.files.Resolve(msg)
 
-	if statErr != nil {
-		fmt.Printf("netfile.handleClientFetch error: %s\n", statErr.Error())
+	if resolveErr != nil {
+		sc.logger.Printf("netfile.handleClientFetch error: %s", resolveErr.Error())
 		noFileFlush()
 		return
 	}
 
-	if fileInfo.IsDir() {
+	// Open the file before announcing it so a failure can still be reported
+	// as server.fetch.nofile.
+	file, openErr := os.OpenFile(path, os.O_RDONLY, 0755)
+
+	if openErr != nil {
+		sc.logger.Printf("netfile.handleClientFetch error: %s", openErr.Error())
 		noFileFlush()
 		return
 	}
-
-	fmt.Printf("Sending: '%s'\n", fileInfo.Name())
-
-	// Write the next 2 messages and send.
-	rw.WriteString("server.fetch.file\n")
-	rw.WriteString(fmt.Sprintf("%d\n", fileInfo.Size()))
-	rw.Flush()
-
-	file, openErr := os.OpenFile(fileInfo.Name(), os.O_RDONLY, 0755)
 	defer file.Close()
 
-	if openErr != nil {
+	// Stat the open file so the size and checksum describe what is streamed.
+	fileInfo, statErr := file.Stat()
+
+	if statErr != nil || fileInfo.IsDir() {
 		noFileFlush()
 		return
 	}
 
-	data := make([]byte, BufferSize)
+	size := strconv.FormatInt(fileInfo.Size(), 10)
+	var sendErr error
 
-	for {
-		n, readErr := file.Read(data)
+	if p.framed() {
+		checksum, sumErr := s.checksums.get(path, fileInfo, s.config.BufferSize)
 
-		_, _ = io.CopyN(rw, bytes.NewReader(data), int64(n))
+		if sumErr != nil {
+			sc.logger.Printf("netfile.handleClientFetch error: %s", sumErr.Error())
+			noFileFlush()
+			return
+		}
+
+		sc.logger.Printf("Sending: '%s'", fileInfo.Name())
+
+		// Announce the size and checksum, then send the file followed by
+		// its trailer.
+		p.writeFrame("server.fetch.file", size, checksum)
+		sendErr = s.sendFile(sc, file, fileInfo.Size())
+	} else {
+		sc.logger.Printf("Sending: '%s'", fileInfo.Name())
+
+		p.writeFrame("server.fetch.file", size)
+
+		_, readErr, writeErr := s.streamFile(sc, file, fileInfo.Size())
+		switch {
+		case readErr != nil:
+			sendErr = readErr
+		case writeErr != nil:
+			sendErr = writeErr
+		default:
+			sendErr = p.flush()
+		}
 
-		if readErr != nil {
-			fmt.Printf("handleClientFetch(): netfile fetch file read error: %s\n", readErr.Error())
-			break
+		if sendErr != nil {
+			// Without a trailer the client can only tell from the
+			// connection closing.
+			sc.conn.Close()
 		}
 	}
+
+	if sendErr != nil {
+		sc.logger.Printf("netfile.handleClientFetch error: %s", sendErr.Error())
+	}
+
+	s.audit(sc, "client.fetch", msg, resultOf(sendErr))
 }
 
 // AddCommandHandler takes a command name and a command handler and add the handler
 // to a command handler map using the command name as a key. When the command name
-// command is received...the associated command handler will be executed.
+// command is received...the associated command handler will be executed. The
+// handler applies to every Server; see Server.AddCommandHandler.
 // AddCommandHandler is thread safe.
 func AddCommandHandler(cmd string, commandHandler CommandHandlerFunc) {
 	mtxCommandHandlers.Lock()
@@ -113,124 +174,59 @@ func AddCommandHandler(cmd string, commandHandler CommandHandlerFunc) {
 	mtxCommandHandlers.Unlock()
 }
 
-func onHandleCommand(cmd string, conn net.Conn) {
-	mtxCommandHandlers.RLock()
-	handleCommand, ok := commandHandlers[cmd]
-	mtxCommandHandlers.RUnlock()
-
-	if !ok {
-		fmt.Printf("The command '%s' is not registered.\n", cmd)
-		return
-	}
-
-	handleCommand(NewConnReadWriter(conn))
+// ServerListen takes a host address and port number which it uses to dial a tcp
+// connection.
+// It returns an error if a successful connection is not made...or it loops listening
+// for client connections otherwise until killed. Files are kept in the default
+// ServerConfig directories; use NewServer to serve from elsewhere.
+func ServerListen(host string, port int) error {
+	return ServerListenTLS(host, port, nil)
 }
 
-// ensureDataDir makes sure that the netfile data directory exists before the
-// server starts listening.
-// It returns an error if the dir doesn't exist and it can't create it.
-// Note: If not running netfile as CLI...ensure the DataDir structure and
-// 			 permissions are set correctly before the app that uses this code is run.
-func ensureDataDir() error {
-	if _, err := os.Stat(DataDir); os.IsNotExist(err) {
-		fmt.Println("netfile data directory doesn't exist...")
-
-		curUser := os.Getenv("USER")
-		if curUser != "root" {
-			return errors.New("unable to create netfile data directory...please run with sudo")
-		}
-
-		fmt.Printf("Creating '%s'...\n", DataDir)
-		var mkdirErr error
-		mkdirErr = os.MkdirAll(DataDir, os.ModePerm)
-		if mkdirErr != nil {
-			return errors.New(fmt.Sprintf("mkdir error: %s\n", mkdirErr.Error()))
-		}
-		fmt.Printf("Creating '%s'...\n", FilesDir)
-		mkdirErr = os.MkdirAll(FilesDir, os.ModePerm)
-		if mkdirErr != nil {
-			return errors.New(fmt.Sprintf("mkdir error: %s\n", mkdirErr.Error()))
-		}
-		fmt.Printf("Creating '%s'...\n", TempDir)
-		mkdirErr = os.MkdirAll(TempDir, os.ModePerm)
-		if mkdirErr != nil {
-			return errors.New(fmt.Sprintf("mkdir error: %s\n", mkdirErr.Error()))
-		}
-
-		fmt.Println("netfile data directory created.")
-
-		user := os.Getenv("SUDO_USER")
-		uid, _ := strconv.Atoi(os.Getenv("SUDO_UID"))
-		gid, _ := strconv.Atoi(os.Getenv("SUDO_GID"))
-
-		fmt.Println("Currently only the user that first runs netfile on a system will have access to store data.")
-		fmt.Printf("Setting owner of data directory to %s...", user)
-
-		os.Chown(DataDir, uid, gid)
-		os.Chown(FilesDir, uid, gid)
-		os.Chown(TempDir, uid, gid)
-
-		fmt.Println("finished.")
-
-		return errors.New("Please run netfile server again normally.")
-	}
+// ServerListenTLS works like ServerListen but, when tlsConfig is not nil,
+// only accepts TLS connections. Set tlsConfig.ClientAuth to require client
+// certificates; nx/crypto.ServerTLSConfig builds a config that reloads its
+// certificate from disk.
+func ServerListenTLS(host string, port int, tlsConfig *tls.Config) error {
+	return listenAndServe("tcp", fmt.Sprintf("%s:%d", host, port), tlsConfig)
+}
 
-	return nil
+// ServerListenUnix works like ServerListenTLS but listens on the unix domain
+// socket at path for local IPC. tlsConfig may be nil.
+func ServerListenUnix(path string, tlsConfig *tls.Config) error {
+	return listenAndServe("unix", path, tlsConfig)
 }
 
-// ServerListen takes a host address and port number which it uses to dial a tcp
-// connection.
-// It returns an error if a successful connection is not made...or it loops listening
-// for client connections otherwise until killed.
-func ServerListen(host string, port int) error {
-	if dataDirErr := ensureDataDir(); dataDirErr != nil {
-		return dataDirErr
-	}
-	addrString := fmt.Sprintf("%s:%d", host, port)
-	server, serverErr := net.Listen("tcp", addrString)
+func listenAndServe(network, addr string, tlsConfig *tls.Config) error {
+	var config ServerConfig
+	config.Init()
+	config.Network = network
+	config.Addr = addr
+	config.TLSConfig = tlsConfig
+
+	server, serverErr := NewServer(config)
 
 	if serverErr != nil {
-		return errors.New(fmt.Sprintf("netfile server error listening: %s\n", serverErr.Error()))
+		return serverErr
 	}
-	defer server.Close()
 
-	fmt.Printf("netfile server listening on port: %d...\n", port)
+	return server.ListenAndServe()
+}
 
-	for {
-		conn, connErr := server.Accept()
+// Serve accepts client connections on l and handles each on its own
+// goroutine with a Server using the default ServerConfig.
+// It returns an error when l stops accepting connections.
+func Serve(l net.Listener) error {
+	var config ServerConfig
+	config.Init()
 
-		if connErr != nil {
-			return errors.New(fmt.Sprintf("netfile server client connection error: %s\n", connErr.Error()))
-		}
+	server, serverErr := NewServer(config)
 
-		fmt.Printf("Client connected from: '%s:%s'\n", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
-		go func() {
-			defer conn.Close()
-			// Send client ready message
-			SendMsg(conn, "server.ready")
-			for {
-				cmd, readErr := ReadMsg(conn)
-
-				switch {
-				case readErr == io.EOF:
-					fmt.Println("netfile server closed connection.")
-					return
-				case readErr != nil:
-					fmt.Printf("netfile.ReadMsg() error: %s\n", readErr.Error())
-					return
-				}
-
-				if cmd == "client.quit" {
-					fmt.Println("client.quit msg received...")
-					break
-				}
-
-				onHandleCommand(cmd, conn)
-			}
-		}()
+	if serverErr != nil {
+		return serverErr
 	}
 
-	return nil
+	return server.Serve(l)
 }
 
 func NewConnReadWriter(conn net.Conn) *bufio.ReadWriter {
@@ -263,13 +259,24 @@ func readMsg(rw *bufio.ReadWriter) (string, error) {
 	command, ioErr := rw.ReadString(delim)
 	command = strings.Trim(command, string(delim)+" ")
 
+	// Pass EOF through untouched so callers can tell a clean disconnect apart.
+	if ioErr == io.EOF && command == "" {
+		return "", io.EOF
+	}
+
 	if ioErr != nil {
-		return "", errors.New(fmt.Sprintf("netfile.ReadMsg() network io error: %s\n", ioErr.Error()))
+		return "", fmt.Errorf("netfile.ReadMsg() network io error: %w", ioErr)
 	}
 
 	return command, nil
 }
 
+// isTimeout reports whether err was caused by a connection deadline passing.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func ReadMsg(conn net.Conn) (string, error) {
 	return readMsg(NewConnReadWriter(conn))
 }
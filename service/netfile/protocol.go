@@ -0,0 +1,270 @@
+package netfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Protocol versions. Every connection starts with the legacy newline
+// delimited text protocol, ProtocolLegacy, in which the original commands
+// get the same replies, byte for byte, as from the original netfile server.
+// Right after "server.ready" a client may send "client.protocol.v2"; a server
+// that supports it answers "server.protocol.v2" and both sides switch to
+// ProtocolFramed. Servers without it that answer unknown commands with
+// "server.unknown" keep the connection on the legacy protocol, while the
+// original netfile server ignores the command without replying at all.
+const (
+	ProtocolLegacy = 1
+	ProtocolFramed = 2
+)
+
+// MaxHeaderSize is the largest Frame header, in bytes, either side accepts.
+const MaxHeaderSize = 1 << 20
+
+// ErrFrameTooLarge is returned when a Frame header exceeds MaxHeaderSize.
+var ErrFrameTooLarge = errors.New("netfile: frame header too large")
+
+// Frame is one protocol message: a command or reply Name with its Args, a
+// JSON document in Data or a ServerError.
+//
+// With ProtocolFramed a Frame is sent as a 4 byte big-endian length followed
+// by the Frame as JSON, so names and arguments may hold any character. With
+// ProtocolLegacy the Name and each Arg are sent as lines, followed by Data or
+// Error as a single JSON line. In both, file contents follow the Frame that
+// announces their size as raw bytes.
+type Frame struct {
+	Name  string          `json:"Name,omitempty"`
+	Args  []string        `json:"Args,omitempty"`
+	Data  json.RawMessage `json:"Data,omitempty"`
+	Error *ServerError    `json:"Error,omitempty"`
+}
+
+// protoConn reads and writes Frames over one connection in whichever
+// protocol version is in use. Raw file bytes go straight through rw.
+type protoConn struct {
+	rw      *bufio.ReadWriter
+	version int
+
+	// pending is the framed message whose Name readName returned and whose
+	// other parts haven't been read yet.
+	pending *Frame
+}
+
+func newProtoConn(rw *bufio.ReadWriter) *protoConn {
+	return &protoConn{rw: rw, version: ProtocolLegacy}
+}
+
+// framed reports whether the connection has switched to ProtocolFramed.
+func (p *protoConn) framed() bool {
+	return p.version >= ProtocolFramed
+}
+
+// readName reads the next message and returns its name. Any parts of the
+// previous framed message that weren't read are discarded.
+// It returns io.EOF when the peer closed the connection cleanly.
+func (p *protoConn) readName() (string, error) {
+	if !p.framed() {
+		return readMsg(p.rw)
+	}
+
+	frame, err := readFrame(p.rw)
+	if err != nil {
+		return "", err
+	}
+
+	p.pending = frame
+
+	return frame.Name, nil
+}
+
+// readArgs reads the n arguments of the message whose name was just read,
+// or, if there is none, of a message that only carries arguments.
+func (p *protoConn) readArgs(n int) ([]string, error) {
+	if !p.framed() {
+		args := make([]string, n)
+		for i := range args {
+			arg, err := readMsg(p.rw)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = arg
+		}
+		return args, nil
+	}
+
+	frame := p.take()
+	if frame == nil {
+		var err error
+		if frame, err = readFrame(p.rw); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(frame.Args) != n {
+		return nil, fmt.Errorf("netfile: '%s' has %d arguments, expected %d", frame.Name, len(frame.Args), n)
+	}
+
+	return frame.Args, nil
+}
+
+// readData decodes the JSON document of the message whose name was just
+// read into v.
+func (p *protoConn) readData(v interface{}) error {
+	var data []byte
+
+	if !p.framed() {
+		line, err := readMsg(p.rw)
+		if err != nil {
+			return err
+		}
+		data = []byte(line)
+	} else if frame := p.take(); frame != nil {
+		data = frame.Data
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("netfile: malformed reply data: %w", err)
+	}
+
+	return nil
+}
+
+// readError returns the ServerError of the server.error message whose name
+// was just read.
+func (p *protoConn) readError() error {
+	serverErr := &ServerError{}
+
+	if !p.framed() {
+		if err := p.readData(serverErr); err != nil {
+			return err
+		}
+		return serverErr
+	}
+
+	frame := p.take()
+	if frame == nil || frame.Error == nil {
+		return errors.New("netfile: malformed server.error reply")
+	}
+
+	return frame.Error
+}
+
+// take returns and clears the pending framed message.
+func (p *protoConn) take() *Frame {
+	frame := p.pending
+	p.pending = nil
+	return frame
+}
+
+// writeFrame buffers a message called name with args. An empty name writes
+// a message that only carries arguments.
+func (p *protoConn) writeFrame(name string, args ...string) error {
+	if p.framed() {
+		return writeFrame(p.rw, &Frame{Name: name, Args: args})
+	}
+
+	lines := args
+	if name != "" {
+		lines = append([]string{name}, args...)
+	}
+
+	for _, line := range lines {
+		if strings.ContainsRune(line, '\n') {
+			return fmt.Errorf("netfile: '%s' can't be sent with the legacy protocol", line)
+		}
+	}
+
+	for _, line := range lines {
+		if _, err := p.rw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeData buffers a message called name carrying v as JSON.
+func (p *protoConn) writeData(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if p.framed() {
+		return writeFrame(p.rw, &Frame{Name: name, Data: data})
+	}
+
+	p.rw.WriteString(name + "\n")
+	p.rw.Write(data)
+	_, err = p.rw.WriteString("\n")
+
+	return err
+}
+
+// writeError buffers a server.error message.
+func (p *protoConn) writeError(code, msg string) error {
+	serverErr := &ServerError{Code: code, Message: msg}
+
+	if p.framed() {
+		return writeFrame(p.rw, &Frame{Name: "server.error", Error: serverErr})
+	}
+
+	return p.writeData("server.error", serverErr)
+}
+
+// flush sends everything buffered.
+func (p *protoConn) flush() error {
+	return p.rw.Flush()
+}
+
+// readFrame reads one length-prefixed Frame.
+func readFrame(r io.Reader) (*Frame, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("netfile.readFrame() network io error: %w", err)
+	}
+
+	if size > MaxHeaderSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("netfile.readFrame() network io error: %w", err)
+	}
+
+	frame := &Frame{}
+	if err := json.Unmarshal(data, frame); err != nil {
+		return nil, fmt.Errorf("netfile: malformed frame: %w", err)
+	}
+
+	return frame, nil
+}
+
+// writeFrame writes frame with its length prefix.
+func writeFrame(w io.Writer, frame *Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > MaxHeaderSize {
+		return ErrFrameTooLarge
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
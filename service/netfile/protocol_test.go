@@ -0,0 +1,178 @@
+package netfile_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestFramedProtocol(t *testing.T) {
+	root := t.TempDir()
+	addr := startServer(t, testConfig(t, root))
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	if client.Protocol() != netfile.ProtocolFramed {
+		t.Fatalf("Dial() negotiated protocol %d, expected %d", client.Protocol(), netfile.ProtocolFramed)
+	}
+
+	// A name that would split into two commands with the legacy protocol.
+	name := "two\nlines"
+	data := "framed"
+
+	if err := client.Store(ctx, name, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Store(%q) error: %s", name, err)
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(root, name)); string(got) != data {
+		t.Errorf("Store(%q) wrote %q, expected %q", name, got, data)
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.Fetch(ctx, name, &buf); err != nil || buf.String() != data {
+		t.Errorf("Fetch(%q) = %q, %v, expected %q", name, buf.String(), err, data)
+	}
+
+	if err := client.Ping(ctx); err != nil {
+		t.Errorf("Ping() after transfers error: %s", err)
+	}
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "old.txt"), []byte("legacy"), 0644)
+
+	conn, err := net.Dial("tcp", startServer(t, testConfig(t, root)))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+
+	if msg, err := netfile.ReadMsg(conn); err != nil || msg != "server.ready" {
+		t.Fatalf("ReadMsg() = %q, %v, expected \"server.ready\"", msg, err)
+	}
+
+	ctx := context.Background()
+	client := netfile.NewClient(conn)
+	defer client.Quit()
+
+	if client.Protocol() != netfile.ProtocolLegacy {
+		t.Fatalf("NewClient() protocol %d, expected %d", client.Protocol(), netfile.ProtocolLegacy)
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.Fetch(ctx, "old.txt", &buf); err != nil || buf.String() != "legacy" {
+		t.Errorf("Fetch() = %q, %v, expected \"legacy\"", buf.String(), err)
+	}
+
+	if err := client.Store(ctx, "bad\nname", strings.NewReader("x"), 1); err == nil {
+		t.Errorf("Store() of a name with a newline succeeded over the legacy protocol")
+	}
+
+	if err := client.Negotiate(ctx); err != nil || client.Protocol() != netfile.ProtocolFramed {
+		t.Fatalf("Negotiate() = %v, protocol %d, expected %d", err, client.Protocol(), netfile.ProtocolFramed)
+	}
+
+	buf.Reset()
+	if _, err := client.Fetch(ctx, "old.txt", &buf); err != nil || buf.String() != "legacy" {
+		t.Errorf("Fetch() after Negotiate() = %q, %v, expected \"legacy\"", buf.String(), err)
+	}
+}
+
+func TestNegotiateWithOriginalServer(t *testing.T) {
+	defer func(timeout time.Duration) { netfile.NegotiateTimeout = timeout }(netfile.NegotiateTimeout)
+	netfile.NegotiateTimeout = 100 * time.Millisecond
+
+	addr := startLegacyServer(t, map[string]string{"old.txt": "legacy"}, true)
+
+	// Without a deadline of its own, Dial gives up on the silent server
+	// after NegotiateTimeout and stays on the legacy protocol.
+	ctx := context.Background()
+	done := make(chan struct{})
+	var client *netfile.Client
+	var err error
+
+	go func() {
+		defer close(done)
+		client, err = netfile.Dial(ctx, "tcp", addr, nil)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dial() to a server that never answers negotiation hung")
+	}
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	if client.Protocol() != netfile.ProtocolLegacy {
+		t.Errorf("Dial() negotiated protocol %d, expected %d", client.Protocol(), netfile.ProtocolLegacy)
+	}
+
+	client.Compression = []string{netfile.CompressionGzip}
+
+	var buf bytes.Buffer
+	if _, err := client.Fetch(ctx, "old.txt", &buf); err != nil || buf.String() != "legacy" {
+		t.Errorf("Fetch() = %q, %v, expected \"legacy\"", buf.String(), err)
+	}
+
+	// A deadline from the caller is kept and its expiry is an error.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := netfile.Dial(ctx, "tcp", addr, nil); err == nil {
+		t.Errorf("Dial() with a deadline to a server that never answers negotiation succeeded")
+	}
+}
+
+// TestLegacyTranscript plays what a client written against the original
+// netfile server sends and checks the server's replies byte for byte.
+func TestLegacyTranscript(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "old.txt"), []byte("legacy"), 0644)
+
+	conn, err := net.Dial("tcp", startServer(t, testConfig(t, root)))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	transcript := "client.fetch\nold.txt\n" +
+		"client.fetch\nmissing.txt\n" +
+		"client.fetch\nold.txt\n" +
+		"client.quit\n"
+
+	if _, err := conn.Write([]byte(transcript)); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	replies, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	expected := "server.ready\n" +
+		"server.fetch.file\n6\nlegacy" +
+		"server.fetch.nofile\n" +
+		"server.fetch.file\n6\nlegacy"
+
+	if string(replies) != expected {
+		t.Errorf("server replied %q, expected %q", replies, expected)
+	}
+}
@@ -0,0 +1,349 @@
+package netfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PartialSuffix is appended to the destination path of Client.Download while
+// the download is incomplete. A later Download of the same file resumes from
+// the end of the partial file.
+const PartialSuffix = ".part"
+
+// handleClientFetchRange implements client.fetch.range:
+//
+//	client -> client.fetch.range, <name>, <offset>, <length>
+//	server -> server.fetch.range, <offset>, <length>, <file size>, <file sha256>,
+//	          <length bytes>, server.fetch.ok | server.error, <ServerError json>
+//	        | server.error, <ServerError json>
+//
+// A negative length reads to the end of the file and a length running past
+// the end is cut short, so the reply carries the length actually sent. The
+// checksum is of the whole file so a client can verify the result once it
+// has every range.
+func (s *Server) handleClientFetchRange(sc *serverConn) {
+	s.fetchRange(sc, "client.fetch.range", false)
+}
+
+// handleClientFetchRangeCompressed implements client.fetch.range.compressed,
+// which works like client.fetch.range but takes the encodings the client
+// accepts, in order of preference, and sends the range compressed with the
+// first one the server supports:
+//
+//	client -> client.fetch.range.compressed, <name>, <offset>, <length>, <encodings>
+//	server -> server.fetch.range.compressed, <encoding>, <offset>, <length>,
+//	          <file size>, <file sha256>, <compressed chunks>,
+//	          server.fetch.ok | server.error, <ServerError json>
+//	        | server.error, <ServerError json>
+//
+// The length, size and checksum are those of the uncompressed data. The
+// compressed bytes are sent as chunks each preceded by its 4 byte big-endian
+// length and ended by an empty chunk.
+func (s *Server) handleClientFetchRangeCompressed(sc *serverConn) {
+	s.fetchRange(sc, "client.fetch.range.compressed", true)
+}
+
+func (s *Server) fetchRange(sc *serverConn, cmd string, compressed bool) {
+	p := sc.proto
+
+	n := 3
+	if compressed {
+		n = 4
+	}
+
+	args, readErr := p.readArgs(n)
+	if readErr != nil {
+		return
+	}
+
+	name := args[0]
+	offset, offsetErr := strconv.ParseInt(args[1], 10, 64)
+	length, lengthErr := strconv.ParseInt(args[2], 10, 64)
+
+	if offsetErr != nil || lengthErr != nil || offset < 0 {
+		replyError(p, ErrCodeBadRequest, "malformed offset or length")
+		return
+	}
+
+	if !s.allow(sc, PermRead, cmd, name) {
+		replyError(p, ErrCodeForbidden, "permission denied")
+		return
+	}
+
+	path, resolveErr := sc.files.Resolve(name)
+	if resolveErr != nil {
+		replyError(p, ErrCodeBadRequest, resolveErr.Error())
+		return
+	}
+
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		s.audit(sc, cmd, name, ErrCodeNoFile)
+		replyError(p, ErrCodeNoFile, "no such file")
+		return
+	}
+	defer file.Close()
+
+	info, statErr := file.Stat()
+	if statErr != nil || !info.Mode().IsRegular() {
+		s.audit(sc, cmd, name, ErrCodeNoFile)
+		replyError(p, ErrCodeNoFile, "no such file")
+		return
+	}
+
+	size := info.Size()
+
+	if offset > size {
+		replyError(p, ErrCodeBadRequest, fmt.Sprintf("offset %d is past the end of the file (%d bytes)", offset, size))
+		return
+	}
+
+	if length < 0 || length > size-offset {
+		length = size - offset
+	}
+
+	checksum, sumErr := s.checksums.get(path, info, s.config.BufferSize)
+	if sumErr != nil {
+		sc.logger.Printf("netfile.handleClientFetchRange() error: %s", sumErr.Error())
+		replyError(p, ErrCodeInternal, "unable to read file")
+		return
+	}
+
+	if _, seekErr := file.Seek(offset, io.SeekStart); seekErr != nil {
+		sc.logger.Printf("netfile.handleClientFetchRange() seek error: %s", seekErr.Error())
+		replyError(p, ErrCodeInternal, "unable to read file")
+		return
+	}
+
+	header := []string{strconv.FormatInt(offset, 10), strconv.FormatInt(length, 10), strconv.FormatInt(size, 10), checksum}
+
+	var sendErr error
+
+	if compressed {
+		encoding := chooseEncoding(args[3])
+		sc.logger.Printf("Sending: '%s' bytes %d-%d of %d (%s)", name, offset, offset+length, size, encoding)
+
+		p.writeFrame("server.fetch.range.compressed", append([]string{encoding}, header...)...)
+		sendErr = s.sendCompressed(sc, file, length, encoding)
+	} else {
+		sc.logger.Printf("Sending: '%s' bytes %d-%d of %d", name, offset, offset+length, size)
+
+		p.writeFrame("server.fetch.range", header...)
+		sendErr = s.sendFile(sc, file, length)
+	}
+
+	if sendErr != nil {
+		sc.logger.Printf("netfile.handleClientFetchRange() error: %s", sendErr.Error())
+	}
+
+	s.audit(sc, cmd, name, resultOf(sendErr))
+}
+
+// FetchRange asks the server for length bytes of the file called name
+// starting at offset and streams them into w. A negative length asks for
+// everything from offset to the end of the file. When the range covers the
+// whole file it is checked against the file's sha256 digest. With
+// Client.Compression set the range is sent compressed.
+// It returns the number of bytes written to w, the Name, Size and Sha256 of
+// the whole file on the server, an error matching ErrNoFile if the server
+// doesn't have it, or the error that interrupted the transfer.
+func (c *Client) FetchRange(ctx context.Context, name string, offset, length int64, w io.Writer) (int64, *FileInfo, error) {
+	var written int64
+	info := &FileInfo{Name: name}
+
+	err := c.do(ctx, func() error {
+		var err error
+		written, err = c.fetchRange(name, offset, length, w, info)
+		return err
+	})
+	if err != nil {
+		return written, nil, err
+	}
+
+	return written, info, nil
+}
+
+// fetchRange runs the FetchRange exchange, filling in info. A server that
+// doesn't know client.fetch.range.compressed is asked again without
+// compression, which is then left off for the rest of the connection. Over
+// ProtocolLegacy an unknown command leaves the connection unusable instead,
+// so it is closed.
+func (c *Client) fetchRange(name string, offset, length int64, w io.Writer, info *FileInfo) (int64, error) {
+	compressed := len(c.Compression) > 0 && !c.noCompression
+
+	args := []string{name, strconv.FormatInt(offset, 10), strconv.FormatInt(length, 10)}
+	cmd, want := "client.fetch.range", "server.fetch.range"
+
+	if compressed {
+		args = append(args, strings.Join(c.Compression, ","))
+		cmd, want = "client.fetch.range.compressed", "server.fetch.range.compressed"
+	}
+
+	if err := c.send(cmd, args...); err != nil {
+		return 0, err
+	}
+
+	reply, err := c.proto.readName()
+	if err != nil {
+		return 0, err
+	}
+
+	switch reply {
+	case want:
+	case "server.error":
+		return 0, c.readServerError()
+	case "server.unknown":
+		// A legacy server reads each of the command's arguments as a command
+		// of its own and answers those too, so the connection is out of step.
+		if !c.proto.framed() {
+			c.conn.Close()
+			return 0, fmt.Errorf("%w: '%s', connection closed", ErrUnknownCommand, cmd)
+		}
+		if compressed {
+			c.noCompression = true
+			return c.fetchRange(name, offset, length, w, info)
+		}
+		return 0, ErrUnknownCommand
+	default:
+		return 0, unexpectedReply(want, reply)
+	}
+
+	n := 4
+	if compressed {
+		n = 5
+	}
+
+	if args, err = c.proto.readArgs(n); err != nil {
+		return 0, err
+	}
+
+	encoding := CompressionNone
+	if compressed {
+		encoding, args = args[0], args[1:]
+	}
+
+	var header [3]int64
+	for i := range header {
+		if header[i], err = parseSize(args[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	info.Sha256 = args[3]
+
+	if header[0] != offset {
+		c.conn.Close()
+		return 0, fmt.Errorf("netfile: server sent offset %d, expected %d", header[0], offset)
+	}
+
+	info.Size = header[2]
+	sum := sha256.New()
+
+	var written int64
+
+	if compressed {
+		written, err = c.receiveCompressed(encoding, io.MultiWriter(w, sum), header[1])
+	} else {
+		written, err = c.receive(c.proto.rw, io.MultiWriter(w, sum), header[1])
+		if err != nil {
+			// Unread bytes of the range are still in flight.
+			c.conn.Close()
+		}
+	}
+	if err != nil {
+		return written, err
+	}
+
+	if err := c.readTrailer(); err != nil {
+		return written, err
+	}
+
+	if offset == 0 && written == info.Size {
+		return written, verifySum(name, sum, info.Sha256)
+	}
+
+	return written, nil
+}
+
+// Download fetches the file called name into the local file at path. Data is
+// written to path+PartialSuffix first; if that exists from an earlier,
+// interrupted Download only the missing tail is fetched. The finished file
+// is checked against the sha256 digest the server reports for it before it
+// is renamed to path.
+// It returns an error wrapping ErrChecksumMismatch, in which case the partial
+// file is removed so the next attempt starts over, or the error that
+// interrupted the transfer, in which case the partial file is kept.
+func (c *Client) Download(ctx context.Context, name, path string) error {
+	info, err := c.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	partial := path + PartialSuffix
+
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("netfile.Client download error: %w", err)
+	}
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err == nil && offset > info.Size {
+		// Left over from a different version of the file.
+		offset, err = 0, file.Truncate(0)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("netfile.Client download error: %w", err)
+	}
+
+	if offset < info.Size {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return fmt.Errorf("netfile.Client download error: %w", err)
+		}
+
+		_, rangeInfo, err := c.FetchRange(ctx, name, offset, -1, file)
+		if err != nil {
+			file.Close()
+			if errors.Is(err, ErrChecksumMismatch) {
+				os.Remove(partial)
+			}
+			return err
+		}
+
+		// The digest sent with the data describes the version streamed,
+		// should the file have changed since it was stat'd.
+		info = rangeInfo
+	}
+
+	sum := sha256.New()
+	_, err = file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyBuffer(sum, file, make([]byte, BufferSize))
+	}
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("netfile.Client download error: %w", err)
+	}
+
+	if err := verifySum(name, sum, info.Sha256); err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	if err := os.Rename(partial, path); err != nil {
+		return fmt.Errorf("netfile.Client download error: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package netfile_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestFetchRange(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "digits"), []byte("0123456789"), 0644)
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", startServer(t, testConfig(t, root)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, 4, "3456"},
+		{7, 100, "789"},
+		{10, -1, ""},
+		// offset+length overflows.
+		{2, math.MaxInt64, "23456789"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		n, info, err := client.FetchRange(ctx, "digits", test.offset, test.length, &buf)
+		if err != nil {
+			t.Errorf("FetchRange(%d, %d) error: %s", test.offset, test.length, err)
+			continue
+		}
+		if buf.String() != test.want || n != int64(len(test.want)) || info.Size != 10 {
+			t.Errorf("FetchRange(%d, %d) = %q, %d, %d, expected %q", test.offset, test.length, buf.String(), n, info.Size, test.want)
+		}
+	}
+
+	if _, _, err := client.FetchRange(ctx, "digits", 11, -1, &bytes.Buffer{}); err == nil {
+		t.Errorf("FetchRange() past the end succeeded")
+	}
+
+	if _, _, err := client.FetchRange(ctx, "missing", 0, -1, &bytes.Buffer{}); !errors.Is(err, netfile.ErrNoFile) {
+		t.Errorf("FetchRange() of a missing file error = %v, expected ErrNoFile", err)
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("netfile "), 4096)
+	os.WriteFile(filepath.Join(root, "big"), data, 0644)
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", startServer(t, testConfig(t, root)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	dest := filepath.Join(t.TempDir(), "big")
+
+	// An earlier attempt that stopped part way through.
+	os.WriteFile(dest+netfile.PartialSuffix, data[:1000], 0644)
+
+	var fetched int64
+	client.OnProgress = func(transferred, total int64) { fetched = total }
+
+	if err := client.Download(ctx, "big", dest); err != nil {
+		t.Fatalf("Download() error: %s", err)
+	}
+
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, data) {
+		t.Errorf("Download() wrote %d bytes that don't match the %d on the server", len(got), len(data))
+	}
+
+	if want := int64(len(data) - 1000); fetched != want {
+		t.Errorf("Download() fetched %d bytes, expected only the missing %d", fetched, want)
+	}
+
+	// A corrupt partial file fails verification and is discarded.
+	os.WriteFile(dest+netfile.PartialSuffix, []byte("garbage"), 0644)
+
+	if err := client.Download(ctx, "big", dest); !errors.Is(err, netfile.ErrChecksumMismatch) {
+		t.Errorf("Download() error = %v, expected ErrChecksumMismatch", err)
+	}
+
+	if _, err := os.Stat(dest + netfile.PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("Download() kept the corrupt partial file")
+	}
+}
+
+// pausingProxy relays one connection to addr, holding back what the server
+// sends once after the first after bytes until resume is closed. paused is
+// closed when that happens.
+// It returns the address to dial.
+func pausingProxy(t *testing.T, addr string, after int64, paused, resume chan struct{}) string {
+	t.Helper()
+
+	l := listen(t)
+
+	go func() {
+		client, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		server, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer server.Close()
+
+		go io.Copy(server, client)
+
+		io.CopyN(client, server, after)
+		close(paused)
+		<-resume
+		io.Copy(client, server)
+	}()
+
+	return l.Addr().String()
+}
+
+func TestDownloadInterruptedByShrinkingFile(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "big.bin")
+
+	// Large enough that the server blocks on the paused proxy long before
+	// it has read the whole file.
+	data := make([]byte, 32<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	os.WriteFile(path, data, 0644)
+
+	paused, resume := make(chan struct{}), make(chan struct{})
+	addr := pausingProxy(t, startServer(t, testConfig(t, root)), 1<<20, paused, resume)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := netfile.Dial(ctx, "tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Close()
+
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	downloaded := make(chan error, 1)
+	go func() { downloaded <- client.Download(ctx, "big.bin", dest) }()
+
+	<-paused
+	// The server's next read comes up short.
+	os.Truncate(path, 0)
+	time.Sleep(100 * time.Millisecond)
+	close(resume)
+
+	if err := <-downloaded; err == nil {
+		t.Fatalf("Download() of a file that shrank mid-transfer succeeded")
+	}
+
+	part, err := os.ReadFile(dest + netfile.PartialSuffix)
+	if err != nil {
+		t.Fatalf("the partial file wasn't kept: %s", err)
+	}
+
+	if len(part) == 0 || len(part) >= len(data) || !bytes.Equal(part, data[:len(part)]) {
+		t.Errorf("the partial file holds %d bytes that aren't the first bytes of the file", len(part))
+	}
+}
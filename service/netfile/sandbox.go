@@ -0,0 +1,153 @@
+package netfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidName is returned when a client supplied file name is empty,
+// absolute, contains a ".." element or a NUL byte.
+var ErrInvalidName = errors.New("netfile: invalid file name")
+
+// ErrOutsideRoot is returned when a client supplied file name resolves, via
+// symlinks, to somewhere outside the sandbox root.
+var ErrOutsideRoot = errors.New("netfile: file name escapes root")
+
+// Sandbox resolves client supplied file names against a root directory and
+// refuses any name that would reach outside of it, whether through ".."
+// elements or through symlinks. It never changes the process working
+// directory so it is safe to use from concurrent connections.
+type Sandbox struct {
+	// root is absolute with its own symlinks resolved so that resolved names
+	// can be compared against it.
+	root string
+}
+
+// NewSandbox creates a Sandbox rooted at root.
+// It returns an error if root doesn't exist or isn't a directory.
+func NewSandbox(root string) (*Sandbox, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(real)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("netfile: sandbox root '" + root + "' is not a directory")
+	}
+
+	return &Sandbox{root: real}, nil
+}
+
+// Root returns the absolute, symlink free path of the sandbox root.
+func (s *Sandbox) Root() string {
+	return s.root
+}
+
+// Resolve maps name, a slash separated path relative to the root, to an
+// absolute path inside the root. The named file doesn't have to exist, but
+// any part of the path that does exist must not be a symlink leading out of
+// the root.
+// It returns ErrInvalidName or ErrOutsideRoot if the name is refused.
+func (s *Sandbox) Resolve(name string) (string, error) {
+	if !validName(name) {
+		return "", ErrInvalidName
+	}
+
+	path := filepath.Join(s.root, filepath.FromSlash(name))
+
+	real, err := evalExisting(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !s.contains(real) {
+		return "", ErrOutsideRoot
+	}
+
+	return path, nil
+}
+
+// Rel returns path, which must be inside the root, as a slash separated name
+// relative to it.
+func (s *Sandbox) Rel(path string) string {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// contains reports whether path is the root or inside it.
+func (s *Sandbox) contains(path string) bool {
+	if path == s.root {
+		return true
+	}
+
+	return strings.HasPrefix(path, s.root+string(filepath.Separator))
+}
+
+// validName reports whether name is a non-empty relative path without ".."
+// elements or NUL bytes. Both separators are checked so a Windows style name
+// can't slip through on either platform.
+func validName(name string) bool {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return false
+	}
+
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return false
+	}
+
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return filepath.Clean(filepath.FromSlash(name)) != "."
+}
+
+// evalExisting resolves the symlinks of the longest existing prefix of path
+// and joins the remaining, not yet existing, elements back on.
+func evalExisting(path string) (string, error) {
+	var missing []string
+
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				real = filepath.Join(real, missing[i])
+			}
+			return real, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// A dangling symlink can't be proven to stay inside the root.
+		if _, lstatErr := os.Lstat(path); lstatErr == nil {
+			return "", ErrOutsideRoot
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+
+		missing = append(missing, filepath.Base(path))
+		path = parent
+	}
+}
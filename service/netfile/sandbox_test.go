@@ -0,0 +1,120 @@
+package netfile_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestSandboxResolve(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "sub", "b.txt"), []byte("b"), 0644)
+
+	sandbox, err := netfile.NewSandbox(root)
+	if err != nil {
+		t.Fatalf("NewSandbox(%q) error: %s", root, err)
+	}
+
+	refused := []string{
+		"",
+		".",
+		"..",
+		"../../etc/passwd",
+		"sub/../../etc/passwd",
+		"sub/../..",
+		"/etc/passwd",
+		"..\\..\\etc\\passwd",
+		"a\x00b",
+	}
+
+	for _, name := range refused {
+		if path, err := sandbox.Resolve(name); err == nil {
+			t.Errorf("Resolve(%q) = %q, expected it to be refused", name, path)
+		}
+	}
+
+	allowed := map[string]string{
+		"a.txt":         filepath.Join(sandbox.Root(), "a.txt"),
+		"sub/b.txt":     filepath.Join(sandbox.Root(), "sub", "b.txt"),
+		"sub/./b.txt":   filepath.Join(sandbox.Root(), "sub", "b.txt"),
+		"new/dir/c.txt": filepath.Join(sandbox.Root(), "new", "dir", "c.txt"),
+	}
+
+	for name, want := range allowed {
+		path, err := sandbox.Resolve(name)
+		if err != nil || path != want {
+			t.Errorf("Resolve(%q) = %q, %v, expected %q", name, path, err, want)
+		}
+	}
+}
+
+func TestSandboxSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(root, "inside"), []byte("inside"), 0644)
+
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symlinks unavailable: %s", err)
+	}
+	os.Symlink(filepath.Join(root, "inside"), filepath.Join(root, "alias"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+
+	sandbox, err := netfile.NewSandbox(root)
+	if err != nil {
+		t.Fatalf("NewSandbox(%q) error: %s", root, err)
+	}
+
+	for _, name := range []string{"escape", "escape/secret", "escape/new.txt", "dangling"} {
+		if _, err := sandbox.Resolve(name); !errors.Is(err, netfile.ErrOutsideRoot) {
+			t.Errorf("Resolve(%q) error = %v, expected ErrOutsideRoot", name, err)
+		}
+	}
+
+	if _, err := sandbox.Resolve("alias"); err != nil {
+		t.Errorf("Resolve(%q) error = %v, expected a symlink inside the root to be allowed", "alias", err)
+	}
+}
+
+func TestFetchRefusesTraversal(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(root, "ok.txt"), []byte("ok"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+
+	addr := startServer(t, testConfig(t, root))
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	rel, _ := filepath.Rel(root, filepath.Join(outside, "secret"))
+
+	for _, name := range []string{"../../etc/passwd", "/etc/passwd", rel, "escape/secret"} {
+		var buf bytes.Buffer
+		if _, err := client.Fetch(ctx, name, &buf); err != netfile.ErrNoFile {
+			t.Errorf("Fetch(%q) error = %v, expected ErrNoFile", name, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Fetch(%q) leaked %d bytes", name, buf.Len())
+		}
+		if _, err := client.Stat(ctx, name); err == nil {
+			t.Errorf("Stat(%q) succeeded, expected it to be refused", name)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.Fetch(ctx, "ok.txt", &buf); err != nil || buf.String() != "ok" {
+		t.Errorf("Fetch(%q) = %q, %v, expected \"ok\"", "ok.txt", buf.String(), err)
+	}
+}
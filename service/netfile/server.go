@@ -0,0 +1,727 @@
+package netfile
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/steviesama/nx/service/socket"
+)
+
+// ErrServerClosed is returned by Server.Serve and Server.ListenAndServe after
+// Shutdown or Close has been called.
+var ErrServerClosed = errors.New("netfile: server closed")
+
+// ServerConfig holds the settings a netfile Server runs with and uses the json
+// annotations so it can be kept on disk next to other config.
+type ServerConfig struct {
+	// FilesDir is the directory files are served from and stored into.
+	// Client supplied names are confined to it.
+	FilesDir string `json:"FilesDir"`
+	// TempDir holds uploads while they are in flight. It should be on the same
+	// file system as FilesDir so finished uploads can be renamed into place.
+	TempDir string `json:"TempDir"`
+	// Network is "tcp" or "unix" and Addr the address ListenAndServe listens
+	// on, a host:port or a socket path.
+	Network string `json:"Network"`
+	Addr    string `json:"Addr"`
+	// TLSConfig, when not nil, makes ListenAndServe only accept TLS
+	// connections. nx/crypto.ServerTLSConfig builds one that reloads its
+	// certificate from disk.
+	TLSConfig *tls.Config `json:"-"`
+	// HandshakeTimeout bounds the TLS handshake of a new connection so a
+	// client that never completes it can't hold on to a connection slot.
+	// Zero falls back to ten seconds.
+	HandshakeTimeout time.Duration `json:"HandshakeTimeout"`
+	// BufferSize is the chunk size, in bytes, transfers are streamed in.
+	BufferSize int `json:"BufferSize"`
+	// MaxConnections caps the number of clients served at once. Further
+	// clients wait in the listen backlog until a slot frees up. Zero means no
+	// limit.
+	MaxConnections int `json:"MaxConnections"`
+	// IdleTimeout is how long the server waits for a client's next command
+	// before dropping the connection. Clients that need to stay connected
+	// while idle can send "client.ping". Zero disables the timeout.
+	IdleTimeout time.Duration `json:"IdleTimeout"`
+	// KeepAlivePeriod is the TCP keepalive period set on every client
+	// connection so half-open connections are detected by the OS. Zero leaves
+	// the system default in place.
+	KeepAlivePeriod time.Duration `json:"KeepAlivePeriod"`
+	// MaxUploadSize is the largest file, in bytes, client.store accepts. Zero
+	// means no limit.
+	MaxUploadSize int64 `json:"MaxUploadSize"`
+	// Overwrite is the policy client.store applies to files that already
+	// exist.
+	Overwrite OverwritePolicy `json:"Overwrite"`
+	// MaxListPage is the most entries client.list returns in one page.
+	MaxListPage int `json:"MaxListPage"`
+	// OnDisconnect, if set, is called when a client connection ends with the
+	// error that ended it, or nil when the client quit or closed cleanly.
+	OnDisconnect func(addr net.Addr, err error) `json:"-"`
+	// Users, when not empty, requires clients to authenticate as one of them
+	// and limits each to its own root and permissions. When empty every
+	// client has full access to FilesDir.
+	Users []User `json:"Users"`
+	// AuditLog, if set, receives an AuditEvent JSON line for every
+	// authentication and file access.
+	AuditLog io.Writer `json:"-"`
+	// AuditLogFile, if set and AuditLog isn't, is a file NewServer opens for
+	// appending and uses as the AuditLog.
+	AuditLogFile string `json:"AuditLogFile"`
+	// Logger receives the server's messages. Those about a connection, and
+	// the ones command handlers log, are prefixed with the client's address.
+	// When nil NewServer logs to standard output.
+	Logger *log.Logger `json:"-"`
+}
+
+// Init assigns the intended default values on the ServerConfig instance. The
+// directories default to the system wide DataDir layout which needs root to
+// create; point them elsewhere to run unprivileged.
+func (sc *ServerConfig) Init() {
+	sc.FilesDir = FilesDir
+	sc.TempDir = TempDir
+	sc.Network = "tcp"
+	sc.Addr = ""
+	sc.TLSConfig = nil
+	sc.HandshakeTimeout = 10 * time.Second
+	sc.BufferSize = BufferSize
+	sc.MaxConnections = 0
+	sc.IdleTimeout = 5 * time.Minute
+	sc.KeepAlivePeriod = 30 * time.Second
+	sc.MaxUploadSize = 1 << 30
+	sc.Overwrite = OverwriteReject
+	sc.MaxListPage = 1000
+	sc.OnDisconnect = nil
+	sc.Users = nil
+	sc.AuditLog = nil
+	sc.AuditLogFile = ""
+	sc.Logger = nil
+}
+
+// Server serves the netfile protocol from a ServerConfig. Each Server has its
+// own files root and command handlers so several can run in one process.
+type Server struct {
+	config ServerConfig
+	files  *Sandbox
+
+	// checksums caches the digests sent with transfers and client.stat.
+	checksums checksumCache
+
+	// accounts holds the configured Users by name.
+	accounts map[string]*account
+
+	// auditFile is the AuditLogFile opened by NewServer.
+	auditFile *os.File
+	mtxAudit  sync.Mutex
+
+	// builtins holds the commands netfile implements itself, which work on
+	// the connection's user and root in either protocol version.
+	builtins map[string]func(*serverConn)
+
+	// handlers holds the commands added with Server.AddCommandHandler.
+	handlers    map[string]CommandHandlerFunc
+	mtxHandlers sync.RWMutex
+
+	// sem holds a token per connection being served when MaxConnections is
+	// set.
+	sem chan struct{}
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// serverConn tracks whether a connection is between commands so Shutdown can
+// close it without interrupting a transfer, and who the client is.
+type serverConn struct {
+	conn  net.Conn
+	proto *protoConn
+	idle  bool
+
+	// ctx is cancelled when the connection ends or the server is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *log.Logger
+
+	// user is nil until the client authenticates, and always when
+	// authentication is disabled.
+	user *account
+	// files is the sandbox of the user's root.
+	files *Sandbox
+	perms Permission
+}
+
+// NewServer creates a Server from config, creating FilesDir and TempDir if
+// they don't exist. Zero HandshakeTimeout, BufferSize and MaxListPage fall
+// back to their defaults.
+// It returns an error if a directory is missing from config or can't be
+// created.
+func NewServer(config ServerConfig) (*Server, error) {
+	if config.FilesDir == "" || config.TempDir == "" {
+		return nil, errors.New("netfile.NewServer() error: FilesDir and TempDir are required")
+	}
+
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = 10 * time.Second
+	}
+
+	if config.BufferSize <= 0 {
+		config.BufferSize = BufferSize
+	}
+
+	if config.MaxListPage <= 0 {
+		config.MaxListPage = 1000
+	}
+
+	if config.Logger == nil {
+		config.Logger = log.New(os.Stdout, "netfile ", log.LstdFlags)
+	}
+
+	if dirErr := ensureDirs(config.Logger, config.FilesDir, config.TempDir); dirErr != nil {
+		return nil, dirErr
+	}
+
+	files, sandboxErr := NewSandbox(config.FilesDir)
+	if sandboxErr != nil {
+		return nil, fmt.Errorf("netfile.NewServer() error: %w", sandboxErr)
+	}
+
+	accounts, accountsErr := loadAccounts(config.Users, files)
+	if accountsErr != nil {
+		return nil, accountsErr
+	}
+
+	s := &Server{
+		config:    config,
+		files:     files,
+		accounts:  accounts,
+		handlers:  make(map[string]CommandHandlerFunc),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+		done:      make(chan struct{}),
+	}
+
+	s.builtins = map[string]func(*serverConn){
+		"client.fetch":                  s.handleClientFetch,
+		"client.fetch.range":            s.handleClientFetchRange,
+		"client.fetch.range.compressed": s.handleClientFetchRangeCompressed,
+		"client.ping":                   handleClientPing,
+		"client.store":                  s.handleClientStore,
+		"client.list":                   s.handleClientList,
+		"client.list.sums":              s.handleClientListSums,
+		"client.stat":                   s.handleClientStat,
+		"client.delete":                 s.handleClientDelete,
+	}
+
+	if config.AuditLog == nil && config.AuditLogFile != "" {
+		auditFile, openErr := os.OpenFile(config.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if openErr != nil {
+			return nil, fmt.Errorf("netfile audit log error: %w", openErr)
+		}
+
+		s.auditFile = auditFile
+		s.config.AuditLog = auditFile
+	}
+
+	if config.MaxConnections > 0 {
+		s.sem = make(chan struct{}, config.MaxConnections)
+	}
+
+	return s, nil
+}
+
+// ensureDirs creates each dir, and its parents, if it doesn't exist. When run
+// through sudo newly created dirs are handed to the invoking user so the
+// server can later run without root.
+func ensureDirs(logger *log.Logger, dirs ...string) error {
+	for _, dir := range dirs {
+		if _, statErr := os.Stat(dir); statErr == nil {
+			continue
+		}
+
+		logger.Printf("Creating '%s'...", dir)
+
+		if mkdirErr := os.MkdirAll(dir, os.ModePerm); mkdirErr != nil {
+			return fmt.Errorf("netfile mkdir error: %w", mkdirErr)
+		}
+
+		uid, uidErr := strconv.Atoi(os.Getenv("SUDO_UID"))
+		gid, gidErr := strconv.Atoi(os.Getenv("SUDO_GID"))
+
+		if uidErr == nil && gidErr == nil {
+			os.Chown(dir, uid, gid)
+		}
+	}
+
+	return nil
+}
+
+// Config returns the configuration the server is running with.
+func (s *Server) Config() ServerConfig {
+	return s.config
+}
+
+// Sandbox returns the Sandbox client supplied names are resolved with.
+func (s *Server) Sandbox() *Sandbox {
+	return s.files
+}
+
+// AddCommandHandler registers commandHandler for cmd on this server only,
+// taking precedence over the package level AddCommandHandler registrations
+// and the built-in commands. Handlers added this way bypass the per-user
+// permissions and should do their own checks with ConnContext.Permissions.
+// AddCommandHandler is thread safe.
+func (s *Server) AddCommandHandler(cmd string, commandHandler CommandHandlerFunc) {
+	s.mtxHandlers.Lock()
+	s.handlers[cmd] = commandHandler
+	s.mtxHandlers.Unlock()
+}
+
+// handler looks cmd up among the server's own handlers, the built-in
+// commands, then the package level handlers.
+// It returns the handler bound to sc.
+func (s *Server) handler(sc *serverConn, cmd string) (func(), bool) {
+	s.mtxHandlers.RLock()
+	handleCommand, ok := s.handlers[cmd]
+	s.mtxHandlers.RUnlock()
+
+	if ok {
+		return func() { handleCommand(&ConnContext{sc: sc}) }, true
+	}
+
+	if builtin, ok := s.builtins[cmd]; ok {
+		return func() { builtin(sc) }, true
+	}
+
+	mtxCommandHandlers.RLock()
+	handleCommand, ok = commandHandlers[cmd]
+	mtxCommandHandlers.RUnlock()
+
+	if ok {
+		return func() { handleCommand(&ConnContext{sc: sc}) }, true
+	}
+
+	return nil, false
+}
+
+func (s *Server) onHandleCommand(sc *serverConn, cmd string) {
+	handleCommand, ok := s.handler(sc, cmd)
+
+	if !ok {
+		sc.logger.Printf("The command '%s' is not registered.", cmd)
+		sc.proto.writeFrame("server.unknown")
+		sc.proto.flush()
+		return
+	}
+
+	handleCommand()
+}
+
+// ListenAndServe listens on the configured Network and Addr, with TLS when
+// TLSConfig is set, and serves clients until Shutdown or Close.
+// It returns ErrServerClosed once shut down, or the error that stopped it.
+func (s *Server) ListenAndServe() error {
+	l, listenErr := socket.Listen(s.config.Network, s.config.Addr, s.config.TLSConfig)
+
+	if listenErr != nil {
+		return fmt.Errorf("netfile server error listening: %w", listenErr)
+	}
+	defer l.Close()
+
+	s.config.Logger.Printf("server listening on %s: %s...", s.config.Network, s.config.Addr)
+
+	return s.Serve(l)
+}
+
+// Serve accepts client connections on l and handles each on its own
+// goroutine, no more than MaxConnections at once. Temporary accept errors
+// are retried with a growing delay. l is closed when Serve returns.
+// It returns ErrServerClosed once shut down, or the error that stopped l
+// accepting connections.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	var retryDelay time.Duration
+
+	for {
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.done:
+				return ErrServerClosed
+			}
+		}
+
+		conn, connErr := l.Accept()
+
+		if connErr != nil {
+			s.release()
+
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			// Errors such as running out of file descriptors pass, so back
+			// off and keep accepting rather than stop serving.
+			if isTemporary(connErr) {
+				retryDelay = acceptBackoff(retryDelay)
+				s.config.Logger.Printf("server accept error: %s...retrying in %s", connErr.Error(), retryDelay)
+
+				select {
+				case <-time.After(retryDelay):
+				case <-s.done:
+					return ErrServerClosed
+				}
+				continue
+			}
+
+			return fmt.Errorf("netfile server client connection error: %w", connErr)
+		}
+
+		retryDelay = 0
+
+		sc := &serverConn{conn: conn, files: s.files}
+		if !s.authRequired() {
+			sc.perms = PermAll
+		}
+
+		sc.ctx, sc.cancel = context.WithCancel(context.Background())
+		sc.logger = log.New(s.config.Logger.Writer(), s.config.Logger.Prefix()+conn.RemoteAddr().String()+" ", s.config.Logger.Flags())
+		sc.logger.Printf("Client connected from: '%s:%s'", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+
+		if !s.trackConn(sc, true) {
+			sc.cancel()
+			conn.Close()
+			s.release()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.release()
+			defer s.trackConn(sc, false)
+			s.serveConn(sc)
+		}()
+	}
+}
+
+// serveConn runs the command loop for one client.
+func (s *Server) serveConn(sc *serverConn) {
+	conn := sc.conn
+	var disconnectErr error
+
+	defer func() {
+		sc.cancel()
+		conn.Close()
+		if s.config.OnDisconnect != nil {
+			s.config.OnDisconnect(conn.RemoteAddr(), disconnectErr)
+		}
+	}()
+
+	s.setKeepAlive(conn)
+
+	// Finish the TLS handshake before greeting the client so a peer that
+	// never completes it is dropped rather than left waiting for a command.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(sc.ctx, s.config.HandshakeTimeout)
+		handshakeErr := tlsConn.HandshakeContext(ctx)
+		cancel()
+
+		if handshakeErr != nil {
+			sc.logger.Printf("TLS handshake error: %s", handshakeErr.Error())
+			disconnectErr = handshakeErr
+			return
+		}
+	}
+
+	// A single buffered reader per connection so bytes a client sends ahead
+	// of time aren't lost between commands.
+	sc.proto = newProtoConn(NewConnReadWriter(conn))
+	// Send client ready message
+	sc.proto.writeFrame("server.ready")
+	if flushErr := sc.proto.flush(); flushErr != nil {
+		sc.logger.Printf("server write error: %s", flushErr.Error())
+		disconnectErr = flushErr
+		return
+	}
+
+	for {
+		if !s.setIdle(sc, true) {
+			sc.logger.Print("server shutting down...closing connection.")
+			return
+		}
+
+		// Every command pushes the idle deadline forward.
+		if s.config.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		}
+
+		cmd, readErr := sc.proto.readName()
+
+		switch {
+		case readErr == io.EOF:
+			sc.logger.Print("client closed connection.")
+			return
+		case s.shuttingDown():
+			sc.logger.Print("server shutting down...closing connection.")
+			return
+		case isTimeout(readErr):
+			sc.logger.Print("client idle timeout...closing connection.")
+			disconnectErr = readErr
+			return
+		case readErr != nil:
+			sc.logger.Printf("read error: %s", readErr.Error())
+			disconnectErr = readErr
+			return
+		}
+
+		if cmd == "client.quit" {
+			sc.logger.Print("client.quit msg received...")
+			return
+		}
+
+		s.setIdle(sc, false)
+
+		// The command's arguments get the same allowance as the command
+		// itself. Replies aren't bounded since a handler may take a while to
+		// produce one; transfers extend the deadlines chunk by chunk instead.
+		s.extendDeadline(sc)
+		conn.SetWriteDeadline(time.Time{})
+
+		switch {
+		case cmd == "client.protocol.v2":
+			// Acknowledged in the current protocol, then both sides switch.
+			sc.proto.writeFrame("server.protocol.v2")
+			sc.proto.flush()
+			sc.proto.version = ProtocolFramed
+			continue
+		case cmd == "client.auth":
+			if !s.handleClientAuth(sc) {
+				disconnectErr = ErrUnauthorized
+				return
+			}
+			continue
+		case cmd != "client.ping" && s.authRequired() && sc.user == nil:
+			s.audit(sc, cmd, "", ErrCodeUnauthorized)
+			replyError(sc.proto, ErrCodeUnauthorized, "authentication required")
+
+			// A framed command carries its arguments with it; a legacy
+			// command's arguments can't be skipped without knowing the
+			// command, so the connection is dropped.
+			if sc.proto.framed() {
+				continue
+			}
+
+			sc.logger.Printf("client sent '%s' before authenticating...closing connection.", cmd)
+			disconnectErr = ErrUnauthorized
+			return
+		}
+
+		s.onHandleCommand(sc, cmd)
+
+		// A failed write leaves the client out of step with the protocol.
+		if flushErr := sc.proto.flush(); flushErr != nil {
+			sc.logger.Printf("server write error: %s", flushErr.Error())
+			disconnectErr = flushErr
+			return
+		}
+	}
+}
+
+// Shutdown stops the server gracefully: listeners are closed, connections
+// waiting for a command are closed, and connections in the middle of a
+// command are closed as soon as it finishes. If ctx ends first the remaining
+// connections are closed forcefully.
+// It returns ctx's error if it ended before every connection finished.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.close(false)
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		s.closeAuditLog()
+		return nil
+	case <-ctx.Done():
+		s.close(true)
+
+		// The handlers still running audit how their command ended, so the
+		// log stays open until they are gone.
+		go func() {
+			<-finished
+			s.closeAuditLog()
+		}()
+
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately, closing every listener and connection,
+// and waits for the command handlers still running to return.
+func (s *Server) Close() error {
+	s.close(true)
+	s.wg.Wait()
+	return s.closeAuditLog()
+}
+
+// closeAuditLog closes the AuditLogFile if NewServer opened it.
+func (s *Server) closeAuditLog() error {
+	s.mtxAudit.Lock()
+	defer s.mtxAudit.Unlock()
+
+	if s.auditFile == nil {
+		return nil
+	}
+
+	closeErr := s.auditFile.Close()
+	s.auditFile = nil
+
+	return closeErr
+}
+
+// close marks the server closed and closes its listeners along with either
+// every connection or only the idle ones.
+func (s *Server) close(all bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	for sc := range s.conns {
+		if all {
+			sc.cancel()
+		}
+		if all || sc.idle {
+			sc.conn.Close()
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closed
+}
+
+// setIdle records whether sc is waiting for a command.
+// It returns false if the server is shutting down.
+func (s *Server) setIdle(sc *serverConn, idle bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sc.idle = idle
+	return !s.closed
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !add {
+		delete(s.conns, sc)
+		s.wg.Done()
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[sc] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// acceptBackoff returns how long to wait before accepting again after a
+// temporary error, doubling the previous delay up to a second.
+func acceptBackoff(previous time.Duration) time.Duration {
+	const maxDelay = time.Second
+
+	if previous == 0 {
+		return 5 * time.Millisecond
+	}
+
+	if previous *= 2; previous > maxDelay {
+		return maxDelay
+	}
+
+	return previous
+}
+
+// isTemporary reports whether an Accept error is expected to pass, such as
+// the process running out of file descriptors.
+func isTemporary(err error) bool {
+	var tempErr interface{ Temporary() bool }
+	return errors.As(err, &tempErr) && tempErr.Temporary()
+}
+
+// release frees a MaxConnections slot.
+func (s *Server) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// extendDeadline gives the connection another IdleTimeout to read or write,
+// so a transfer may take as long as it needs while a client that stalls in
+// the middle of one is still dropped.
+func (s *Server) extendDeadline(sc *serverConn) {
+	if s.config.IdleTimeout > 0 {
+		sc.conn.SetDeadline(time.Now().Add(s.config.IdleTimeout))
+	}
+}
+
+// setKeepAlive enables TCP keepalives on conn, looking through TLS, when it
+// is a TCP connection.
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok && s.config.KeepAlivePeriod > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(s.config.KeepAlivePeriod)
+	}
+}
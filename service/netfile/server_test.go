@@ -0,0 +1,245 @@
+package netfile_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+// testConfig returns the default ServerConfig serving files from root, with
+// temp files in a sibling temp dir.
+func testConfig(t *testing.T, root string) netfile.ServerConfig {
+	var config netfile.ServerConfig
+	config.Init()
+	config.FilesDir = root
+	config.TempDir = filepath.Join(t.TempDir(), "temp")
+
+	return config
+}
+
+// newServer builds a Server from config, which is shut down when the test
+// ends.
+func newServer(t *testing.T, config netfile.ServerConfig) *netfile.Server {
+	t.Helper()
+
+	server, err := netfile.NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer() error: %s", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+
+	return server
+}
+
+// listen returns a loopback listener that is closed when the test ends.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// serve serves server on a loopback listener.
+// It returns the address to dial.
+func serve(t *testing.T, server *netfile.Server) string {
+	t.Helper()
+
+	l := listen(t)
+	go server.Serve(l)
+
+	return l.Addr().String()
+}
+
+// startServer serves a Server built from config on a loopback listener until
+// the test ends.
+// It returns the address to dial.
+func startServer(t *testing.T, config netfile.ServerConfig) string {
+	t.Helper()
+
+	return serve(t, newServer(t, config))
+}
+
+func TestServerShutdown(t *testing.T) {
+	config := testConfig(t, filepath.Join(t.TempDir(), "files"))
+	config.MaxConnections = 1
+
+	server := newServer(t, config)
+
+	if _, err := os.Stat(config.FilesDir); err != nil {
+		t.Fatalf("FilesDir wasn't created: %s", err)
+	}
+
+	l := listen(t)
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Close()
+
+	if err := client.Store(ctx, "a.txt", bytes.NewReader([]byte("a")), 1); err != nil {
+		t.Fatalf("Store() error: %s", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown() error: %s", err)
+	}
+
+	if err := <-served; !errors.Is(err, netfile.ErrServerClosed) {
+		t.Errorf("Serve() error = %v, expected ErrServerClosed", err)
+	}
+
+	if err := client.Ping(ctx); err == nil {
+		t.Errorf("Ping() succeeded after Shutdown, expected the idle connection to be closed")
+	}
+
+	if _, err := netfile.Dial(ctx, "tcp", l.Addr().String(), nil); err == nil {
+		t.Errorf("Dial() succeeded after Shutdown")
+	}
+}
+
+func TestTransferDeadlines(t *testing.T) {
+	root := t.TempDir()
+
+	config := testConfig(t, root)
+	config.BufferSize = 2
+	config.IdleTimeout = 300 * time.Millisecond
+
+	disconnected := make(chan error, 1)
+	config.OnDisconnect = func(addr net.Addr, err error) { disconnected <- err }
+
+	conn, err := net.Dial("tcp", startServer(t, config))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// expect reads the next line and checks it is want.
+	expect := func(want string) {
+		t.Helper()
+
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimSuffix(line, "\n") != want {
+			t.Fatalf("read %q, %v, expected %q", line, err, want)
+		}
+	}
+
+	expect("server.ready")
+
+	// An upload taking longer than IdleTimeout is fine as long as every chunk
+	// arrives in time.
+	data := "0123456789"
+	conn.Write([]byte("client.store\nslow.txt\n10\n"))
+	expect("server.store.ready")
+
+	for i := range data {
+		conn.Write([]byte{data[i]})
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	conn.Write([]byte("84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882\n"))
+	expect("server.store.ok")
+
+	// An upload that stalls part way is dropped.
+	conn.Write([]byte("client.store\nstalled.txt\n10\n01"))
+	expect("server.store.ready")
+
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Errorf("stalled upload disconnected without an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stalled upload wasn't dropped")
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "stalled.txt")); !os.IsNotExist(err) {
+		t.Errorf("stalled upload was committed")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for the server's goroutines to log to
+// while the test reads it.
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestServerLogger(t *testing.T) {
+	var logs lockedBuffer
+
+	config := testConfig(t, filepath.Join(t.TempDir(), "files"))
+	config.Logger = log.New(&logs, "test ", 0)
+
+	conn, err := net.Dial("tcp", startServer(t, config))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	if msg, err := netfile.ReadMsg(conn); err != nil || msg != "server.ready" {
+		t.Fatalf("ReadMsg() = %q, %v, expected \"server.ready\"", msg, err)
+	}
+	conn.Write([]byte("client.quit\n"))
+
+	local := conn.LocalAddr().String()
+
+	want := []string{
+		"test Creating '" + config.FilesDir + "'...",
+		"test " + local + " Client connected from: 'tcp:" + local + "'",
+		"test " + local + " client.quit msg received...",
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), want[len(want)-1]) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range want {
+		if !strings.Contains(logs.String(), line+"\n") {
+			t.Errorf("server log is missing %q:\n%s", line, logs.String())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+package netfile_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownKeepsAuditLogForHandlers(t *testing.T) {
+	root := t.TempDir()
+
+	// Opening a fifo blocks until it has a writer, which closing the
+	// connection doesn't interrupt.
+	fifo := filepath.Join(root, "slow")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skipf("mkfifo error: %s", err)
+	}
+
+	config := testConfig(t, root)
+	config.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+
+	server := newServer(t, config)
+
+	conn, err := net.Dial("tcp", serve(t, server))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("client.fetch\nslow\n"))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() error = %v, expected context.DeadlineExceeded", err)
+	}
+
+	// Let the fetch carry on now that Shutdown gave up waiting for it.
+	w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("opening the fifo error: %s", err)
+	}
+	w.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		data, _ := os.ReadFile(config.AuditLogFile)
+		if bytes.Contains(data, []byte(`"Command":"client.fetch"`)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the fetch outliving Shutdown wasn't audited, log: %q", data)
+		}
+	}
+}
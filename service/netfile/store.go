@@ -0,0 +1,288 @@
+package netfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// OverwritePolicy decides what client.store does when the named file already
+// exists in the server's FilesDir.
+type OverwritePolicy int
+
+const (
+	// OverwriteReject refuses the upload, leaving the existing file alone.
+	OverwriteReject OverwritePolicy = iota
+	// OverwriteReplace atomically replaces the existing file.
+	OverwriteReplace
+)
+
+// ErrRejected is wrapped by the errors Client.Store returns when the server
+// refuses an upload or fails to commit it. The server's reason follows it in
+// the error text.
+var ErrRejected = errors.New("netfile: store rejected")
+
+// handleClientStore implements client.store:
+//
+//	client -> client.store, <name>, <size>
+//	server -> server.store.ready | server.store.rejected, <reason>
+//	client -> <size bytes>, <sha256 hex>
+//	server -> server.store.ok | server.store.failed, <reason>
+//
+// The data is written to a temp file in TempDir and only renamed into
+// FilesDir once its size and checksum match, so readers never see a partial
+// file. Names may include sub directories, which are created as needed.
+func (s *Server) handleClientStore(sc *serverConn) {
+	p := sc.proto
+
+	args, readErr := p.readArgs(2)
+	if readErr != nil {
+		return
+	}
+
+	name, sizeLine := args[0], args[1]
+
+	var reply = func(name string, args ...string) {
+		p.writeFrame(name, args...)
+		p.flush()
+	}
+
+	size, parseErr := strconv.ParseInt(sizeLine, 10, 64)
+	switch {
+	case !s.allow(sc, PermWrite, "client.store", name):
+		reply("server.store.rejected", "permission denied")
+		return
+	case parseErr != nil || size < 0:
+		reply("server.store.rejected", "malformed size")
+		return
+	case s.config.MaxUploadSize > 0 && size > s.config.MaxUploadSize:
+		reply("server.store.rejected", fmt.Sprintf("file exceeds maximum upload size of %d bytes", s.config.MaxUploadSize))
+		return
+	}
+
+	dest, resolveErr := sc.files.Resolve(name)
+	if resolveErr != nil {
+		reply("server.store.rejected", "invalid file name")
+		return
+	}
+
+	if s.config.Overwrite == OverwriteReject {
+		if _, statErr := os.Stat(dest); statErr == nil {
+			reply("server.store.rejected", "file exists")
+			return
+		}
+	}
+
+	temp, tempErr := os.CreateTemp(s.config.TempDir, "store-*")
+	if tempErr != nil {
+		sc.logger.Printf("netfile.handleClientStore() temp file error: %s", tempErr.Error())
+		reply("server.store.rejected", "server storage unavailable")
+		return
+	}
+	tempName := temp.Name()
+	// Harmless once the temp file has been renamed into place.
+	defer os.Remove(tempName)
+
+	reply("server.store.ready")
+
+	sum := sha256.New()
+	n, copyErr := s.receive(sc, io.MultiWriter(temp, sum), size)
+	closeErr := temp.Close()
+
+	if copyErr != nil || n != size {
+		// The stream is out of step with the protocol; the connection can't
+		// be trusted for another command, so drop it rather than parse the
+		// rest of the upload as commands.
+		sc.logger.Printf("netfile.handleClientStore() upload of '%s' interrupted after %d of %d bytes", name, n, size)
+		sc.conn.Close()
+		return
+	}
+
+	trailer, readErr := p.readArgs(1)
+	if readErr != nil {
+		return
+	}
+
+	checksum := trailer[0]
+
+	switch {
+	case closeErr != nil:
+		reply("server.store.failed", "write error")
+		return
+	case checksum != hex.EncodeToString(sum.Sum(nil)):
+		reply("server.store.failed", "checksum mismatch")
+		return
+	}
+
+	if commitErr := commitUpload(tempName, dest, s.config.Overwrite); commitErr != nil {
+		sc.logger.Printf("netfile.handleClientStore() commit error: %s", commitErr.Error())
+		if os.IsExist(commitErr) {
+			reply("server.store.failed", "file exists")
+		} else {
+			reply("server.store.failed", "commit error")
+		}
+		return
+	}
+
+	// The digest is already known so the first fetch doesn't have to read the
+	// file again to send it.
+	if info, statErr := os.Stat(dest); statErr == nil {
+		s.checksums.put(dest, info, checksum)
+	}
+
+	sc.logger.Printf("Stored: '%s' (%d bytes)", name, size)
+	s.audit(sc, "client.store", name, "ok")
+	reply("server.store.ok")
+}
+
+// receive copies size bytes of an upload from sc to w in BufferSize chunks,
+// giving each chunk the idle timeout to arrive.
+// It returns the number of bytes copied and the error that stopped it short.
+func (s *Server) receive(sc *serverConn, w io.Writer, size int64) (int64, error) {
+	data := make([]byte, s.config.BufferSize)
+	var received int64
+
+	for received < size {
+		chunk := int64(len(data))
+		if remaining := size - received; remaining < chunk {
+			chunk = remaining
+		}
+
+		s.extendDeadline(sc)
+		n, readErr := io.ReadFull(sc.proto.rw, data[:chunk])
+
+		if _, writeErr := w.Write(data[:n]); writeErr != nil {
+			return received, writeErr
+		}
+		received += int64(n)
+
+		if readErr != nil {
+			return received, readErr
+		}
+	}
+
+	return received, nil
+}
+
+// commitUpload moves the finished upload into place according to the
+// overwrite policy. Without overwrite a hard link is used so an existing
+// file is never clobbered, even by a concurrent upload of the same name.
+func commitUpload(tempName, dest string, overwrite OverwritePolicy) error {
+	if mkdirErr := os.MkdirAll(filepath.Dir(dest), os.ModePerm); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	if overwrite == OverwriteReplace {
+		return os.Rename(tempName, dest)
+	}
+
+	if linkErr := os.Link(tempName, dest); linkErr != nil {
+		return linkErr
+	}
+
+	return os.Remove(tempName)
+}
+
+// Store uploads size bytes read from r to the server under name using
+// client.store. The data is checksummed as it streams and the server only
+// commits the file once the checksum matches.
+// It returns an error wrapping ErrRejected if the server refused or failed
+// the upload, or the error that interrupted the transfer.
+func (c *Client) Store(ctx context.Context, name string, r io.Reader, size int64) error {
+	return c.do(ctx, func() error {
+		if err := c.send("client.store", name, strconv.FormatInt(size, 10)); err != nil {
+			return err
+		}
+
+		reply, err := c.proto.readName()
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.store.ready":
+		case "server.store.rejected":
+			return c.readRejection()
+		default:
+			return unexpectedReply("server.store.ready", reply)
+		}
+
+		sum := sha256.New()
+		if err := c.upload(io.TeeReader(r, sum), size); err != nil {
+			// The server is still waiting for the rest of the bytes.
+			c.conn.Close()
+			return err
+		}
+
+		if err := c.send("", hex.EncodeToString(sum.Sum(nil))); err != nil {
+			return err
+		}
+
+		reply, err = c.proto.readName()
+		if err != nil {
+			return err
+		}
+
+		switch reply {
+		case "server.store.ok":
+			return nil
+		case "server.store.failed":
+			return c.readRejection()
+		default:
+			return unexpectedReply("server.store.ok", reply)
+		}
+	})
+}
+
+// readRejection reads the reason that follows a rejected or failed reply.
+func (c *Client) readRejection() error {
+	args, err := c.proto.readArgs(1)
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", ErrRejected, args[0])
+}
+
+// upload writes exactly size bytes from r to the server in BufferSize chunks,
+// reporting progress after each one.
+func (c *Client) upload(r io.Reader, size int64) error {
+	data := make([]byte, BufferSize)
+	var sent int64
+
+	if c.OnProgress != nil {
+		c.OnProgress(0, size)
+	}
+
+	for sent < size {
+		chunk := int64(len(data))
+		if remaining := size - sent; remaining < chunk {
+			chunk = remaining
+		}
+
+		n, readErr := io.ReadFull(r, data[:chunk])
+
+		if n > 0 {
+			if _, err := c.proto.rw.Write(data[:n]); err != nil {
+				return fmt.Errorf("netfile.Client write error: %w", err)
+			}
+			sent += int64(n)
+
+			if c.OnProgress != nil {
+				c.OnProgress(sent, size)
+			}
+		}
+
+		if readErr != nil {
+			return fmt.Errorf("netfile.Client source ended after %d of %d bytes: %w", sent, size, readErr)
+		}
+	}
+
+	return c.proto.flush()
+}
@@ -0,0 +1,161 @@
+package netfile_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+// storeConfig returns a ServerConfig serving root with overwrite and
+// maxUploadSize.
+func storeConfig(t *testing.T, root string, overwrite netfile.OverwritePolicy, maxUploadSize int64) netfile.ServerConfig {
+	config := testConfig(t, root)
+	config.Overwrite = overwrite
+	config.MaxUploadSize = maxUploadSize
+
+	return config
+}
+
+func TestStoreLimitsAndOverwrite(t *testing.T) {
+	root := t.TempDir()
+	addr := startServer(t, storeConfig(t, root, netfile.OverwriteReject, 10))
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	big := strings.Repeat("x", 11)
+	if err := client.Store(ctx, "big.txt", strings.NewReader(big), int64(len(big))); !errors.Is(err, netfile.ErrRejected) {
+		t.Errorf("Store() over MaxUploadSize error = %v, expected ErrRejected", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "big.txt")); !os.IsNotExist(err) {
+		t.Errorf("Store() over MaxUploadSize created the file")
+	}
+
+	if err := client.Store(ctx, "a.txt", strings.NewReader("first"), 5); err != nil {
+		t.Fatalf("Store() error: %s", err)
+	}
+
+	if err := client.Store(ctx, "a.txt", strings.NewReader("second"), 6); !errors.Is(err, netfile.ErrRejected) {
+		t.Errorf("Store() over an existing file with OverwriteReject error = %v, expected ErrRejected", err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "first" {
+		t.Errorf("OverwriteReject left %q, expected \"first\"", data)
+	}
+
+	root = t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("first"), 0644)
+
+	client, err = netfile.Dial(ctx, "tcp", startServer(t, storeConfig(t, root, netfile.OverwriteReplace, 0)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	if err := client.Store(ctx, "a.txt", strings.NewReader("second"), 6); err != nil {
+		t.Fatalf("Store() over an existing file with OverwriteReplace error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.Fetch(ctx, "a.txt", &buf); err != nil || buf.String() != "second" {
+		t.Errorf("Fetch() after OverwriteReplace = %q, %v, expected \"second\"", buf.String(), err)
+	}
+}
+
+func TestStoreChecksumMismatch(t *testing.T) {
+	root := t.TempDir()
+
+	conn, err := net.Dial("tcp", startServer(t, testConfig(t, root)))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// expect reads the next line and checks it is want.
+	expect := func(want string) {
+		t.Helper()
+
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimSuffix(line, "\n") != want {
+			t.Fatalf("read %q, %v, expected %q", line, err, want)
+		}
+	}
+
+	expect("server.ready")
+
+	conn.Write([]byte("client.store\na.txt\n3\n"))
+	expect("server.store.ready")
+
+	conn.Write([]byte("abc" + strings.Repeat("0", 64) + "\n"))
+	expect("server.store.failed")
+	expect("checksum mismatch")
+
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("an upload with a bad checksum was committed")
+	}
+
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("files left behind: %v", entries)
+	}
+
+	conn.Write([]byte("client.ping\n"))
+	expect("server.pong")
+}
+
+func TestStoreInterruptedUpload(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "victim.txt"), []byte("keep"), 0644)
+
+	config := storeConfig(t, root, netfile.OverwriteReject, 0)
+	config.IdleTimeout = 200 * time.Millisecond
+
+	conn, err := net.Dial("tcp", startServer(t, config))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if line, _ := r.ReadString('\n'); line != "server.ready\n" {
+		t.Fatalf("read %q, expected \"server.ready\"", line)
+	}
+
+	// The rest of the upload, arriving after the server gave up on it, must
+	// not be run as commands.
+	rest := "client.delete\nvictim.txt\n"
+	conn.Write([]byte(fmt.Sprintf("client.store\na.txt\n%d\nabc", 3+len(rest))))
+
+	if line, _ := r.ReadString('\n'); line != "server.store.ready\n" {
+		t.Fatalf("read %q, expected \"server.store.ready\"", line)
+	}
+
+	time.Sleep(2 * config.IdleTimeout)
+	conn.Write([]byte(rest))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if unread, err := io.ReadAll(r); err != nil || len(unread) != 0 {
+		t.Errorf("read %q, %v after an interrupted upload, expected the connection closed", unread, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "victim.txt")); err != nil {
+		t.Errorf("the rest of an interrupted upload was run as a command: %s", err)
+	}
+}
@@ -0,0 +1,214 @@
+package netfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncOptions controls Client.Sync.
+type SyncOptions struct {
+	// Prefix limits the sync to remote files whose names start with it. With
+	// Delete, only local files matching it are candidates for removal.
+	Prefix string
+	// Delete removes local files that aren't on the server.
+	Delete bool
+	// DryRun reports what would be downloaded and deleted without touching
+	// the local directory.
+	DryRun bool
+}
+
+// SyncSummary reports what Client.Sync did. Names are relative to the synced
+// directory and use forward slashes.
+type SyncSummary struct {
+	// Downloaded lists the files that were missing or differed locally.
+	Downloaded []string
+	// Bytes is the total size of the downloaded files.
+	Bytes int64
+	// Unchanged counts files that already matched the server.
+	Unchanged int
+	// Deleted lists the local files removed because the server doesn't have
+	// them.
+	Deleted []string
+	// Failed holds the error for every file that couldn't be synced.
+	Failed map[string]error
+}
+
+// String summarizes the sync on one line.
+func (s *SyncSummary) String() string {
+	return fmt.Sprintf("%d downloaded (%d bytes), %d unchanged, %d deleted, %d failed",
+		len(s.Downloaded), s.Bytes, s.Unchanged, len(s.Deleted), len(s.Failed))
+}
+
+// Sync mirrors the server's files into the local directory dir, creating it
+// if needed. The remote listing, with checksums, is compared against the
+// local files and only those that are missing or whose size or sha256
+// differ are downloaded, each with Download so it is verified and an
+// interrupted sync resumes where it stopped. Names the server sends are
+// resolved inside dir so a listing can't write outside of it.
+// It returns the summary, along with an error joining every failure when
+// there were any, or a nil summary if the server couldn't be listed.
+func (c *Client) Sync(ctx context.Context, dir string, opts SyncOptions) (*SyncSummary, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("netfile.Client sync error: %w", err)
+	}
+
+	local, err := NewSandbox(dir)
+	if err != nil {
+		return nil, fmt.Errorf("netfile.Client sync error: %w", err)
+	}
+
+	remote, err := c.ListAllChecksums(ctx, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &SyncSummary{Failed: make(map[string]error)}
+	wanted := make(map[string]bool)
+
+	for _, file := range remote {
+		wanted[file.Name] = true
+
+		path, err := local.Resolve(file.Name)
+		if err != nil {
+			summary.Failed[file.Name] = err
+			continue
+		}
+
+		same, err := sameFile(path, &file)
+		if err != nil {
+			summary.Failed[file.Name] = err
+			continue
+		}
+
+		if same {
+			summary.Unchanged++
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				summary.Failed[file.Name] = err
+				continue
+			}
+
+			if err := c.Download(ctx, file.Name, path); err != nil {
+				summary.Failed[file.Name] = err
+
+				// A dead connection fails every file after it the same way,
+				// so stop at the first one rather than listing them all.
+				if ctx.Err() != nil || connectionLost(err) {
+					break
+				}
+				continue
+			}
+		}
+
+		summary.Downloaded = append(summary.Downloaded, file.Name)
+		summary.Bytes += file.Size
+	}
+
+	var errs []error
+
+	if opts.Delete && ctx.Err() == nil {
+		extra, err := extraFiles(local, opts.Prefix, wanted)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing '%s': %w", dir, err))
+		}
+
+		for _, name := range extra {
+			if !opts.DryRun {
+				path := filepath.Join(local.Root(), filepath.FromSlash(name))
+				if err := os.Remove(path); err != nil {
+					summary.Failed[name] = err
+					continue
+				}
+			}
+
+			summary.Deleted = append(summary.Deleted, name)
+		}
+	}
+
+	names := make([]string, 0, len(summary.Failed))
+	for name := range summary.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		errs = append(errs, fmt.Errorf("'%s': %w", name, summary.Failed[name]))
+	}
+
+	if len(errs) > 0 {
+		return summary, fmt.Errorf("netfile.Client sync incomplete: %w", errors.Join(errs...))
+	}
+
+	return summary, nil
+}
+
+// connectionLost reports whether err came from the connection to the server
+// rather than from the one file, such as the server hanging up or a read
+// timing out.
+func connectionLost(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+// sameFile reports whether the local file at path has the size and sha256
+// of the remote file. Hashing is skipped when the sizes differ.
+func sameFile(path string, remote *FileInfo) (bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !info.Mode().IsRegular() || info.Size() != remote.Size {
+		return false, nil
+	}
+
+	sum, err := fileSha256(path, BufferSize)
+	if err != nil {
+		return false, err
+	}
+
+	return sum == remote.Sha256, nil
+}
+
+// extraFiles returns the regular files in the local sandbox whose names start
+// with prefix and aren't wanted. Partial downloads of wanted files are kept
+// so they can be resumed.
+func extraFiles(local *Sandbox, prefix string, wanted map[string]bool) ([]string, error) {
+	var extra []string
+
+	walkErr := filepath.WalkDir(local.Root(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := local.Rel(path)
+
+		if !strings.HasPrefix(name, prefix) || wanted[name] || wanted[strings.TrimSuffix(name, PartialSuffix)] {
+			return nil
+		}
+
+		extra = append(extra, name)
+		return nil
+	})
+
+	return extra, walkErr
+}
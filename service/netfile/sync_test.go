@@ -0,0 +1,144 @@
+package netfile_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+)
+
+func TestSync(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "c.txt"), []byte("c"), 0644)
+
+	ctx := context.Background()
+	client, err := netfile.Dial(ctx, "tcp", startServer(t, testConfig(t, root)), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	dir := filepath.Join(t.TempDir(), "mirror")
+
+	summary, err := client.Sync(ctx, dir, netfile.SyncOptions{})
+	if err != nil {
+		t.Fatalf("Sync() error: %s", err)
+	}
+	if want := []string{"a.txt", "b.txt", "sub/c.txt"}; !reflect.DeepEqual(summary.Downloaded, want) || summary.Bytes != 3 {
+		t.Errorf("first Sync() downloaded %v (%d bytes), expected %v", summary.Downloaded, summary.Bytes, want)
+	}
+
+	// Change one file on each side, add one remotely and one locally.
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("A"), 0644)
+	os.WriteFile(filepath.Join(root, "d.txt"), []byte("d"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("local edit"), 0644)
+	os.WriteFile(filepath.Join(dir, "extra.txt"), []byte("extra"), 0644)
+
+	summary, err = client.Sync(ctx, dir, netfile.SyncOptions{Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("Sync() error: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "extra.txt")); err != nil || len(summary.Deleted) != 1 {
+		t.Errorf("dry run Sync() = %s, and touched the directory: %v", summary, err)
+	}
+
+	summary, err = client.Sync(ctx, dir, netfile.SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatalf("Sync() error: %s", err)
+	}
+
+	if want := []string{"a.txt", "b.txt", "d.txt"}; !reflect.DeepEqual(summary.Downloaded, want) {
+		t.Errorf("Sync() downloaded %v, expected %v", summary.Downloaded, want)
+	}
+	if want := []string{"extra.txt"}; !reflect.DeepEqual(summary.Deleted, want) {
+		t.Errorf("Sync() deleted %v, expected %v", summary.Deleted, want)
+	}
+	if summary.Unchanged != 1 {
+		t.Errorf("Sync() left %d files unchanged, expected 1", summary.Unchanged)
+	}
+
+	for name, want := range map[string]string{"a.txt": "A", "b.txt": "b", "d.txt": "d", "sub/c.txt": "c"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); string(got) != want {
+			t.Errorf("%s = %q after Sync(), expected %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "extra.txt")); !os.IsNotExist(err) {
+		t.Errorf("extra.txt survived Sync() with Delete")
+	}
+
+	summary, err = client.Sync(ctx, dir, netfile.SyncOptions{Delete: true})
+	if err != nil || len(summary.Downloaded) != 0 || len(summary.Deleted) != 0 || summary.Unchanged != 4 {
+		t.Errorf("Sync() of a mirrored directory = %s, %v, expected everything unchanged", summary, err)
+	}
+}
+
+// cuttingProxy forwards connections to addr and hangs up on the client once
+// after bytes have been sent to it.
+func cuttingProxy(t *testing.T, addr string, after int64) string {
+	t.Helper()
+
+	l := listen(t)
+
+	go func() {
+		client, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		server, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer server.Close()
+
+		go io.Copy(server, client)
+		io.CopyN(client, server, after)
+	}()
+
+	return l.Addr().String()
+}
+
+func TestSyncStopsOnLostConnection(t *testing.T) {
+	root := t.TempDir()
+
+	// The first file is large enough that the connection is cut during its
+	// download, well after the listing.
+	os.WriteFile(filepath.Join(root, "a.bin"), make([]byte, 4<<20), 0644)
+	for _, name := range []string{"b.txt", "c.txt", "d.txt"} {
+		os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := netfile.Dial(ctx, "tcp", cuttingProxy(t, startServer(t, testConfig(t, root)), 1<<20), nil)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	defer client.Quit()
+
+	summary, err := client.Sync(ctx, t.TempDir(), netfile.SyncOptions{})
+	if err == nil {
+		t.Fatalf("Sync() over a cut connection succeeded")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Sync() ran until the deadline: %s", err)
+	}
+
+	if _, ok := summary.Failed["a.bin"]; !ok || len(summary.Failed) != 1 {
+		t.Errorf("Sync() failed %v, expected only a.bin", summary.Failed)
+	}
+	if len(summary.Downloaded) != 0 {
+		t.Errorf("Sync() downloaded %v over a cut connection", summary.Downloaded)
+	}
+}
@@ -0,0 +1,113 @@
+package netfile_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/netfile"
+	"github.com/steviesama/nx/service/socket"
+)
+
+// selfSigned creates a certificate for 127.0.0.1 and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key error: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netfile"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate error: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("certificate error: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestServerTLSHandshakeTimeout(t *testing.T) {
+	cert, pool := selfSigned(t)
+
+	config := testConfig(t, filepath.Join(t.TempDir(), "files"))
+	config.HandshakeTimeout = 100 * time.Millisecond
+
+	disconnected := make(chan error, 2)
+	config.OnDisconnect = func(addr net.Addr, err error) { disconnected <- err }
+
+	server := newServer(t, config)
+
+	l, err := socket.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen() error: %s", err)
+	}
+	go server.Serve(l)
+
+	ctx := context.Background()
+
+	client, err := netfile.Dial(ctx, "tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Dial() over TLS error: %s", err)
+	}
+
+	if err := client.Ping(ctx); err != nil {
+		t.Errorf("Ping() over TLS error: %s", err)
+	}
+	client.Close()
+
+	if err := <-disconnected; err != nil {
+		t.Errorf("TLS client disconnected with %v, expected nil", err)
+	}
+
+	// A peer that never starts the handshake is dropped once it times out.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Errorf("stalled handshake disconnected without an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stalled handshake wasn't dropped")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("read from a dropped connection error = %v, expected it closed", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
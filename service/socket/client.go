@@ -1 +1,303 @@
 package socket
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/steviesama/nx/service/socket/heartbeat"
+	"github.com/steviesama/nx/service/socket/hub"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// MethodHandlerFunc handles a request another peer sent to this client. The
+// returned payload is sent back as a TypeResponse; a returned error is sent
+// back as a TypeError frame, keeping its code if it is a *message.Error.
+type MethodHandlerFunc func(ctx context.Context, from string, payload []byte) ([]byte, error)
+
+// Config holds the settings a Client is created with.
+type Config struct {
+	// Network is "tcp" or "unix". Empty means "tcp".
+	Network string
+	// TLSConfig, if set, makes Dial complete a TLS handshake. Set its
+	// Certificates or GetClientCertificate to authenticate with a client
+	// certificate; nx/crypto.ClientTLSConfig builds one that reloads from disk.
+	TLSConfig *tls.Config
+	// Heartbeat configures keepalive pings, the read deadline and the idle
+	// timeout for the connection.
+	Heartbeat heartbeat.Config
+	// OnDisconnect, if set, is called once the connection is gone. err is nil
+	// for a clean close, heartbeat.ErrTimeout or heartbeat.ErrIdle when the
+	// heartbeat dropped the connection, or the read error otherwise.
+	OnDisconnect func(err error)
+}
+
+// DefaultConfig is a Config with heartbeat.DefaultConfig keepalives.
+var DefaultConfig = Config{Heartbeat: heartbeat.DefaultConfig}
+
+// Client is the dialing side of a hub connection. It runs its own message
+// pump which resolves replies to Call and dispatches incoming requests to the
+// methods registered with HandleMethod.
+type Client struct {
+	// OnMessage, if set, receives fire-and-forget messages sent to this client.
+	OnMessage func(m *message.Message)
+
+	conn    net.Conn
+	config  Config
+	monitor *heartbeat.Monitor
+
+	// A mutex to serialize frame writes to conn.
+	mtxWrite sync.Mutex
+
+	methods    map[string]MethodHandlerFunc
+	mtxMethods sync.RWMutex
+
+	pending *message.Pending
+
+	// ready is closed once the server has told the client its id.
+	ready chan struct{}
+	id    string
+
+	// done is closed when the message pump exits.
+	done chan struct{}
+	err  error
+
+	// closing is set by Close so the pump reports a clean disconnect.
+	closing int32
+}
+
+// Dial connects to the hub server listening on addr using config. For a unix
+// Network addr is the socket's path.
+// It returns once the server has assigned the client its id, or an error if
+// the connection couldn't be made.
+func Dial(ctx context.Context, addr string, config Config) (*Client, error) {
+	network := config.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	conn, err := DialConn(ctx, network, addr, config.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(conn, config)
+
+	select {
+	case <-c.ready:
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("socket.Dial() handshake error: %v", c.err)
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// NewClient wraps an established connection to a hub server and starts its
+// message pump and heartbeat.
+func NewClient(conn net.Conn, config Config) *Client {
+	c := &Client{
+		conn:    conn,
+		config:  config,
+		methods: make(map[string]MethodHandlerFunc),
+		pending: message.NewPending(),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	c.monitor = heartbeat.NewMonitor(conn, config.Heartbeat, func() error {
+		return c.Send(&message.Message{Type: message.TypePing})
+	})
+	c.monitor.Start()
+
+	go c.pump()
+
+	return c
+}
+
+// Id returns the id the server assigned to the client. It is empty until the
+// server's welcome message has been received.
+func (c *Client) Id() string {
+	select {
+	case <-c.ready:
+		return c.id
+	default:
+		return ""
+	}
+}
+
+// Done returns a channel that is closed once the connection is gone.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the message pump exited, or nil if it exited on a
+// clean disconnect or is still running. See Config.OnDisconnect.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// HandleMethod registers handler to answer requests for method sent to this
+// client by other peers.
+// HandleMethod is thread safe.
+func (c *Client) HandleMethod(method string, handler MethodHandlerFunc) {
+	c.mtxMethods.Lock()
+	c.methods[method] = handler
+	c.mtxMethods.Unlock()
+}
+
+// Send writes m to the server, which routes it according to m.To.
+// It is safe for concurrent use.
+func (c *Client) Send(m *message.Message) error {
+	c.mtxWrite.Lock()
+	defer c.mtxWrite.Unlock()
+
+	if err := m.SendMessage(c.conn); err != nil {
+		return err
+	}
+
+	// A client that only publishes isn't idle.
+	if m.Type != message.TypePing && m.Type != message.TypePong {
+		c.monitor.Touch()
+	}
+
+	return nil
+}
+
+// Call sends a request for method to the peer identified by to and waits for
+// its reply, bounded by ctx. An empty to addresses the server itself.
+// It returns the reply payload or the error the peer replied with.
+func (c *Client) Call(ctx context.Context, to string, method string, payload []byte) ([]byte, error) {
+	req := message.NewRequest(to, method, payload)
+	ch := c.pending.Add(ctx, req)
+
+	if err := c.Send(req); err != nil {
+		c.pending.Resolve(message.NewErrorResponse(req, err))
+	}
+
+	return c.pending.Wait(ctx, req, ch)
+}
+
+// Close disconnects from the server. Calls still waiting for a reply fail
+// with message.ErrClosed.
+func (c *Client) Close() error {
+	atomic.StoreInt32(&c.closing, 1)
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+func (c *Client) pump() {
+	defer func() {
+		c.monitor.Stop()
+		c.conn.Close()
+		c.pending.Close()
+		close(c.done)
+
+		if c.config.OnDisconnect != nil {
+			c.config.OnDisconnect(c.err)
+		}
+	}()
+
+	for {
+		m := &message.Message{}
+		err := m.ReceiveMessage(c.conn)
+
+		switch {
+		case err == io.EOF:
+			return
+		case err != nil:
+			if atomic.LoadInt32(&c.closing) == 0 {
+				c.err = c.monitor.Reason(err)
+			}
+			return
+		}
+
+		switch m.Type {
+		case message.TypePing:
+			c.monitor.Received(false)
+			if err := c.Send(&message.Message{Type: message.TypePong}); err != nil {
+				c.err = err
+				return
+			}
+			continue
+		case message.TypePong:
+			c.monitor.Received(false)
+			continue
+		}
+
+		c.monitor.Received(true)
+		c.dispatch(m)
+	}
+}
+
+func (c *Client) dispatch(m *message.Message) {
+	switch m.Type {
+	case message.TypeRequest:
+		go c.handleRequest(m)
+	case message.TypeResponse, message.TypeError:
+		c.pending.Resolve(m)
+	default:
+		if m.Method == hub.MethodWelcome && len(m.From) == 0 {
+			if c.id == "" {
+				c.id = string(m.To)
+				close(c.ready)
+			}
+			return
+		}
+		if c.OnMessage != nil {
+			c.OnMessage(m)
+		}
+	}
+}
+
+func (c *Client) handleRequest(req *message.Message) {
+	// A panicking handler fails its request rather than the whole client.
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Printf("socket.Client.handleRequest() panic in '%s': %v\n", req.Method, p)
+			err := message.NewError(message.ErrCodeInternal, "method '"+req.Method+"' failed")
+			c.reply(message.NewErrorResponse(req, err))
+		}
+	}()
+
+	c.mtxMethods.RLock()
+	handler, ok := c.methods[req.Method]
+	c.mtxMethods.RUnlock()
+
+	var reply *message.Message
+
+	if !ok {
+		err := message.NewError(message.ErrCodeMethodNotFound, "method '"+req.Method+"' is not registered")
+		reply = message.NewErrorResponse(req, err)
+	} else {
+		ctx, cancel := message.ContextFor(context.Background(), req)
+		defer cancel()
+		payload, err := handler(ctx, string(req.From), req.Data)
+
+		if err != nil {
+			reply = message.NewErrorResponse(req, err)
+		} else {
+			reply = message.NewResponse(req, payload)
+		}
+	}
+
+	c.reply(reply)
+}
+
+// reply sends the client's reply to a request.
+func (c *Client) reply(reply *message.Message) {
+	if err := c.Send(reply); err != nil {
+		fmt.Printf("socket.Client.handleRequest() reply error: %s\n", err.Error())
+	}
+}
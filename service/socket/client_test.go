@@ -0,0 +1,134 @@
+package socket_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/socket"
+	"github.com/steviesama/nx/service/socket/hub"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// startHub serves s on a loopback listener that is closed when the test ends.
+// It returns the address to dial.
+func startHub(t *testing.T, s *hub.Server) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	return l.Addr().String()
+}
+
+// dial connects a client to addr with config, closing it when the test ends.
+func dial(t *testing.T, addr string, config socket.Config) *socket.Client {
+	t.Helper()
+
+	c, err := socket.Dial(context.Background(), addr, config)
+	if err != nil {
+		t.Fatalf("Dial() error: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// errCode returns the code of the *message.Error in err, or -1.
+func errCode(err error) int {
+	var msgErr *message.Error
+	if !errors.As(err, &msgErr) {
+		return -1
+	}
+	return msgErr.Code
+}
+
+func TestCall(t *testing.T) {
+	s := hub.NewServer()
+	s.HandleMethod("echo", func(ctx context.Context, c *hub.Client, payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	s.HandleMethod("fail", func(ctx context.Context, c *hub.Client, payload []byte) ([]byte, error) {
+		return nil, message.NewError(42, "failed")
+	})
+	s.HandleMethod("panic", func(ctx context.Context, c *hub.Client, payload []byte) ([]byte, error) {
+		panic("boom")
+	})
+	addr := startHub(t, s)
+
+	a := dial(t, addr, socket.DefaultConfig)
+	b := dial(t, addr, socket.DefaultConfig)
+	b.HandleMethod("hello", func(ctx context.Context, from string, payload []byte) ([]byte, error) {
+		return []byte("hello " + from), nil
+	})
+
+	ctx := context.Background()
+
+	if reply, err := a.Call(ctx, "", "echo", []byte("ping")); err != nil || string(reply) != "ping" {
+		t.Errorf("Call(echo) = %q, %v", reply, err)
+	}
+
+	if _, err := a.Call(ctx, "", "fail", nil); errCode(err) != 42 {
+		t.Errorf("Call(fail) error = %v, expected code 42", err)
+	}
+
+	if _, err := a.Call(ctx, "", "missing", nil); errCode(err) != message.ErrCodeMethodNotFound {
+		t.Errorf("Call(missing) error = %v, expected ErrCodeMethodNotFound", err)
+	}
+
+	if _, err := a.Call(ctx, "", "panic", nil); errCode(err) != message.ErrCodeInternal {
+		t.Errorf("Call(panic) error = %v, expected ErrCodeInternal", err)
+	}
+
+	if reply, err := a.Call(ctx, b.Id(), "hello", nil); err != nil || string(reply) != "hello "+a.Id() {
+		t.Errorf("Call(hello) to a peer = %q, %v", reply, err)
+	}
+
+	if _, err := a.Call(ctx, "nobody", "hello", nil); errCode(err) != message.ErrCodePeerNotFound {
+		t.Errorf("Call() to a missing peer error = %v, expected ErrCodePeerNotFound", err)
+	}
+
+	if reply, err := s.Call(ctx, b.Id(), "hello", nil); err != nil || string(reply) != "hello " {
+		t.Errorf("Server.Call(hello) = %q, %v", reply, err)
+	}
+}
+
+func TestCallTimeoutAndCancel(t *testing.T) {
+	s := hub.NewServer()
+	s.HandleMethod("slow", func(ctx context.Context, c *hub.Client, payload []byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	addr := startHub(t, s)
+
+	c := dial(t, addr, socket.DefaultConfig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Call(ctx, "", "slow", nil); errCode(err) != message.ErrCodeTimeout {
+		t.Errorf("Call() past its deadline error = %v, expected ErrCodeTimeout", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if _, err := c.Call(ctx, "", "slow", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Call() error = %v, expected context.Canceled", err)
+	}
+
+	// The connection is still usable once the calls gave up.
+	s.HandleMethod("fast", func(ctx context.Context, c *hub.Client, payload []byte) ([]byte, error) {
+		return []byte("done"), nil
+	})
+
+	if reply, err := c.Call(context.Background(), "", "fast", nil); err != nil || string(reply) != "done" {
+		t.Errorf("Call() after a timeout = %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,197 @@
+// nx/service/socket/heartbeat keeps socket connections honest. A Monitor sends
+// periodic pings, pushes the connection's read deadline forward whenever a
+// frame arrives and closes connections that have gone silent or idle, so
+// half-open TCP connections don't linger forever.
+package heartbeat
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is the reason reported when the peer stops sending frames,
+// heartbeats included, for longer than Config.Timeout.
+var ErrTimeout = errors.New("heartbeat: peer timed out")
+
+// ErrIdle is the reason reported when no application traffic has been seen
+// for longer than Config.IdleTimeout.
+var ErrIdle = errors.New("heartbeat: connection idle")
+
+// Config holds the keepalive settings for one end of a connection. A zero
+// duration disables the corresponding behavior.
+type Config struct {
+	// Interval is how often a ping is sent to the peer.
+	Interval time.Duration `json:"Interval"`
+	// Timeout is how long to wait for any frame from the peer before
+	// considering it dead. It should be comfortably larger than the peer's
+	// Interval.
+	Timeout time.Duration `json:"Timeout"`
+	// IdleTimeout closes the connection when nothing but heartbeats has been
+	// exchanged for this long. Frames sent count as traffic as much as frames
+	// received, see Monitor.Touch.
+	IdleTimeout time.Duration `json:"IdleTimeout"`
+}
+
+// DefaultConfig pings every 15 seconds and drops peers that have been silent
+// for 45. Idle connections are kept.
+var DefaultConfig = Config{
+	Interval: 15 * time.Second,
+	Timeout:  45 * time.Second,
+}
+
+// Monitor applies a Config to a single connection.
+type Monitor struct {
+	conn   net.Conn
+	config Config
+	ping   func() error
+
+	mtx          sync.Mutex
+	lastActivity time.Time
+	reason       error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewMonitor creates a Monitor for conn. ping is called every
+// config.Interval to send a heartbeat frame to the peer.
+func NewMonitor(conn net.Conn, config Config, ping func() error) *Monitor {
+	return &Monitor{
+		conn:         conn,
+		config:       config,
+		ping:         ping,
+		lastActivity: time.Now(),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start arms the read deadline and starts the ping loop.
+func (m *Monitor) Start() {
+	m.resetDeadline()
+
+	tick := m.tickInterval()
+	if tick <= 0 {
+		return
+	}
+
+	go m.loop(tick)
+}
+
+// Stop ends the ping loop. It is safe to call more than once.
+func (m *Monitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Received records that a frame arrived from the peer. activity should be
+// false for heartbeat frames so they don't count against IdleTimeout.
+func (m *Monitor) Received(activity bool) {
+	m.resetDeadline()
+
+	if activity {
+		m.Touch()
+	}
+}
+
+// Touch records application traffic, such as a frame being sent, without
+// touching the read deadline. Callers should call it after every successful
+// write of a frame other than a heartbeat.
+func (m *Monitor) Touch() {
+	m.mtx.Lock()
+	m.lastActivity = time.Now()
+	m.mtx.Unlock()
+}
+
+// Reason returns why the Monitor closed the connection, or translates err,
+// the error the read loop exited with, into ErrTimeout when it was caused by
+// the read deadline.
+// It returns err untouched otherwise.
+func (m *Monitor) Reason(err error) error {
+	m.mtx.Lock()
+	reason := m.reason
+	m.mtx.Unlock()
+
+	if reason != nil {
+		return reason
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrTimeout
+	}
+
+	return err
+}
+
+func (m *Monitor) resetDeadline() {
+	if m.config.Timeout > 0 {
+		m.conn.SetReadDeadline(time.Now().Add(m.config.Timeout))
+	}
+}
+
+// tickInterval is how often the loop wakes up: the ping interval, or often
+// enough to notice IdleTimeout when pings are disabled.
+func (m *Monitor) tickInterval() time.Duration {
+	tick := m.config.Interval
+	if m.config.IdleTimeout > 0 {
+		idleTick := m.config.IdleTimeout / 4
+		if tick <= 0 || idleTick < tick {
+			tick = idleTick
+		}
+	}
+	return tick
+}
+
+func (m *Monitor) loop(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			if m.idle(now) {
+				m.closeWith(ErrIdle)
+				return
+			}
+
+			// Allow half a tick of slack so ticker jitter doesn't skip pings.
+			if m.config.Interval <= 0 || now.Sub(lastPing)+tick/2 < m.config.Interval {
+				continue
+			}
+			lastPing = now
+
+			if err := m.ping(); err != nil {
+				m.closeWith(err)
+				return
+			}
+		}
+	}
+}
+
+func (m *Monitor) idle(now time.Time) bool {
+	if m.config.IdleTimeout <= 0 {
+		return false
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return now.Sub(m.lastActivity) > m.config.IdleTimeout
+}
+
+func (m *Monitor) closeWith(reason error) {
+	m.mtx.Lock()
+	if m.reason == nil {
+		m.reason = reason
+	}
+	m.mtx.Unlock()
+
+	m.conn.Close()
+}
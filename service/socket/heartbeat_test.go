@@ -0,0 +1,146 @@
+package socket_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/socket"
+	"github.com/steviesama/nx/service/socket/heartbeat"
+	"github.com/steviesama/nx/service/socket/hub"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// disconnectReason returns the next error sent on gone, failing the test if
+// no client disconnects within a second.
+func disconnectReason(t *testing.T, gone <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-gone:
+		return err
+	case <-time.After(time.Second):
+		t.Fatalf("client wasn't disconnected")
+		return nil
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	s := hub.NewServer()
+	s.Heartbeat = heartbeat.Config{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond, IdleTimeout: 300 * time.Millisecond}
+
+	gone := make(chan error, 1)
+	s.OnDisconnect = func(c *hub.Client, err error) { gone <- err }
+
+	addr := startHub(t, s)
+
+	// A peer that never answers a ping misses its heartbeat.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	if err := disconnectReason(t, gone); err != heartbeat.ErrTimeout {
+		t.Errorf("silent peer disconnected with %v, expected heartbeat.ErrTimeout", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("the connection of a silent peer was left open")
+	}
+
+	// Pings keep a client connected past Timeout, but not past IdleTimeout.
+	start := time.Now()
+	c := dial(t, addr, socket.Config{Heartbeat: heartbeat.Config{Interval: 20 * time.Millisecond}})
+
+	if err := disconnectReason(t, gone); err != heartbeat.ErrIdle || time.Since(start) < 250*time.Millisecond {
+		t.Errorf("idle client disconnected with %v after %s, expected heartbeat.ErrIdle", err, time.Since(start))
+	}
+
+	<-c.Done()
+
+	// A clean close has no reason.
+	c = dial(t, addr, socket.DefaultConfig)
+	c.Close()
+
+	if err := disconnectReason(t, gone); err != nil {
+		t.Errorf("closed client disconnected with %v, expected nil", err)
+	}
+
+	if c.Err() != nil {
+		t.Errorf("Err() after Close() = %v", c.Err())
+	}
+}
+
+func TestHeartbeatSendsAreActivity(t *testing.T) {
+	s := hub.NewServer()
+	s.Heartbeat = heartbeat.Config{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond, IdleTimeout: 150 * time.Millisecond}
+
+	gone := make(chan string, 2)
+	reasons := make(map[string]error)
+	var mtx sync.Mutex
+	s.OnDisconnect = func(c *hub.Client, err error) {
+		mtx.Lock()
+		reasons[c.Id] = err
+		mtx.Unlock()
+		gone <- c.Id
+	}
+
+	addr := startHub(t, s)
+
+	// The server pushes to one client that never talks back, while another
+	// client with a shorter IdleTimeout of its own only publishes.
+	listener := dial(t, addr, socket.Config{Heartbeat: heartbeat.Config{Interval: 20 * time.Millisecond}})
+	publisher := dial(t, addr, socket.Config{Heartbeat: heartbeat.Config{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond, IdleTimeout: 100 * time.Millisecond}})
+
+	for deadline := time.Now().Add(400 * time.Millisecond); time.Now().Before(deadline); {
+		if err := s.Send(&message.Message{To: []byte(listener.Id()), Data: []byte("news")}); err != nil {
+			t.Fatalf("Server.Send() error: %s", err)
+		}
+		if err := publisher.Send(&message.Message{Data: []byte("news")}); err != nil {
+			t.Fatalf("Client.Send() error: %s", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	select {
+	case id := <-gone:
+		t.Fatalf("client %s was disconnected while sending traffic", id)
+	default:
+	}
+
+	// Once the sends stop, both go idle.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-gone:
+		case <-time.After(time.Second):
+			t.Fatalf("idle clients weren't disconnected")
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if err := reasons[listener.Id()]; err != heartbeat.ErrIdle {
+		t.Errorf("the server dropped its listener with %v, expected heartbeat.ErrIdle", err)
+	}
+
+	<-publisher.Done()
+	if err := publisher.Err(); err != heartbeat.ErrIdle {
+		t.Errorf("publisher Err() = %v, expected heartbeat.ErrIdle", err)
+	}
+}
@@ -1,7 +1,416 @@
+// nx/service/socket/hub is the server side of nx/service/socket. A Server
+// accepts connections, assigns every one of them a Client with its own id and
+// routes message.Message frames between clients using the To/From fields.
+// Requests addressed to the server itself are dispatched to the methods
+// registered with HandleMethod. Clients can also join named rooms and post
+// messages to every member of a room at once.
 package hub
 
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/steviesama/nx/rand"
+	"github.com/steviesama/nx/service/socket/heartbeat"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// MethodWelcome is sent by the server to every new client. Its To field holds
+// the id the server assigned to the client.
+const MethodWelcome = "hub.welcome"
+
+// MethodHandlerFunc handles a request for a registered method. The returned
+// payload is sent back as a TypeResponse; a returned error is sent back as a
+// TypeError frame, keeping its code if it is a *message.Error.
+type MethodHandlerFunc func(ctx context.Context, c *Client, payload []byte) ([]byte, error)
+
+// MessageHandlerFunc handles fire-and-forget messages addressed to the server.
+type MessageHandlerFunc func(c *Client, m *message.Message)
+
+// Client is the server side representation of a connected peer.
 type Client struct {
+	// Id is the server assigned identifier other peers address it by.
+	Id string
+
+	conn   net.Conn
+	server *Server
+
+	// rooms is the set of rooms the client is in. It is guarded by the
+	// server's mtxRooms.
+	rooms map[string]struct{}
+
+	// monitor pings the client and drops it when it goes silent.
+	monitor *heartbeat.Monitor
+
+	// queue holds messages waiting for the writer goroutine.
+	queue        chan *message.Message
+	overflow     OverflowPolicy
+	writeTimeout time.Duration
+	sent         uint64
+	dropped      uint64
+
+	// closed is closed, once, when the client is shut down. closeReason is
+	// why, nil when Close was called.
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closeReason error
+}
+
+// RemoteAddr returns the network address of the client.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// TLSState returns the TLS connection state of the client, including any
+// verified client certificates, and whether the client connected over TLS.
+func (c *Client) TLSState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return tlsConn.ConnectionState(), true
+}
+
+// Close disconnects the client and stops its writer. Messages still queued
+// are discarded.
+func (c *Client) Close() error {
+	return c.closeWith(nil)
 }
 
+func (c *Client) closeWith(reason error) error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Server routes messages between connected clients.
 type Server struct {
+	// OnMessage, if set, receives fire-and-forget messages addressed to the
+	// server rather than to another client.
+	OnMessage MessageHandlerFunc
+
+	// Heartbeat configures keepalive pings, read deadlines and idle timeouts
+	// for every client. NewServer sets it to heartbeat.DefaultConfig; it must
+	// not be changed once Serve has been called.
+	Heartbeat heartbeat.Config
+
+	// OnConnect, if set, is called once a client has been registered and
+	// welcomed.
+	OnConnect func(c *Client)
+
+	// OnDisconnect, if set, is called after a client has been removed from the
+	// server and all of its rooms. err is why it went away: nil for a clean
+	// close, heartbeat.ErrTimeout or heartbeat.ErrIdle when the heartbeat
+	// dropped it, or the read error otherwise.
+	OnDisconnect func(c *Client, err error)
+
+	// SendQueueSize is the number of outbound messages buffered per client.
+	// NewServer sets it to DefaultSendQueueSize.
+	SendQueueSize int
+
+	// Overflow decides what happens when a client's send queue is full.
+	// The zero value is OverflowBlock.
+	Overflow OverflowPolicy
+
+	// WriteTimeout bounds each frame write so a client that stops reading
+	// can't stall its writer forever. NewServer sets it to
+	// DefaultWriteTimeout; zero disables it.
+	WriteTimeout time.Duration
+
+	clients    map[string]*Client
+	mtxClients sync.RWMutex
+
+	methods    map[string]MethodHandlerFunc
+	mtxMethods sync.RWMutex
+
+	// rooms maps each room name to its members keyed by client id.
+	rooms    map[string]map[string]*Client
+	mtxRooms sync.RWMutex
+
+	pending *message.Pending
+}
+
+// NewServer creates a Server with no clients or rooms that answers only the
+// built-in room methods.
+func NewServer() *Server {
+	s := &Server{
+		Heartbeat:     heartbeat.DefaultConfig,
+		SendQueueSize: DefaultSendQueueSize,
+		WriteTimeout:  DefaultWriteTimeout,
+		clients:       make(map[string]*Client),
+		methods:       make(map[string]MethodHandlerFunc),
+		rooms:         make(map[string]map[string]*Client),
+		pending:       message.NewPending(),
+	}
+
+	s.registerRoomMethods()
+
+	return s
+}
+
+// HandleMethod registers handler to answer requests for method that are
+// addressed to the server.
+// HandleMethod is thread safe.
+func (s *Server) HandleMethod(method string, handler MethodHandlerFunc) {
+	s.mtxMethods.Lock()
+	s.methods[method] = handler
+	s.mtxMethods.Unlock()
+}
+
+// Client looks up a connected client by id.
+// It returns nil if no such client is connected.
+func (s *Server) Client(id string) *Client {
+	s.mtxClients.RLock()
+	defer s.mtxClients.RUnlock()
+
+	return s.clients[id]
+}
+
+// Serve accepts connections on l and serves each on its own goroutine. Use
+// socket.Listen to serve over TLS or a unix socket.
+// It returns when l.Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("hub.Server.Serve() accept error: %s", err.Error())
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn registers conn as a new client and pumps its messages until it
+// disconnects.
+func (s *Server) ServeConn(conn net.Conn) {
+	// Finish the TLS handshake up front so a peer that never completes it
+	// doesn't get registered, bounded by the heartbeat timeout.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if s.Heartbeat.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.Heartbeat.Timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	queueSize := s.SendQueueSize
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+
+	c := &Client{
+		Id:           rand.Guid(true),
+		conn:         conn,
+		server:       s,
+		rooms:        make(map[string]struct{}),
+		queue:        make(chan *message.Message, queueSize),
+		overflow:     s.Overflow,
+		writeTimeout: s.WriteTimeout,
+		closed:       make(chan struct{}),
+	}
+
+	c.monitor = heartbeat.NewMonitor(conn, s.Heartbeat, func() error {
+		// A dropped ping isn't worth disconnecting over; a client that is
+		// really gone is caught by the read deadline.
+		if err := c.Send(&message.Message{Type: message.TypePing}); err != nil && err != ErrQueueFull {
+			return err
+		}
+		return nil
+	})
+
+	go c.writer()
+
+	s.mtxClients.Lock()
+	s.clients[c.Id] = c
+	s.mtxClients.Unlock()
+
+	var reason error
+
+	defer func() {
+		c.monitor.Stop()
+		c.Close()
+		s.leaveAll(c)
+		s.mtxClients.Lock()
+		delete(s.clients, c.Id)
+		s.mtxClients.Unlock()
+
+		// Nobody is left to answer calls made to the client.
+		s.pending.FailTo(c.Id, message.NewError(message.ErrCodePeerNotFound, "client '"+c.Id+"' disconnected"))
+
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(c, reason)
+		}
+	}()
+
+	welcome := &message.Message{Guid: rand.Guid(true), To: []byte(c.Id), Method: MethodWelcome}
+	if err := c.Send(welcome); err != nil {
+		reason = err
+		return
+	}
+
+	if s.OnConnect != nil {
+		s.OnConnect(c)
+	}
+
+	c.monitor.Start()
+
+	for {
+		m := &message.Message{}
+		err := m.ReceiveMessage(conn)
+
+		switch {
+		case err == io.EOF:
+			return
+		case err != nil:
+			select {
+			case <-c.closed:
+				reason = c.closeReason
+			default:
+				reason = c.monitor.Reason(err)
+			}
+			return
+		}
+
+		switch m.Type {
+		case message.TypePing:
+			c.monitor.Received(false)
+			if err := c.Send(&message.Message{Type: message.TypePong}); err != nil && err != ErrQueueFull {
+				reason = err
+				return
+			}
+			continue
+		case message.TypePong:
+			c.monitor.Received(false)
+			continue
+		}
+
+		c.monitor.Received(true)
+
+		// Clients can't impersonate one another.
+		m.From = []byte(c.Id)
+
+		s.dispatch(c, m)
+	}
+}
+
+// Send routes m to the client named in its To field.
+// It returns an error if that client isn't connected or the write fails.
+func (s *Server) Send(m *message.Message) error {
+	c := s.Client(string(m.To))
+	if c == nil {
+		return message.NewError(message.ErrCodePeerNotFound, "no client '"+string(m.To)+"'")
+	}
+
+	return c.Send(m)
+}
+
+// Call sends a request for method to the client identified by to and waits
+// for its reply, bounded by ctx.
+// It returns the reply payload or the error the client replied with.
+func (s *Server) Call(ctx context.Context, to string, method string, payload []byte) ([]byte, error) {
+	req := message.NewRequest(to, method, payload)
+	ch := s.pending.Add(ctx, req)
+
+	if err := s.Send(req); err != nil {
+		s.pending.Resolve(message.NewErrorResponse(req, err))
+	}
+
+	return s.pending.Wait(ctx, req, ch)
+}
+
+func (s *Server) dispatch(c *Client, m *message.Message) {
+	if len(m.To) > 0 {
+		s.forward(c, m)
+		return
+	}
+
+	if m.Room != "" && m.Type == message.TypeMessage {
+		s.broadcastFrom(c, m)
+		return
+	}
+
+	switch m.Type {
+	case message.TypeRequest:
+		go s.handleRequest(c, m)
+	case message.TypeResponse, message.TypeError:
+		s.pending.Resolve(m)
+	default:
+		if s.OnMessage != nil {
+			s.OnMessage(c, m)
+		}
+	}
+}
+
+// forward relays m to the client it is addressed to. A request to a client
+// that isn't connected is answered with an error frame so the caller doesn't
+// wait for its deadline.
+func (s *Server) forward(from *Client, m *message.Message) {
+	err := s.Send(m)
+	if err == nil {
+		return
+	}
+
+	if m.Type == message.TypeRequest {
+		reply := message.NewErrorResponse(m, err)
+		if sendErr := from.Send(reply); sendErr != nil {
+			fmt.Printf("hub.Server.forward() reply error: %s\n", sendErr.Error())
+		}
+	}
+}
+
+func (s *Server) handleRequest(c *Client, req *message.Message) {
+	// A panicking handler fails its request rather than the whole hub.
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Printf("hub.Server.handleRequest() panic in '%s': %v\n", req.Method, p)
+			err := message.NewError(message.ErrCodeInternal, "method '"+req.Method+"' failed")
+			s.reply(c, message.NewErrorResponse(req, err))
+		}
+	}()
+
+	s.mtxMethods.RLock()
+	handler, ok := s.methods[req.Method]
+	s.mtxMethods.RUnlock()
+
+	var reply *message.Message
+
+	if !ok {
+		err := message.NewError(message.ErrCodeMethodNotFound, "method '"+req.Method+"' is not registered")
+		reply = message.NewErrorResponse(req, err)
+	} else {
+		ctx, cancel := message.ContextFor(context.Background(), req)
+		defer cancel()
+		payload, err := handler(ctx, c, req.Data)
+
+		if err != nil {
+			reply = message.NewErrorResponse(req, err)
+		} else {
+			reply = message.NewResponse(req, payload)
+		}
+	}
+
+	s.reply(c, reply)
+}
+
+// reply sends the server's reply to a request from c.
+func (s *Server) reply(c *Client, reply *message.Message) {
+	// Replies from the server have no sender.
+	reply.From = nil
+
+	if err := c.Send(reply); err != nil {
+		fmt.Printf("hub.Server.handleRequest() reply error: %s\n", err.Error())
+	}
 }
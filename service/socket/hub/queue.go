@@ -0,0 +1,157 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// OverflowPolicy decides what Client.Send does when the client's send queue
+// is full because the client isn't reading fast enough.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Send wait for room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued message to make room.
+	OverflowDropOldest
+	// OverflowDropNewest discards the message being sent and returns
+	// ErrQueueFull.
+	OverflowDropNewest
+	// OverflowDisconnect drops the client and returns ErrQueueFull.
+	OverflowDisconnect
+)
+
+// DefaultSendQueueSize is the send queue capacity NewServer configures.
+const DefaultSendQueueSize = 256
+
+// DefaultWriteTimeout is the per-frame write deadline NewServer configures.
+const DefaultWriteTimeout = 30 * time.Second
+
+// ErrQueueFull is returned by Client.Send when the message was not queued
+// because the client's send queue is full.
+var ErrQueueFull = message.NewError(message.ErrCodeInternal, "client send queue is full")
+
+// QueueStats is a snapshot of a client's send queue.
+type QueueStats struct {
+	// Depth is the number of messages waiting to be written.
+	Depth int `json:"Depth"`
+	// Capacity is the size of the queue.
+	Capacity int `json:"Capacity"`
+	// Sent counts the messages written to the connection.
+	Sent uint64 `json:"Sent"`
+	// Dropped counts the messages discarded by the overflow policy.
+	Dropped uint64 `json:"Dropped"`
+}
+
+// Send queues m to be written to the client by its writer goroutine. When the
+// queue is full the server's Overflow policy decides what happens.
+// It returns ErrQueueFull if m was dropped, message.ErrClosed if the client
+// is gone, or nil once m is queued.
+// It is safe for concurrent use.
+func (c *Client) Send(m *message.Message) error {
+	select {
+	case <-c.closed:
+		return message.ErrClosed
+	default:
+	}
+
+	// Fast path: there's room in the queue.
+	select {
+	case c.queue <- m:
+		return nil
+	default:
+	}
+
+	switch c.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.queue <- m:
+				return nil
+			case <-c.closed:
+				return message.ErrClosed
+			default:
+			}
+			// Make room; the writer may have beaten us to it, which is fine.
+			select {
+			case <-c.queue:
+				atomic.AddUint64(&c.dropped, 1)
+			default:
+			}
+		}
+	case OverflowDropNewest:
+		atomic.AddUint64(&c.dropped, 1)
+		return ErrQueueFull
+	case OverflowDisconnect:
+		atomic.AddUint64(&c.dropped, 1)
+		c.closeWith(ErrQueueFull)
+		return ErrQueueFull
+	default:
+		select {
+		case c.queue <- m:
+			return nil
+		case <-c.closed:
+			return message.ErrClosed
+		}
+	}
+}
+
+// QueueDepth returns the number of messages waiting to be written to the
+// client.
+func (c *Client) QueueDepth() int {
+	return len(c.queue)
+}
+
+// Stats returns a snapshot of the client's send queue.
+func (c *Client) Stats() QueueStats {
+	return QueueStats{
+		Depth:    len(c.queue),
+		Capacity: cap(c.queue),
+		Sent:     atomic.LoadUint64(&c.sent),
+		Dropped:  atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// Stats returns a snapshot of every connected client's send queue keyed by
+// client id.
+func (s *Server) Stats() map[string]QueueStats {
+	s.mtxClients.RLock()
+	defer s.mtxClients.RUnlock()
+
+	stats := make(map[string]QueueStats, len(s.clients))
+	for id, c := range s.clients {
+		stats[id] = c.Stats()
+	}
+
+	return stats
+}
+
+// writer is the only goroutine that writes to the client's connection. It
+// drains the send queue until the client is closed, dropping the client on
+// the first failed write.
+func (c *Client) writer() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case m := <-c.queue:
+			if c.writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			}
+
+			if err := m.SendMessage(c.conn); err != nil {
+				c.closeWith(err)
+				return
+			}
+
+			atomic.AddUint64(&c.sent, 1)
+
+			// Pushing to a client that never talks back keeps it alive.
+			if m.Type != message.TypePing && m.Type != message.TypePong {
+				c.monitor.Touch()
+			}
+		}
+	}
+}
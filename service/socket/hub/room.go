@@ -0,0 +1,227 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/steviesama/nx/rand"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// Built-in methods every Server answers. Each takes the room name as its
+// payload; MethodRooms and MethodMembers reply with a JSON array of strings.
+const (
+	MethodJoin    = "hub.join"
+	MethodLeave   = "hub.leave"
+	MethodRooms   = "hub.rooms"
+	MethodMembers = "hub.members"
+)
+
+// Events broadcast to the members of a room. Their From field holds the id of
+// the client that joined or left and their Room field the room's name.
+const (
+	EventJoined = "hub.joined"
+	EventLeft   = "hub.left"
+)
+
+// registerRoomMethods adds the built-in room methods to s.
+func (s *Server) registerRoomMethods() {
+	s.HandleMethod(MethodJoin, func(ctx context.Context, c *Client, payload []byte) ([]byte, error) {
+		if len(payload) == 0 {
+			return nil, message.NewError(message.ErrCodeBadRequest, "room name is required")
+		}
+		s.Join(c, string(payload))
+		return nil, nil
+	})
+	s.HandleMethod(MethodLeave, func(ctx context.Context, c *Client, payload []byte) ([]byte, error) {
+		s.Leave(c, string(payload))
+		return nil, nil
+	})
+	s.HandleMethod(MethodRooms, func(ctx context.Context, c *Client, payload []byte) ([]byte, error) {
+		return json.Marshal(s.Rooms())
+	})
+	s.HandleMethod(MethodMembers, func(ctx context.Context, c *Client, payload []byte) ([]byte, error) {
+		return json.Marshal(s.Members(string(payload)))
+	})
+}
+
+// Join adds c to room, creating the room if it doesn't exist, and tells the
+// room's other members with an EventJoined message.
+// It returns false if c was already a member or has disconnected.
+func (s *Server) Join(c *Client, room string) bool {
+	s.mtxRooms.Lock()
+	// A closed client has left, or is leaving, all of its rooms; adding it
+	// back would leave it a member forever.
+	select {
+	case <-c.closed:
+		s.mtxRooms.Unlock()
+		return false
+	default:
+	}
+	members, ok := s.rooms[room]
+	if !ok {
+		members = make(map[string]*Client)
+		s.rooms[room] = members
+	}
+	if _, ok := members[c.Id]; ok {
+		s.mtxRooms.Unlock()
+		return false
+	}
+	members[c.Id] = c
+	c.rooms[room] = struct{}{}
+	s.mtxRooms.Unlock()
+
+	s.Broadcast(room, &message.Message{Method: EventJoined, From: []byte(c.Id)}, c.Id)
+
+	return true
+}
+
+// Leave removes c from room, dropping the room once it is empty, and tells
+// the remaining members with an EventLeft message.
+// It returns false if c wasn't a member.
+func (s *Server) Leave(c *Client, room string) bool {
+	s.mtxRooms.Lock()
+	members, ok := s.rooms[room]
+	if !ok {
+		s.mtxRooms.Unlock()
+		return false
+	}
+	if _, ok := members[c.Id]; !ok {
+		s.mtxRooms.Unlock()
+		return false
+	}
+	delete(members, c.Id)
+	delete(c.rooms, room)
+	if len(members) == 0 {
+		delete(s.rooms, room)
+	}
+	s.mtxRooms.Unlock()
+
+	s.Broadcast(room, &message.Message{Method: EventLeft, From: []byte(c.Id)}, c.Id)
+
+	return true
+}
+
+// leaveAll removes c from every room it is a member of. It is called when c
+// disconnects, once c is closed so Join can't add it back.
+func (s *Server) leaveAll(c *Client) {
+	for _, room := range s.RoomsOf(c.Id) {
+		s.Leave(c, room)
+	}
+}
+
+// Broadcast sends a copy of m to every member of room except the client
+// identified by except, which may be empty. Each copy gets its own Guid and
+// has its To and Room fields set.
+// It returns the number of members the message was delivered to.
+func (s *Server) Broadcast(room string, m *message.Message, except string) int {
+	s.mtxRooms.RLock()
+	targets := make([]*Client, 0, len(s.rooms[room]))
+	for id, c := range s.rooms[room] {
+		if id != except {
+			targets = append(targets, c)
+		}
+	}
+	s.mtxRooms.RUnlock()
+
+	sent := 0
+	for _, c := range targets {
+		cp := *m
+		cp.Guid = rand.Guid(true)
+		cp.To = []byte(c.Id)
+		cp.Room = room
+		if err := c.Send(&cp); err != nil {
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
+// Rooms returns the names of every room with at least one member, sorted.
+func (s *Server) Rooms() []string {
+	s.mtxRooms.RLock()
+	defer s.mtxRooms.RUnlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+
+	return rooms
+}
+
+// Members returns the ids of the clients in room, sorted.
+func (s *Server) Members(room string) []string {
+	s.mtxRooms.RLock()
+	defer s.mtxRooms.RUnlock()
+
+	ids := make([]string, 0, len(s.rooms[room]))
+	for id := range s.rooms[room] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// IsMember reports whether the client identified by id is in room.
+func (s *Server) IsMember(room string, id string) bool {
+	s.mtxRooms.RLock()
+	defer s.mtxRooms.RUnlock()
+
+	_, ok := s.rooms[room][id]
+	return ok
+}
+
+// RoomsOf returns the rooms the client identified by id is a member of,
+// sorted.
+func (s *Server) RoomsOf(id string) []string {
+	c := s.Client(id)
+	if c == nil {
+		return nil
+	}
+
+	s.mtxRooms.RLock()
+	defer s.mtxRooms.RUnlock()
+
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+
+	return rooms
+}
+
+// Clients returns the ids of every connected client, sorted.
+func (s *Server) Clients() []string {
+	s.mtxClients.RLock()
+	defer s.mtxClients.RUnlock()
+
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Online reports whether the client identified by id is connected.
+func (s *Server) Online(id string) bool {
+	return s.Client(id) != nil
+}
+
+// broadcastFrom relays a room message sent by c to the room's other members.
+// Clients can only post to rooms they have joined.
+func (s *Server) broadcastFrom(c *Client, m *message.Message) {
+	if !s.IsMember(m.Room, c.Id) {
+		return
+	}
+
+	s.Broadcast(m.Room, m, c.Id)
+}
@@ -0,0 +1,53 @@
+package message
+
+import (
+	"context"
+	"fmt"
+)
+
+// Error codes carried by TypeError replies.
+const (
+	// ErrCodeInternal means the handler failed without a more specific code.
+	ErrCodeInternal = 1
+	// ErrCodeMethodNotFound means no handler is registered for the method.
+	ErrCodeMethodNotFound = 2
+	// ErrCodePeerNotFound means the To field did not match a connected peer.
+	ErrCodePeerNotFound = 3
+	// ErrCodeTimeout means the request deadline passed before a reply.
+	ErrCodeTimeout = 4
+	// ErrCodeBadRequest means the request frame itself was malformed.
+	ErrCodeBadRequest = 5
+)
+
+// Error is the structured error frame sent back in TypeError replies so that
+// failures survive the trip across the wire with their code intact.
+type Error struct {
+	Code    int    `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// Error satisfies the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("socket error %d: %s", e.Code, e.Message)
+}
+
+// NewError builds an *Error with the given code and message.
+func NewError(code int, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// AsError converts err into an *Error suitable for a TypeError reply.
+// It returns err itself if it is already an *Error, maps an expired context
+// to ErrCodeTimeout, and otherwise wraps its text as ErrCodeInternal.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	if err == context.DeadlineExceeded {
+		return &Error{Code: ErrCodeTimeout, Message: err.Error()}
+	}
+	return &Error{Code: ErrCodeInternal, Message: err.Error()}
+}
@@ -1,9 +1,18 @@
 package message
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// MaxFrameSize is the largest encoded message, in bytes, ReceiveMessage will
+// accept. It keeps a corrupt or hostile length prefix from allocating
+// unbounded memory.
+var MaxFrameSize uint32 = 16 << 20
+
 type Sender interface {
 	SendMessage(w io.Writer) error
 }
@@ -17,6 +26,28 @@ type SendReceiver interface {
 	Receiver
 }
 
+// Type describes what a Message is used for so the receiving side knows how
+// to dispatch it.
+type Type string
+
+const (
+	// TypeMessage is a fire-and-forget message. It is the zero value so
+	// messages built without a Type keep their original meaning.
+	TypeMessage Type = ""
+	// TypeRequest is a message that expects a TypeResponse or TypeError reply
+	// carrying its Guid in CorrelationId.
+	TypeRequest Type = "request"
+	// TypeResponse is a successful reply to a TypeRequest.
+	TypeResponse Type = "response"
+	// TypeError is a failed reply to a TypeRequest. Its Error field describes
+	// the failure.
+	TypeError Type = "error"
+	// TypePing is a heartbeat the receiver answers with a TypePong.
+	TypePing Type = "ping"
+	// TypePong answers a TypePing.
+	TypePong Type = "pong"
+)
+
 type Message struct {
 	Guid        string `json:"Guid"`
 	From        []byte `json:"From"`
@@ -24,4 +55,117 @@ type Message struct {
 	TotalSize   int    `json:"TotalSize"`
 	BytesCopied int    `json:"BytesCopied"`
 	Data        []byte `json:"Data"`
+	// Type determines how the message is dispatched.
+	Type Type `json:"Type,omitempty"`
+	// CorrelationId holds the Guid of the request a reply answers.
+	CorrelationId string `json:"CorrelationId,omitempty"`
+	// Method names the handler a TypeRequest should be dispatched to.
+	Method string `json:"Method,omitempty"`
+	// Deadline is the caller's deadline in unix milliseconds, if it has one.
+	Deadline int64 `json:"Deadline,omitempty"`
+	// Error is set on TypeError replies.
+	Error *Error `json:"Error,omitempty"`
+	// Room, when set on a message without a To, broadcasts it to every member
+	// of the named room.
+	Room string `json:"Room,omitempty"`
+}
+
+// SendMessage encodes m as JSON and writes it to w prefixed with its length
+// as a big endian uint32.
+func (m *Message) SendMessage(w io.Writer) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("message.SendMessage() marshal error: %s", err.Error())
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("message.SendMessage() write error: %w", err)
+	}
+
+	return nil
+}
+
+// ReceiveMessage reads a single length prefixed frame written by SendMessage
+// from r and decodes it into m.
+// It returns io.EOF untouched when r is closed before a frame starts so
+// callers can tell a clean disconnect from a broken one.
+func (m *Message) ReceiveMessage(r io.Reader) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("message.ReceiveMessage() header read error: %w", err)
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return errors.New("message.ReceiveMessage() frame exceeds MaxFrameSize")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("message.ReceiveMessage() body read error: %w", err)
+	}
+
+	*m = Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return fmt.Errorf("message.ReceiveMessage() unmarshal error: %s", err.Error())
+	}
+
+	return nil
+}
+
+// NewRequest builds a TypeRequest message with a fresh Guid that asks the
+// peer identified by to to run method with payload.
+func NewRequest(to string, method string, payload []byte) *Message {
+	return &Message{
+		Guid:   newGuid(),
+		To:     []byte(to),
+		Type:   TypeRequest,
+		Method: method,
+		Data:   payload,
+	}
+}
+
+// NewResponse builds the TypeResponse reply to req carrying payload.
+func NewResponse(req *Message, payload []byte) *Message {
+	return &Message{
+		Guid:          newGuid(),
+		To:            req.From,
+		Type:          TypeResponse,
+		CorrelationId: req.Guid,
+		Method:        req.Method,
+		Data:          payload,
+	}
+}
+
+// NewErrorResponse builds the TypeError reply to req. If err is not already
+// an *Error it is wrapped as ErrCodeInternal.
+func NewErrorResponse(req *Message, err error) *Message {
+	return &Message{
+		Guid:          newGuid(),
+		To:            req.From,
+		Type:          TypeError,
+		CorrelationId: req.Guid,
+		Method:        req.Method,
+		Error:         AsError(err),
+	}
+}
+
+// Result turns a reply into the payload/error pair a caller expects.
+// It returns the Error field for TypeError replies and Data otherwise.
+func (m *Message) Result() ([]byte, error) {
+	if m.Type == TypeError {
+		if m.Error == nil {
+			return nil, &Error{Code: ErrCodeInternal, Message: "missing error frame"}
+		}
+		return nil, m.Error
+	}
+
+	return m.Data, nil
 }
@@ -0,0 +1,159 @@
+package message
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/steviesama/nx/rand"
+)
+
+// DefaultCallTimeout bounds how long Pending.Wait blocks when the caller's
+// context has no deadline of its own.
+var DefaultCallTimeout = 30 * time.Second
+
+// ErrClosed is returned to callers still waiting on a reply when the
+// connection goes away.
+var ErrClosed = NewError(ErrCodeInternal, "connection closed")
+
+// Pending tracks requests that are waiting for a reply, keyed by the Guid
+// the reply will carry in its CorrelationId. It is safe for concurrent use.
+type Pending struct {
+	mtx    sync.Mutex
+	calls  map[string]*pendingCall
+	closed bool
+}
+
+// pendingCall is a request waiting in Pending.
+type pendingCall struct {
+	to string
+	ch chan *Message
+}
+
+// NewPending creates an empty Pending.
+func NewPending() *Pending {
+	return &Pending{calls: make(map[string]*pendingCall)}
+}
+
+// Add registers req as awaiting a reply and stamps its Deadline from ctx.
+// It returns the channel the reply will be delivered on.
+func (p *Pending) Add(ctx context.Context, req *Message) <-chan *Message {
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Deadline = deadline.UnixNano() / int64(time.Millisecond)
+	}
+
+	ch := make(chan *Message, 1)
+
+	p.mtx.Lock()
+	if p.closed {
+		close(ch)
+	} else {
+		p.calls[req.Guid] = &pendingCall{to: string(req.To), ch: ch}
+	}
+	p.mtx.Unlock()
+
+	return ch
+}
+
+// Resolve delivers reply to the request it correlates with. Only the peer
+// the request was sent to can answer it; a reply without a sender comes from
+// the hub itself, which stamps the sender on every frame it relays.
+// It returns false if nothing was waiting on it, i.e. the caller already
+// gave up, or if reply came from another peer.
+func (p *Pending) Resolve(reply *Message) bool {
+	p.mtx.Lock()
+	call, ok := p.calls[reply.CorrelationId]
+	if ok && len(reply.From) > 0 && string(reply.From) != call.to {
+		ok = false
+	}
+	if ok {
+		delete(p.calls, reply.CorrelationId)
+	}
+	p.mtx.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	call.ch <- reply
+	return true
+}
+
+// FailTo answers every outstanding request addressed to the peer identified
+// by to with err. It is used when that peer disconnects so callers don't wait
+// out their deadline.
+func (p *Pending) FailTo(to string, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for id, call := range p.calls {
+		if call.to != to {
+			continue
+		}
+		delete(p.calls, id)
+		// The channel is buffered and only ever receives one reply.
+		call.ch <- &Message{Type: TypeError, CorrelationId: id, Error: AsError(err)}
+	}
+}
+
+// Wait blocks until the reply to req arrives on ch, ctx is done, or
+// DefaultCallTimeout passes when ctx has no deadline.
+// It returns the reply's payload or the error it carried.
+func (p *Pending) Wait(ctx context.Context, req *Message, ch <-chan *Message) ([]byte, error) {
+	defer p.remove(req.Guid)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return reply.Result()
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, NewError(ErrCodeTimeout, "call to '"+req.Method+"' timed out")
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Close fails every outstanding call with ErrClosed and rejects new ones.
+func (p *Pending) Close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+
+	for id, call := range p.calls {
+		close(call.ch)
+		delete(p.calls, id)
+	}
+}
+
+func (p *Pending) remove(id string) {
+	p.mtx.Lock()
+	delete(p.calls, id)
+	p.mtx.Unlock()
+}
+
+// ContextFor derives the context a request handler should run under from the
+// Deadline the caller stamped on req.
+func ContextFor(parent context.Context, req *Message) (context.Context, context.CancelFunc) {
+	if req.Deadline == 0 {
+		return context.WithCancel(parent)
+	}
+	deadline := time.Unix(0, req.Deadline*int64(time.Millisecond))
+	return context.WithDeadline(parent, deadline)
+}
+
+func newGuid() string {
+	return rand.Guid(true)
+}
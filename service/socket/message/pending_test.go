@@ -0,0 +1,51 @@
+package message_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+func TestPendingResolve(t *testing.T) {
+	p := message.NewPending()
+	ctx := context.Background()
+
+	req := message.NewRequest("alice", "hello", nil)
+	ch := p.Add(ctx, req)
+
+	spoofed := message.NewResponse(req, []byte("spoofed"))
+	spoofed.From = []byte("mallory")
+
+	if p.Resolve(spoofed) {
+		t.Errorf("Resolve() accepted a reply from a peer the request wasn't sent to")
+	}
+
+	reply := message.NewResponse(req, []byte("hi"))
+	reply.From = []byte("alice")
+
+	if !p.Resolve(reply) {
+		t.Fatalf("Resolve() rejected the callee's reply")
+	}
+
+	if payload, err := p.Wait(ctx, req, ch); err != nil || string(payload) != "hi" {
+		t.Errorf("Wait() = %q, %v", payload, err)
+	}
+
+	if p.Resolve(reply) {
+		t.Errorf("Resolve() of an answered request succeeded")
+	}
+
+	// Replies without a sender come from the hub, e.g. when the callee isn't
+	// connected.
+	req = message.NewRequest("bob", "hello", nil)
+	ch = p.Add(ctx, req)
+
+	if !p.Resolve(message.NewErrorResponse(req, message.NewError(message.ErrCodePeerNotFound, "no client 'bob'"))) {
+		t.Fatalf("Resolve() rejected the hub's reply")
+	}
+
+	if _, err := p.Wait(ctx, req, ch); err == nil {
+		t.Errorf("Wait() of an error reply succeeded")
+	}
+}
@@ -0,0 +1,134 @@
+package socket_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/socket/heartbeat"
+	"github.com/steviesama/nx/service/socket/hub"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// stalledClient connects a peer to a hub using policy that never reads, so
+// the hub's writes back up into the client's send queue.
+// It returns the hub's side of the client and a channel receiving the reason
+// it disconnected.
+func stalledClient(t *testing.T, policy hub.OverflowPolicy) (*hub.Client, <-chan error) {
+	t.Helper()
+
+	s := hub.NewServer()
+	s.Heartbeat = heartbeat.Config{}
+	s.SendQueueSize = 4
+	s.Overflow = policy
+	s.WriteTimeout = 200 * time.Millisecond
+
+	connected := make(chan *hub.Client, 1)
+	disconnected := make(chan error, 1)
+	s.OnConnect = func(c *hub.Client) { connected <- c }
+	s.OnDisconnect = func(c *hub.Client, err error) { disconnected <- err }
+
+	conn, err := net.Dial("tcp", startHub(t, s))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return <-connected, disconnected
+}
+
+// flood sends count large messages to c.
+// It returns the errors Send returned.
+func flood(c *hub.Client, count int) []error {
+	var errs []error
+	data := make([]byte, 64<<10)
+
+	for i := 0; i < count; i++ {
+		if err := c.Send(&message.Message{Data: data}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	c, _ := stalledClient(t, hub.OverflowDropOldest)
+
+	if errs := flood(c, 200); len(errs) != 0 {
+		t.Errorf("Send() errors = %v, expected every message queued", errs)
+	}
+
+	if stats := c.Stats(); stats.Dropped == 0 || stats.Depth != stats.Capacity {
+		t.Errorf("Stats() = %+v, expected a full queue and dropped messages", stats)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	c, disconnected := stalledClient(t, hub.OverflowDropNewest)
+
+	errs := flood(c, 200)
+	if len(errs) == 0 || !errors.Is(errs[0], hub.ErrQueueFull) {
+		t.Errorf("Send() errors = %v, expected ErrQueueFull", errs)
+	}
+
+	if stats := c.Stats(); stats.Dropped != uint64(len(errs)) {
+		t.Errorf("Stats() = %+v, expected %d dropped", stats, len(errs))
+	}
+
+	select {
+	case err := <-disconnected:
+		t.Errorf("client disconnected with %v, expected it kept", err)
+	default:
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	c, disconnected := stalledClient(t, hub.OverflowDisconnect)
+
+	errs := flood(c, 200)
+	if len(errs) == 0 || !errors.Is(errs[0], hub.ErrQueueFull) {
+		t.Fatalf("Send() errors = %v, expected ErrQueueFull", errs)
+	}
+
+	// Once dropped the client takes no more messages.
+	for _, err := range errs[1:] {
+		if err != message.ErrClosed {
+			t.Errorf("Send() to a dropped client error = %v, expected message.ErrClosed", err)
+			break
+		}
+	}
+
+	select {
+	case err := <-disconnected:
+		if !errors.Is(err, hub.ErrQueueFull) {
+			t.Errorf("client disconnected with %v, expected ErrQueueFull", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client wasn't disconnected")
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	c, disconnected := stalledClient(t, hub.OverflowBlock)
+
+	// Send blocks until the write timeout drops the stalled client.
+	errs := flood(c, 200)
+	if len(errs) == 0 || errs[0] != message.ErrClosed {
+		t.Errorf("Send() errors = %v, expected message.ErrClosed once the write timed out", errs)
+	}
+
+	if stats := c.Stats(); stats.Dropped != 0 {
+		t.Errorf("Stats() = %+v, expected nothing dropped", stats)
+	}
+
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Errorf("client disconnected without an error")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client wasn't disconnected")
+	}
+}
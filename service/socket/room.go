@@ -0,0 +1,60 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/steviesama/nx/rand"
+	"github.com/steviesama/nx/service/socket/hub"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// Join asks the server to add the client to room. Other members are told
+// with a hub.EventJoined message.
+func (c *Client) Join(ctx context.Context, room string) error {
+	_, err := c.Call(ctx, "", hub.MethodJoin, []byte(room))
+	return err
+}
+
+// Leave asks the server to remove the client from room. Remaining members are
+// told with a hub.EventLeft message.
+func (c *Client) Leave(ctx context.Context, room string) error {
+	_, err := c.Call(ctx, "", hub.MethodLeave, []byte(room))
+	return err
+}
+
+// Rooms returns the names of every room on the server with at least one
+// member.
+func (c *Client) Rooms(ctx context.Context) ([]string, error) {
+	return c.callStrings(ctx, hub.MethodRooms, nil)
+}
+
+// Members returns the ids of the clients in room.
+func (c *Client) Members(ctx context.Context, room string) ([]string, error) {
+	return c.callStrings(ctx, hub.MethodMembers, []byte(room))
+}
+
+// SendTo sends data directly to the client identified by to.
+func (c *Client) SendTo(to string, data []byte) error {
+	return c.Send(&message.Message{Guid: rand.Guid(true), To: []byte(to), Data: data})
+}
+
+// SendRoom sends data to every other member of room. The client must have
+// joined room first.
+func (c *Client) SendRoom(room string, data []byte) error {
+	return c.Send(&message.Message{Guid: rand.Guid(true), Room: room, Data: data})
+}
+
+func (c *Client) callStrings(ctx context.Context, method string, payload []byte) ([]string, error) {
+	data, err := c.Call(ctx, "", method, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, message.NewError(message.ErrCodeBadRequest, "malformed '"+method+"' reply")
+	}
+
+	return values, nil
+}
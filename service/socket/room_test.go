@@ -0,0 +1,95 @@
+package socket_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/steviesama/nx/service/socket"
+	"github.com/steviesama/nx/service/socket/hub"
+	"github.com/steviesama/nx/service/socket/message"
+)
+
+// next returns the next message received on ch, failing the test if none
+// arrives within a second.
+func next(t *testing.T, ch <-chan *message.Message) *message.Message {
+	t.Helper()
+
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("no message received")
+		return nil
+	}
+}
+
+func TestRooms(t *testing.T) {
+	s := hub.NewServer()
+
+	connected := make(chan *hub.Client, 2)
+	disconnected := make(chan *hub.Client, 2)
+	s.OnConnect = func(c *hub.Client) { connected <- c }
+	s.OnDisconnect = func(c *hub.Client, err error) { disconnected <- c }
+
+	addr := startHub(t, s)
+	ctx := context.Background()
+
+	a := dial(t, addr, socket.DefaultConfig)
+	received := make(chan *message.Message, 10)
+	a.OnMessage = func(m *message.Message) { received <- m }
+	<-connected
+
+	b := dial(t, addr, socket.DefaultConfig)
+	hubB := <-connected
+
+	if err := a.Join(ctx, "lobby"); err != nil {
+		t.Fatalf("Join() error: %s", err)
+	}
+
+	if err := b.Join(ctx, "lobby"); err != nil {
+		t.Fatalf("Join() error: %s", err)
+	}
+
+	if m := next(t, received); m.Method != hub.EventJoined || string(m.From) != b.Id() || m.Room != "lobby" {
+		t.Errorf("join event = %+v", m)
+	}
+
+	b.SendRoom("lobby", []byte("to the room"))
+	if m := next(t, received); string(m.Data) != "to the room" || string(m.From) != b.Id() || m.Room != "lobby" {
+		t.Errorf("room message = %+v", m)
+	}
+
+	b.SendTo(a.Id(), []byte("direct"))
+	if m := next(t, received); string(m.Data) != "direct" || m.Room != "" {
+		t.Errorf("direct message = %+v", m)
+	}
+
+	if members, err := a.Members(ctx, "lobby"); err != nil || len(members) != 2 {
+		t.Errorf("Members() = %v, %v", members, err)
+	}
+
+	b.Close()
+
+	if m := next(t, received); m.Method != hub.EventLeft || string(m.From) != b.Id() {
+		t.Errorf("leave event = %+v", m)
+	}
+
+	<-disconnected
+
+	if members := s.Members("lobby"); len(members) != 1 || members[0] != a.Id() {
+		t.Errorf("Members() after a disconnect = %v", members)
+	}
+
+	if rooms := s.RoomsOf(b.Id()); len(rooms) != 0 {
+		t.Errorf("RoomsOf() a disconnected client = %v", rooms)
+	}
+
+	if s.Join(hubB, "lobby") {
+		t.Errorf("Join() of a disconnected client succeeded")
+	}
+
+	if members := s.Members("lobby"); len(members) != 1 {
+		t.Errorf("Members() after joining a disconnected client = %v", members)
+	}
+}
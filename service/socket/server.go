@@ -1 +1,80 @@
 package socket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Listen announces on addr for network, which is "tcp" or "unix". For "unix"
+// addr is the socket's path; a stale socket file left behind by a previous run
+// is removed first. If tlsConfig is not nil, accepted connections are wrapped
+// in TLS. Set tlsConfig.ClientAuth to require client certificates.
+// It returns the listener, or an error if it couldn't be created.
+func Listen(network, addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("socket.Listen() error: %s", err.Error())
+	}
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	return l, nil
+}
+
+// DialConn connects to addr on network, "tcp" or "unix", completing a TLS
+// handshake when tlsConfig is not nil.
+// It returns the connection, or an error if it couldn't be established.
+func DialConn(ctx context.Context, network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if tlsConfig != nil {
+		d := tls.Dialer{Config: tlsConfig}
+		conn, err = d.DialContext(ctx, network, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("socket.DialConn() error: %s", err.Error())
+	}
+
+	return conn, nil
+}
+
+// removeStaleSocket deletes a leftover unix socket file at path. Anything
+// else found at path is left alone and reported as an error.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("socket.Listen() stat error: %s", err.Error())
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New("socket.Listen() '" + path + "' exists and is not a socket")
+	}
+
+	// Only remove the socket if nobody is listening on it anymore.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("socket.Listen() '" + path + "' is in use")
+	}
+
+	return os.Remove(path)
+}